@@ -2,10 +2,13 @@
 package cloudwatch
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/newrelic/aws-unified-lambda-logging/common"
@@ -18,7 +21,11 @@ var log = logger.NewLogrusLogger(logger.WithDebugLevel())
 
 // GetLogs batches logs from CloudWatch into DetailedJson format and sends them to the specified channel.
 // It returns an error if there is a problem retrieving or sending the logs.
-func GetLogs(cloudwatchLogsData events.CloudwatchLogsData, awsConfiguration util.AWSConfiguration, channel chan common.DetailedLogsBatch) error {
+// Once the context is done the remaining log events are not read, and a util.TimeoutError records them
+// when the deadline of the invocation is approaching.
+// The log events read and their batches are recorded in the metrics of the context, with the log group as dimension.
+func GetLogs(ctx context.Context, cloudwatchLogsData events.CloudwatchLogsData, awsConfiguration util.AWSConfiguration, channel chan common.DetailedLogsBatch) error {
+	start := time.Now()
 
 	// Following are the common attributes for all log messages.
 	// All the attributes are compulsory for New Relic to generate Unique Entity ID.
@@ -35,24 +42,29 @@ func GetLogs(cloudwatchLogsData events.CloudwatchLogsData, awsConfiguration util
 
 	if err := util.AddCustomMetaData(os.Getenv(common.CustomMetaData), attributes); err != nil {
 		log.Errorf("failed to add custom metadata %v", err)
-		return err
+		return util.NewStageError(util.StageParse, err)
 	}
 
-	if err := batchLogEntries(cloudwatchLogsData, channel, attributes); err != nil {
-		return err
+	assembler, err := util.NewMultilineAssemblerForLogGroup(os.Getenv(common.MultilineConfig), cloudwatchLogsData.LogGroup)
+	if err != nil {
+		log.Errorf("failed to load multiline config: %v", err)
+		return util.NewStageError(util.StageParse, err)
 	}
-	return nil
+
+	err = batchLogEntries(ctx, cloudwatchLogsData, channel, attributes, assembler)
+	util.MetricsFromContext(ctx).ObserveDuration(util.MetricSourceDuration, time.Since(start), util.SourceDimensions(attributes))
+	return err
 }
 
 // batchLogEntries processes a batch of CloudWatch log entries and splits them into smaller batches based on payload size and message count
 // and produces log data batches to a channel.
-// The function returns an error if any.
-func batchLogEntries(cloudwatchLogsData events.CloudwatchLogsData, channel chan common.DetailedLogsBatch, attributes common.LogAttributes) error {
-	batchSize := 0
-
-	messageCount := 0
-
-	var currentBatch common.LogData
+// Log events are merged by the multiline assembler before batching; a merged entry keeps the timestamp of its first event.
+// Events read before the context is done are flushed, and the function returns an error recording the events left unread.
+func batchLogEntries(ctx context.Context, cloudwatchLogsData events.CloudwatchLogsData, channel chan common.DetailedLogsBatch, attributes common.LogAttributes, assembler *util.MultilineAssembler) error {
+	metrics := util.MetricsFromContext(ctx)
+	dimensions := util.SourceDimensions(attributes)
+	batcher := util.NewBatcher(channel, attributes, util.DefaultBatchLimits(), util.MetricsBatchHooks(metrics, dimensions))
+	defer batcher.Close()
 
 	// Regular expression to match the pattern "RequestId: <UUID> <message>"
 	regularExpression := regexp.MustCompile(common.RequestIDRegex)
@@ -63,12 +75,25 @@ func batchLogEntries(cloudwatchLogsData events.CloudwatchLogsData, channel chan
 	// Check if the log group name starts with "/aws/lambda"
 	isLambdaLogGroup := strings.HasPrefix(cloudwatchLogsData.LogGroup, common.LambdaLogGroup)
 
-	for _, record := range cloudwatchLogsData.LogEvents {
-		messages := util.SplitLargeMessages(record.Message)
-		for _, message := range messages {
+	splitJSONAware := os.Getenv(common.SplitJSONAware) == "true"
+	orderingAttributes := os.Getenv(common.OrderingAttributes) == "true"
+
+	addEntry := func(assembled util.AssembledEntry) {
+		record := cloudwatchLogsData.LogEvents[assembled.FirstLine]
+		fragments := util.SplitLogMessage(assembled.Message, splitJSONAware)
+		for _, fragment := range fragments {
+			message := fragment.Message
 
 			// logAttribute is a map of attributes for each individual log message.
 			logAttribute := common.LogAttributes{}
+			for name, value := range fragment.Attributes {
+				logAttribute[name] = value
+			}
+			if orderingAttributes {
+				// The index of the first event in the batch orders entries sharing a timestamp.
+				logAttribute["logEventId"] = record.ID
+				logAttribute["logSequenceNumber"] = assembled.FirstLine
+			}
 
 			entry := common.Log{
 				Timestamp:  strconv.FormatInt(record.Timestamp, 10),
@@ -79,24 +104,50 @@ func batchLogEntries(cloudwatchLogsData events.CloudwatchLogsData, channel chan
 				lastRequestID = util.AddRequestID(message, logAttribute, lastRequestID, regularExpression)
 			}
 
-			if batchSize+len(message) > common.MaxPayloadSize || messageCount >= common.MaxPayloadMessages {
-				util.ProduceMessageToChannel(channel, currentBatch, attributes)
-				currentBatch = nil
-				batchSize = 0
-				messageCount = 0
-			}
+			batcher.Add(entry)
+		}
+	}
 
-			currentBatch = append(currentBatch, entry)
-			batchSize = batchSize + len(message)
-			messageCount = messageCount + 1
+	unread := 0
+	bytesIn := 0
+	for i, record := range cloudwatchLogsData.LogEvents {
+		if ctx.Err() != nil {
+			unread = len(cloudwatchLogsData.LogEvents) - i
+			break
+		}
+		bytesIn += len(record.Message)
+		if assembled, ok := assembler.Add(record.Message); ok {
+			addEntry(assembled)
 		}
 	}
+	if assembled, ok := assembler.Flush(); ok {
+		addEntry(assembled)
+	}
+
+	batcher.Close()
 
-	if len(currentBatch) > 0 {
-		util.ProduceMessageToChannel(channel, currentBatch, attributes)
+	metrics.Count(util.MetricRecordsRead, float64(len(cloudwatchLogsData.LogEvents)-unread), dimensions)
+	metrics.Count(util.MetricBytesIn, float64(bytesIn), dimensions)
+	if unread > 0 {
+		metrics.Count(util.MetricRecordsUnprocessed, float64(unread), dimensions)
+		err := unreadEventsError(ctx, cloudwatchLogsData, unread)
+		log.Errorf("stopped processing cloudwatch logs: %v", err)
+		return util.NewStageError(util.StageParse, err)
 	}
 
 	log.Debug("Finished processing all cloudwatch logs")
 
 	return nil
 }
+
+// unreadEventsError returns the error of the last unread log events of the batch, which are left unread once the context is done.
+func unreadEventsError(ctx context.Context, cloudwatchLogsData events.CloudwatchLogsData, unread int) error {
+	first := cloudwatchLogsData.LogEvents[len(cloudwatchLogsData.LogEvents)-unread]
+	if !util.IsDeadlineApproaching(ctx) {
+		return fmt.Errorf("%d log events of log group %s not processed: %w", unread, cloudwatchLogsData.LogGroup, context.Cause(ctx))
+	}
+	return &util.TimeoutError{
+		Source:      fmt.Sprintf("log group %s, log stream %s", cloudwatchLogsData.LogGroup, cloudwatchLogsData.LogStream),
+		Unprocessed: fmt.Sprintf("%d of %d log events, from event %s", unread, len(cloudwatchLogsData.LogEvents), first.ID),
+	}
+}
@@ -1,6 +1,9 @@
 package cloudwatch
 
 import (
+	"context"
+	"encoding/json"
+	"os"
 	"strings"
 	"testing"
 	"time"
@@ -107,7 +110,7 @@ func TestGetLogs(t *testing.T) {
 			// create a channel to produce messages
 			channel := make(chan common.DetailedLogsBatch, 2) // Buffer size of 2 to prevent blocking
 
-			err := GetLogs(cloudwatchLogsData, awsConfig, channel)
+			err := GetLogs(context.Background(), cloudwatchLogsData, awsConfig, channel)
 			assert.NoError(t, err)
 
 			close(channel)
@@ -138,3 +141,118 @@ func TestGetLogs(t *testing.T) {
 		})
 	}
 }
+
+// TestGetLogsMultiline verifies that continuation events are merged into the preceding log entry
+// when a multiline rule matches the log group.
+func TestGetLogsMultiline(t *testing.T) {
+	os.Setenv(common.MultilineConfig, `[{"LogGroupPrefix": "/aws/lambda/java", "StartPattern": "^\\d{4}-"}]`)
+	defer os.Unsetenv(common.MultilineConfig)
+
+	cloudwatchLogsData := events.CloudwatchLogsData{
+		LogGroup:  "/aws/lambda/java-service",
+		LogStream: "test-log-stream",
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{Message: "2024-01-01 ERROR failed", Timestamp: 1000},
+			{Message: "java.lang.RuntimeException: boom", Timestamp: 1001},
+			{Message: "\tat com.example.Foo.bar(Foo.java:10)", Timestamp: 1002},
+			{Message: "2024-01-01 INFO recovered", Timestamp: 1003},
+		},
+	}
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	err := GetLogs(context.Background(), cloudwatchLogsData, mockAWSConfiguration(), channel)
+	assert.NoError(t, err)
+	close(channel)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 2)
+	assert.Equal(t, "2024-01-01 ERROR failed\njava.lang.RuntimeException: boom\n\tat com.example.Foo.bar(Foo.java:10)", batch[0].Entries[0].Log)
+	assert.Equal(t, "1000", batch[0].Entries[0].Timestamp)
+	assert.Equal(t, "2024-01-01 INFO recovered", batch[0].Entries[1].Log)
+	assert.Equal(t, "1003", batch[0].Entries[1].Timestamp)
+}
+
+func TestGetLogsOrderingAttributes(t *testing.T) {
+	os.Setenv(common.OrderingAttributes, "true")
+	defer os.Unsetenv(common.OrderingAttributes)
+
+	cloudwatchLogsData := events.CloudwatchLogsData{
+		LogGroup:  "test-log-group",
+		LogStream: "test-log-stream",
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{ID: "event-1", Message: "first", Timestamp: 1000},
+			{ID: "event-2", Message: "second", Timestamp: 1000},
+		},
+	}
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	err := GetLogs(context.Background(), cloudwatchLogsData, mockAWSConfiguration(), channel)
+	assert.NoError(t, err)
+	close(channel)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 2)
+	assert.Equal(t, "event-1", batch[0].Entries[0].Attributes["logEventId"])
+	assert.Equal(t, 0, batch[0].Entries[0].Attributes["logSequenceNumber"])
+	assert.Equal(t, "event-2", batch[0].Entries[1].Attributes["logEventId"])
+	assert.Equal(t, 1, batch[0].Entries[1].Attributes["logSequenceNumber"])
+}
+
+// TestGetLogsDeadlineApproaching verifies that no log event is read once the deadline of the invocation is approaching,
+// and that the unread events are reported in a util.TimeoutError.
+func TestGetLogsDeadlineApproaching(t *testing.T) {
+	cloudwatchLogsData := events.CloudwatchLogsData{
+		LogGroup:  "test-log-group",
+		LogStream: "test-log-stream",
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{ID: "event-1", Message: "first", Timestamp: 1000},
+			{ID: "event-2", Message: "second", Timestamp: 1001},
+		},
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(util.ErrDeadlineApproaching)
+	channel := make(chan common.DetailedLogsBatch, 1)
+	err := GetLogs(ctx, cloudwatchLogsData, mockAWSConfiguration(), channel)
+	close(channel)
+
+	var timeoutErr *util.TimeoutError
+	assert.ErrorAs(t, err, &timeoutErr)
+	assert.ErrorIs(t, err, util.ErrDeadlineApproaching)
+	assert.Equal(t, "2 of 2 log events, from event event-1", timeoutErr.Unprocessed)
+	assert.Empty(t, channel)
+
+	ctx, cancel = context.WithCancelCause(context.Background())
+	cancel(nil)
+	err = GetLogs(ctx, cloudwatchLogsData, mockAWSConfiguration(), make(chan common.DetailedLogsBatch, 1))
+	assert.EqualError(t, err, "parse failed: 2 log events of log group test-log-group not processed: context canceled")
+}
+
+// TestGetLogsMetrics verifies that the log events read and their batches are recorded in the metrics of the context.
+func TestGetLogsMetrics(t *testing.T) {
+	cloudwatchLogsData := events.CloudwatchLogsData{
+		LogGroup:  "test-log-group",
+		LogStream: "test-log-stream",
+		LogEvents: []events.CloudwatchLogsLogEvent{
+			{ID: "event-1", Message: "first", Timestamp: 1000},
+			{ID: "event-2", Message: "second", Timestamp: 1001},
+		},
+	}
+
+	metrics := util.NewMetrics()
+	channel := make(chan common.DetailedLogsBatch, 1)
+	err := GetLogs(util.ContextWithMetrics(context.Background(), metrics), cloudwatchLogsData, mockAWSConfiguration(), channel)
+	assert.NoError(t, err)
+	close(channel)
+
+	var output strings.Builder
+	assert.NoError(t, util.NewEMFExporter(&output).Export(context.Background(), metrics))
+	var document map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(output.String()), &document))
+	assert.Equal(t, "cloudwatch", document["sourceType"])
+	assert.Equal(t, "test-log-group", document["logGroup"])
+	assert.Equal(t, 2.0, document[util.MetricRecordsRead])
+	assert.Equal(t, 11.0, document[util.MetricBytesIn])
+	assert.Equal(t, 2.0, document[util.MetricEntriesBatched])
+	assert.Len(t, document[util.MetricSourceDuration], 1)
+}
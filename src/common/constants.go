@@ -1,6 +1,8 @@
 // Package common provides common constants structs and variables.
 package common
 
+import "time"
+
 // InstrumentationProvider is a parameter necessary for Entity Synthesis at New Relic.
 const InstrumentationProvider = "aws"
 
@@ -25,19 +27,35 @@ const NewRelicRegion = "NEW_RELIC_REGION"
 // DebugEnabled is the name of the environment variable for enabling debug mode.
 const DebugEnabled = "DEBUG_ENABLED"
 
-// MaxBufferSize is the maximum buffer size used to read buffer readers. This is the maximum size of a log, any message larger than this will cause an error.
+// MaxBufferSize is the maximum buffer size used to read buffer readers. This is the maximum size of a log line, longer lines are handled according to the LONG_LINE_POLICY.
 const MaxBufferSize = 8 * 1024 * 1024 // 8 mb
 
 // MaxMessageSize is the maximum size of a message. Any message larger than this will be split into multiple records.
 const MaxMessageSize = 1 * 1024 * 1024 // 1 mb
 
-// MaxPayloadSize is the maximum size of a payload.
+// MaxPayloadSize is the maximum size of the JSON encoding of a payload.
 // Reference: https://docs.newrelic.com/docs/logs/log-api/introduction-log-api/#limits
 const MaxPayloadSize = 1 * 1024 * 1024 // 1 mb
 
 // MaxPayloadMessages is the maximum number of messages in a payload.
 const MaxPayloadMessages = 900
 
+// MaxAttributes is the maximum number of attributes of a log event.
+// Reference: https://docs.newrelic.com/docs/logs/log-api/introduction-log-api/#limits
+const MaxAttributes = 255
+
+// MaxAttributeNameLength is the maximum length of the name of an attribute.
+const MaxAttributeNameLength = 255
+
+// MaxAttributeValueLength is the maximum length of the value of a string attribute.
+const MaxAttributeValueLength = 4094
+
+// TruncatedAttributesAttribute is the attribute listing the attributes of a log event that were truncated, moved or dropped to fit the limits.
+const TruncatedAttributesAttribute = "nr.truncatedAttributes"
+
+// ExcessAttributesAttribute is the attribute holding, as a JSON object, the attributes of a log event over the maximum number of attributes.
+const ExcessAttributesAttribute = "nr.excessAttributes"
+
 // CloudTrailDigestRegex is the regex pattern for CloudTrail digest files.
 const CloudTrailDigestRegex = ".*_CloudTrail-Digest_.*\\.json\\.gz$"
 
@@ -49,3 +67,214 @@ const RequestIDRegex = "RequestId:\\s([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{
 
 // LambdaLogGroup is prefix for identifing log group belonging to lambda
 const LambdaLogGroup = "/aws/lambda"
+
+// MultilineConfig is the name of the environment variable for the multiline assembly rules.
+const MultilineConfig = "MULTILINE_CONFIG"
+
+// DefaultMultilineMaxLines is the maximum number of lines merged into one log entry when a multiline rule does not set MaxLines.
+const DefaultMultilineMaxLines = 500
+
+// TimestampConfig is the name of the environment variable for the S3 timestamp extraction rules.
+const TimestampConfig = "TIMESTAMP_CONFIG"
+
+// S3ObjectFilters is the name of the environment variable for the S3 object include and exclude rules.
+const S3ObjectFilters = "S3_OBJECT_FILTERS"
+
+// S3ObjectMetadata is the name of the environment variable for the S3 object metadata and tag enrichment rules.
+const S3ObjectMetadata = "S3_OBJECT_METADATA"
+
+// DefaultTagCacheTTL is the time S3 object tags are cached when a rule does not set TagCacheTTLSeconds.
+const DefaultTagCacheTTL = 5 * time.Minute
+
+// MaxTagCacheEntries is the maximum number of S3 key prefixes or object versions whose tags are cached.
+const MaxTagCacheEntries = 1000
+
+// S3BucketRoles is the name of the environment variable for the mapping of S3 buckets to the IAM roles assumed to read them.
+const S3BucketRoles = "S3_BUCKET_ROLES"
+
+// AssumeRoleSessionName is the session name used when assuming IAM roles to read S3 buckets.
+const AssumeRoleSessionName = "newrelic-log-forwarder"
+
+// AssumeRoleExpiryWindow is the time before expiry at which the credentials of an assumed role are refreshed.
+const AssumeRoleExpiryWindow = 5 * time.Minute
+
+// S3BucketAccess is the name of the environment variable for the per bucket read modes such as requester pays, SSE-C and access points.
+const S3BucketAccess = "S3_BUCKET_ACCESS"
+
+// SSECustomerKey is the name of the secret field holding a base64 encoded SSE-C key.
+const SSECustomerKey = "SSECustomerKey"
+
+// S3PostProcessing is the name of the environment variable for the actions run on S3 objects after they have been forwarded.
+const S3PostProcessing = "S3_POST_PROCESSING"
+
+// SplitJSONAware is the name of the environment variable for enabling JSON-aware splitting of messages larger than MaxMessageSize.
+const SplitJSONAware = "SPLIT_JSON_AWARE"
+
+// LongLinePolicy is the name of the environment variable for the handling of S3 log lines longer than MaxBufferSize: truncate, split or skip.
+const LongLinePolicy = "LONG_LINE_POLICY"
+
+// TruncatedMarker is appended to log lines truncated by the truncate long line policy.
+const TruncatedMarker = "...[TRUNCATED]"
+
+// OrderingAttributes is the name of the environment variable for enabling the line number, byte offset and sequence attributes used to order logs.
+const OrderingAttributes = "ORDERING_ATTRIBUTES_ENABLED"
+
+// S3ObjectConcurrency is the name of the environment variable for the number of S3 objects of an event read in parallel.
+const S3ObjectConcurrency = "S3_OBJECT_CONCURRENCY"
+
+// LambdaMemorySize is the name of the environment variable set by Lambda to the memory of the function in MB.
+const LambdaMemorySize = "AWS_LAMBDA_FUNCTION_MEMORY_SIZE"
+
+// ObjectWorkerMemory is the memory in MB budgeted for each S3 object read in parallel when S3_OBJECT_CONCURRENCY is not set.
+// A worker buffers up to MaxBufferSize of a line and MaxPayloadSize of a batch, on top of the decompression buffers.
+const ObjectWorkerMemory = 128
+
+// MaxObjectWorkers is the maximum number of S3 objects read in parallel when S3_OBJECT_CONCURRENCY is not set.
+const MaxObjectWorkers = 8
+
+// SenderWorkers is the name of the environment variable for the number of batches sent to New Relic concurrently.
+const SenderWorkers = "NR_SENDER_WORKERS"
+
+// DefaultSenderWorkers is the number of batches sent to New Relic concurrently when NR_SENDER_WORKERS is not set.
+const DefaultSenderWorkers = 4
+
+// SenderQueueSize is the name of the environment variable for the number of batches queued for the sender workers.
+// Producers wait once the queue is full.
+const SenderQueueSize = "NR_SENDER_QUEUE_SIZE"
+
+// DeadlineMargin is the environment variable for the safety margin, in milliseconds, kept before the deadline of an invocation.
+// Logs stop being read once it is reached, and what was read is flushed and sent during its first half.
+const DeadlineMargin = "NR_DEADLINE_MARGIN_MS"
+
+// DefaultDeadlineMargin is the safety margin kept before the deadline of an invocation when NR_DEADLINE_MARGIN_MS is not set.
+const DefaultDeadlineMargin = 10 * time.Second
+
+// BatchMaxMessages is the environment variable holding the maximum number of log entries of a batch, capped at MaxPayloadMessages.
+const BatchMaxMessages = "NR_BATCH_MAX_MESSAGES"
+
+// BatchMaxAge is the environment variable holding the maximum time in milliseconds a log entry waits in a batch before it is sent.
+// Batches are only sent on size and count when it is not set.
+const BatchMaxAge = "NR_BATCH_MAX_AGE_MS"
+
+// AttributeMaxCount is the environment variable holding the maximum number of attributes of a log event, capped at MaxAttributes.
+const AttributeMaxCount = "NR_ATTRIBUTE_MAX_COUNT"
+
+// AttributeMaxNameLength is the environment variable holding the maximum length of an attribute name, capped at MaxAttributeNameLength.
+const AttributeMaxNameLength = "NR_ATTRIBUTE_MAX_NAME_LENGTH"
+
+// AttributeMaxValueLength is the environment variable holding the maximum length of a string attribute value, capped at MaxAttributeValueLength.
+const AttributeMaxValueLength = "NR_ATTRIBUTE_MAX_VALUE_LENGTH"
+
+// ExcessAttributesPolicy is the environment variable telling whether the attributes over the maximum number of attributes are dropped or flattened.
+const ExcessAttributesPolicy = "NR_EXCESS_ATTRIBUTES_POLICY"
+
+// NRDestinations is the environment variable holding the JSON array of the New Relic accounts logs can be routed to.
+const NRDestinations = "NR_DESTINATIONS"
+
+// NRRoutingRules is the environment variable holding the JSON array of rules routing logs to the destinations in NR_DESTINATIONS.
+const NRRoutingRules = "NR_ROUTING_RULES"
+
+// DefaultDestination is the name of the destination of the logs no routing rule matches,
+// the account of NEW_RELIC_LICENSE_KEY or NEW_RELIC_LICENSE_KEY_SECRET_NAME unless a destination with that name is configured.
+const DefaultDestination = "default"
+
+// LogsExporter is the environment variable selecting how logs are sent: logs_api, the default, or otlp.
+const LogsExporter = "NR_LOGS_EXPORTER"
+
+// OTLPLogsEndpoint is the environment variable holding the URL of the OTLP/HTTP logs endpoint of the otlp exporter.
+const OTLPLogsEndpoint = "OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"
+
+// OTLPLogsProtocol is the environment variable selecting the encoding of the otlp exporter: http/protobuf, the default, or http/json.
+const OTLPLogsProtocol = "OTEL_EXPORTER_OTLP_LOGS_PROTOCOL"
+
+// OTLPLogsHeaders is the environment variable holding the headers sent by the otlp exporter, as comma separated key=value pairs.
+const OTLPLogsHeaders = "OTEL_EXPORTER_OTLP_LOGS_HEADERS"
+
+// OTLPEndpointUS is the OTLP/HTTP logs endpoint of New Relic accounts in the US region.
+// Reference: https://docs.newrelic.com/docs/opentelemetry/best-practices/opentelemetry-otlp/
+const OTLPEndpointUS = "https://otlp.nr-data.net:4318/v1/logs"
+
+// OTLPEndpointEU is the OTLP/HTTP logs endpoint of New Relic accounts in the EU region.
+const OTLPEndpointEU = "https://otlp.eu01.nr-data.net:4318/v1/logs"
+
+// OTLPEndpointFedRAMP is the OTLP/HTTP logs endpoint of FedRAMP New Relic accounts.
+const OTLPEndpointFedRAMP = "https://gov-otlp.nr-data.net:4318/v1/logs"
+
+// RegionFedRAMP is the value of NEW_RELIC_REGION sending logs to the FedRAMP endpoints of the US region.
+const RegionFedRAMP = "FedRAMP"
+
+// FedRAMPLogsEndpoint is the Log API endpoint of FedRAMP New Relic accounts.
+// Reference: https://docs.newrelic.com/docs/security/security-privacy/compliance/fedramp-compliant-endpoints/
+const FedRAMPLogsEndpoint = "https://gov-log-api.newrelic.com/log/v1"
+
+// LogsEndpoint is the environment variable overriding the URL of the Log API, to send logs through a PrivateLink
+// endpoint or to a region without a NEW_RELIC_REGION value.
+const LogsEndpoint = "NR_LOGS_ENDPOINT"
+
+// CABundle is the environment variable holding the path of a PEM bundle of certificate authorities
+// trusted in addition to the system ones.
+const CABundle = "NR_CA_BUNDLE"
+
+// HTTPTimeoutSeconds is the environment variable for the timeout in seconds of a request sending logs.
+const HTTPTimeoutSeconds = "NR_HTTP_TIMEOUT_SECONDS"
+
+// HTTPConnectTimeoutSeconds is the environment variable for the timeout in seconds of establishing a connection,
+// the TLS handshake included.
+const HTTPConnectTimeoutSeconds = "NR_HTTP_CONNECT_TIMEOUT_SECONDS"
+
+// MetricsExporter is the environment variable selecting how the metrics of the forwarder are sent once per invocation:
+// none, the default, metric_api or emf.
+const MetricsExporter = "NR_METRICS_EXPORTER"
+
+// MetricsEndpoint is the environment variable overriding the URL of the Metric API the metrics of the forwarder are sent to.
+const MetricsEndpoint = "NR_METRICS_ENDPOINT"
+
+// MetricAPIEndpointUS is the Metric API endpoint of New Relic accounts in the US region.
+// Reference: https://docs.newrelic.com/docs/data-apis/ingest-apis/metric-api/report-metrics-metric-api/
+const MetricAPIEndpointUS = "https://metric-api.newrelic.com/metric/v1"
+
+// MetricAPIEndpointEU is the Metric API endpoint of New Relic accounts in the EU region.
+const MetricAPIEndpointEU = "https://metric-api.eu.newrelic.com/metric/v1"
+
+// MetricAPIEndpointFedRAMP is the Metric API endpoint of FedRAMP New Relic accounts.
+const MetricAPIEndpointFedRAMP = "https://gov-metric-api.newrelic.com/metric/v1"
+
+// EMFNamespace is the CloudWatch namespace of the metrics of the forwarder written as EMF lines.
+const EMFNamespace = "NewRelic/LogForwarder"
+
+// MaxEMFValues is the maximum number of values of a metric in an EMF line.
+const MaxEMFValues = 100
+
+// HTTPTimeout is the default timeout of a request sending logs.
+const HTTPTimeout = 30 * time.Second
+
+// HTTPConnectTimeout is the default timeout of establishing a connection.
+const HTTPConnectTimeout = 10 * time.Second
+
+// Sinks is the environment variable holding the JSON array of the sinks logs are sent to, New Relic alone when not set.
+const Sinks = "NR_SINKS"
+
+// RetryMaxAttempts is the name of the environment variable for the maximum number of attempts to send a log batch.
+const RetryMaxAttempts = "NR_RETRY_MAX_ATTEMPTS"
+
+// DefaultRetryMaxAttempts is the maximum number of attempts to send a log batch when NR_RETRY_MAX_ATTEMPTS is not set.
+const DefaultRetryMaxAttempts = 5
+
+// RetryBaseDelay is the maximum delay before the first retry of a log batch, doubled for every following retry.
+const RetryBaseDelay = 500 * time.Millisecond
+
+// RetryMaxDelay is the maximum delay between two attempts to send a log batch.
+const RetryMaxDelay = 30 * time.Second
+
+// DeadLetterDestination is the name of the environment variable for the destination of log batches that could not be sent:
+// an S3 location, s3://bucket/prefix, or the URL of an SQS queue.
+const DeadLetterDestination = "DEAD_LETTER_DESTINATION"
+
+// LambdaFunctionName is the name of the environment variable set by Lambda to the name of the function.
+const LambdaFunctionName = "AWS_LAMBDA_FUNCTION_NAME"
+
+// DefaultReplayMaxArtifacts is the maximum number of failed log batches resubmitted by a replay event that does not set maxArtifacts.
+const DefaultReplayMaxArtifacts = 100
+
+// ReplayReceiveWaitSeconds is the time a replay waits for failed log batches to arrive in an empty SQS queue.
+const ReplayReceiveWaitSeconds = 1
@@ -0,0 +1,222 @@
+// Package deadletter stores log batches that could not be sent to New Relic in S3 or SQS, and replays them later.
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/logger"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// ArtifactVersion is the version of the Artifact format written by this package.
+const ArtifactVersion = 1
+
+var log = logger.NewLogrusLogger(logger.WithDebugLevel())
+
+// Artifact is a failed log batch as stored in a Destination, along with the metadata of the failure.
+type Artifact struct {
+	Version      int                      `json:"nrFailedBatchVersion"` // Version of the artifact format, always set to tell artifacts from other messages
+	Error        string                   `json:"error"`                // Error of the last attempt to send the batch
+	Attempts     int                      `json:"attempts"`             // Number of attempts made to send the batch
+	Permanent    bool                     `json:"permanent"`            // Whether the error was not retryable
+	FailedAt     time.Time                `json:"failedAt"`             // Time the batch was given up on
+	FunctionName string                   `json:"functionName"`         // Name of the Lambda function that read the logs
+	Batch        common.DetailedLogsBatch `json:"batch"`                // The log batch, in the format of the Log API payload
+}
+
+// Destination stores failed log batches and replays them.
+type Destination interface {
+	// Write stores an artifact. It returns a *PartialWriteError when the artifact was stored in part.
+	Write(ctx context.Context, artifact *Artifact) error
+	// Replay resubmits up to maxArtifacts stored artifacts, deleting each one that is resubmitted successfully,
+	// that is rejected permanently, see isRejected, or that is replaced, see errReplaced. It returns the number of artifacts resubmitted.
+	Replay(ctx context.Context, maxArtifacts int, resubmit func(*Artifact) error) (int, error)
+}
+
+// PartialWriteError is returned by Destination.Write when the artifact was stored in several parts and only some of them
+// were stored. The parts stored are replayed, so only the logs of the other parts are missing from the destination.
+type PartialWriteError struct {
+	Unstored common.DetailedLogsBatch // Unstored holds the logs of the parts that were not stored.
+	Err      error                    // Err joins the errors of the parts that were not stored.
+}
+
+// Error returns the number of logs not stored along with the errors of their parts.
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%d logs of the failed log batch not stored: %v", countLogs(e.Unstored), e.Err)
+}
+
+// Unwrap returns the errors of the parts that were not stored.
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// countLogs returns the number of logs of a batch.
+func countLogs(batch common.DetailedLogsBatch) int {
+	count := 0
+	for _, detailedLog := range batch {
+		count += len(detailedLog.Entries)
+	}
+	return count
+}
+
+// newArtifact creates the artifact of a failed batch.
+func newArtifact(failedBatch util.FailedBatch, now time.Time) *Artifact {
+	artifact := &Artifact{
+		Version:      ArtifactVersion,
+		Error:        failedBatch.Err.Error(),
+		Attempts:     1,
+		FailedAt:     now.UTC(),
+		FunctionName: os.Getenv(common.LambdaFunctionName),
+		Batch:        failedBatch.Batch,
+	}
+	var sendErr *util.SendError
+	if errors.As(failedBatch.Err, &sendErr) {
+		artifact.Attempts = sendErr.Attempts
+		artifact.Permanent = sendErr.Permanent
+	}
+	return artifact
+}
+
+// NewDestination creates the Destination described by a destination string using the default AWS configuration.
+// The destination is either an S3 location, s3://bucket/prefix, or the URL of an SQS queue.
+func NewDestination(ctx context.Context, destination string) (Destination, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	return ParseDestination(destination, s3.NewFromConfig(cfg), sqs.NewFromConfig(cfg))
+}
+
+// ParseDestination creates the Destination described by a destination string using the given clients.
+func ParseDestination(destination string, objectStore ObjectStore, queue Queue) (Destination, error) {
+	location, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dead letter destination %q: %w", destination, err)
+	}
+	switch {
+	case location.Scheme == "s3" && location.Host != "":
+		return &s3Destination{client: objectStore, bucket: location.Host, prefix: strings.TrimPrefix(location.Path, "/")}, nil
+	case location.Scheme == "https" && strings.HasPrefix(location.Host, "sqs."):
+		return &sqsDestination{client: queue, queueURL: destination}, nil
+	default:
+		return nil, fmt.Errorf("invalid dead letter destination %q, expected s3://bucket/prefix or an SQS queue URL", destination)
+	}
+}
+
+// StoreFailedBatches writes the batches that could not be sent to the destination configured in DEAD_LETTER_DESTINATION.
+// It returns the errors of the batches that could not be stored, which are all of them when no destination is configured.
+func StoreFailedBatches(ctx context.Context, failedBatches []util.FailedBatch) error {
+	if len(failedBatches) == 0 {
+		return nil
+	}
+	destinationString := os.Getenv(common.DeadLetterDestination)
+	if destinationString == "" {
+		return joinBatchErrors(failedBatches)
+	}
+
+	destination, err := NewDestination(ctx, destinationString)
+	if err != nil {
+		log.Errorf("failed to create dead letter destination: %v", err)
+		return errors.Join(err, joinBatchErrors(failedBatches))
+	}
+	return storeFailedBatches(ctx, destination, failedBatches, time.Now())
+}
+
+// storeFailedBatches writes the batches to the destination and returns the errors of the batches that could not be stored.
+// A batch stored in part is reported with the number of its logs that were not stored.
+func storeFailedBatches(ctx context.Context, destination Destination, failedBatches []util.FailedBatch, now time.Time) error {
+	var errs []error
+	stored := 0
+	for _, failedBatch := range failedBatches {
+		err := destination.Write(ctx, newArtifact(failedBatch, now))
+		var partial *PartialWriteError
+		switch {
+		case err == nil:
+			stored++
+		case errors.As(err, &partial):
+			log.Errorf("failed to store part of failed log batch: %v", err)
+			errs = append(errs, fmt.Errorf("%w (%d of %d logs not stored: %v)", failedBatch.Err, countLogs(partial.Unstored), countLogs(failedBatch.Batch), partial.Err))
+		default:
+			log.Errorf("failed to store failed log batch: %v", err)
+			errs = append(errs, fmt.Errorf("%w (not stored: %v)", failedBatch.Err, err))
+		}
+	}
+	log.Infof("stored %d of %d failed log batches for replay", stored, len(failedBatches))
+	return errors.Join(errs...)
+}
+
+// joinBatchErrors joins the errors of the failed batches.
+func joinBatchErrors(failedBatches []util.FailedBatch) error {
+	errs := make([]error, len(failedBatches))
+	for i, failedBatch := range failedBatches {
+		errs[i] = failedBatch.Err
+	}
+	return errors.Join(errs...)
+}
+
+// Replay resubmits up to maxArtifacts artifacts stored in the source to New Relic, deleting every resubmitted artifact.
+// Artifacts that still cannot be sent are kept for a later replay, unless they are rejected with an error that is not
+// retryable, such as an invalid payload (400) or a payload too large (413); those are deleted and reported as errors.
+// Artifacts failing with credential errors (401, 402, 403) are kept.
+func Replay(ctx context.Context, source string, maxArtifacts int, nrClientAPI util.NewRelicClientAPI) error {
+	destination, err := NewDestination(ctx, source)
+	if err != nil {
+		return util.NewStageError(util.StageDecode, err)
+	}
+	return replay(ctx, destination, maxArtifacts, nrClientAPI)
+}
+
+// replay resubmits the artifacts stored in the destination.
+// Errors reading the destination are annotated with util.StageFetch, errors resubmitting artifacts with util.StageSend.
+func replay(ctx context.Context, destination Destination, maxArtifacts int, nrClientAPI util.NewRelicClientAPI) error {
+	if maxArtifacts <= 0 {
+		maxArtifacts = common.DefaultReplayMaxArtifacts
+	}
+	policy := util.NewRetryPolicy()
+	replayed, err := destination.Replay(ctx, maxArtifacts, func(artifact *Artifact) error {
+		err := util.SendWithRetry(ctx, nrClientAPI, artifact.Batch, policy)
+		return util.NewStageError(util.StageSend, replaceSentInPart(ctx, destination, artifact, err))
+	})
+	log.Infof("replayed %d failed log batches", replayed)
+	return err
+}
+
+// errReplaced is joined to the error of an artifact sent in part once the logs that were not sent are stored in a new
+// artifact, so that the destination deletes the artifact and the logs that were sent are not replayed again.
+var errReplaced = errors.New("logs not sent stored in a new artifact")
+
+// replaceSentInPart stores the logs of an artifact that were not sent in a new artifact when the artifact was sent in part
+// and is kept for a later replay, and joins errReplaced to the error once they are stored.
+func replaceSentInPart(ctx context.Context, destination Destination, artifact *Artifact, err error) error {
+	var sendErr *util.SendError
+	if !errors.As(err, &sendErr) || len(sendErr.Batch) == len(artifact.Batch) || isRejected(err) {
+		return err
+	}
+	unsent := *artifact
+	unsent.Error = err.Error()
+	unsent.Attempts += sendErr.Attempts
+	unsent.Batch = sendErr.Batch
+	if writeErr := destination.Write(ctx, &unsent); writeErr != nil {
+		log.Errorf("failed to store the logs not sent of a failed log batch, keeping the whole batch: %v", writeErr)
+		return err
+	}
+	return errors.Join(err, errReplaced)
+}
+
+// isRejected checks whether an artifact failed to be resubmitted with an error that is not retryable,
+// so that resubmitting it again would never succeed. Credential errors are not rejections, since the artifact is
+// accepted once the credentials are fixed.
+func isRejected(err error) bool {
+	var sendErr *util.SendError
+	return errors.As(err, &sendErr) && sendErr.Permanent && !util.IsCredentialError(err)
+}
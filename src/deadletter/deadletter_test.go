@@ -0,0 +1,370 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+	nrErrors "github.com/newrelic/newrelic-client-go/v2/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// MockObjectStore is a mock implementation of the ObjectStore interface.
+type MockObjectStore struct {
+	mock.Mock
+}
+
+// PutObject provides a mock response for the PutObject function of the S3 API.
+func (m *MockObjectStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
+}
+
+// ListObjectsV2 provides a mock response for the ListObjectsV2 function of the S3 API.
+func (m *MockObjectStore) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.ListObjectsV2Output), args.Error(1)
+}
+
+// GetObject provides a mock response for the GetObject function of the S3 API.
+func (m *MockObjectStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+// DeleteObject provides a mock response for the DeleteObject function of the S3 API.
+func (m *MockObjectStore) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
+// MockQueue is a mock implementation of the Queue interface.
+type MockQueue struct {
+	mock.Mock
+}
+
+// SendMessage provides a mock response for the SendMessage function of the SQS API.
+func (m *MockQueue) SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*sqs.SendMessageOutput), args.Error(1)
+}
+
+// ReceiveMessage provides a mock response for the ReceiveMessage function of the SQS API.
+func (m *MockQueue) ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*sqs.ReceiveMessageOutput), args.Error(1)
+}
+
+// DeleteMessage provides a mock response for the DeleteMessage function of the SQS API.
+func (m *MockQueue) DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*sqs.DeleteMessageOutput), args.Error(1)
+}
+
+// ChangeMessageVisibility provides a mock response for the ChangeMessageVisibility function of the SQS API.
+func (m *MockQueue) ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*sqs.ChangeMessageVisibilityOutput), args.Error(1)
+}
+
+// MockNRClient is a mock implementation of the NewRelicClientAPI interface.
+type MockNRClient struct {
+	mock.Mock
+}
+
+// CreateLogEntry is a mock method that satisfies the NewRelicClientAPI interface.
+func (m *MockNRClient) CreateLogEntry(batch interface{}) error {
+	args := m.Called(batch)
+	return args.Error(0)
+}
+
+// testBatch creates a log batch with the given number of logs.
+func testBatch(logCount int, logSize int) common.DetailedLogsBatch {
+	entries := make(common.LogData, logCount)
+	for i := range entries {
+		entries[i] = common.Log{Log: strings.Repeat("a", logSize)}
+	}
+	return common.DetailedLogsBatch{{
+		CommonData: common.Common{Attributes: common.LogAttributes{"logBucketName": "test-bucket"}},
+		Entries:    entries,
+	}}
+}
+
+// TestParseDestination tests parsing of dead letter destinations.
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		name        string      // Test case name
+		destination string      // Destination string
+		expected    Destination // Expected destination
+		expectError bool        // Whether an error is expected
+	}{
+		{
+			name:        "S3 location",
+			destination: "s3://dead-letter-bucket/failed/",
+			expected:    &s3Destination{bucket: "dead-letter-bucket", prefix: "failed/"},
+		},
+		{
+			name:        "SQS queue",
+			destination: "https://sqs.us-east-1.amazonaws.com/123456789012/nr-lambda-dlq",
+			expected:    &sqsDestination{queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/nr-lambda-dlq"},
+		},
+		{name: "Missing bucket", destination: "s3:///failed/", expectError: true},
+		{name: "Unsupported", destination: "https://example.com/failed", expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destination, err := ParseDestination(tt.destination, nil, nil)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, destination)
+		})
+	}
+}
+
+// TestStoreFailedBatchesS3 verifies that failed batches are stored in S3 with the metadata of the failure.
+func TestStoreFailedBatchesS3(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	objectStore := new(MockObjectStore)
+	var stored *s3.PutObjectInput
+	objectStore.On("PutObject", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		stored = args.Get(1).(*s3.PutObjectInput)
+	}).Return(&s3.PutObjectOutput{}, nil)
+
+	failedBatches := []util.FailedBatch{{
+		Batch: testBatch(1, 10),
+		Err:   &util.SendError{Err: nrErrors.NewUnexpectedStatusCode(413, ""), Attempts: 1, Permanent: true},
+	}}
+	err := storeFailedBatches(context.Background(), &s3Destination{client: objectStore, bucket: "dead-letter-bucket", prefix: "failed/"}, failedBatches, now)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "dead-letter-bucket", aws.ToString(stored.Bucket))
+	assert.True(t, strings.HasPrefix(aws.ToString(stored.Key), "failed/2024/01/02/03/"))
+	var artifact Artifact
+	assert.NoError(t, json.NewDecoder(stored.Body).Decode(&artifact))
+	assert.Equal(t, ArtifactVersion, artifact.Version)
+	assert.True(t, artifact.Permanent)
+	assert.Equal(t, 1, artifact.Attempts)
+	assert.Equal(t, now, artifact.FailedAt)
+	assert.Equal(t, failedBatches[0].Batch[0].Entries, artifact.Batch[0].Entries)
+}
+
+// TestStoreFailedBatchesError verifies that batches that cannot be stored are reported with their send error.
+func TestStoreFailedBatchesError(t *testing.T) {
+	queue := new(MockQueue)
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, errors.New("access denied"))
+
+	failedBatches := []util.FailedBatch{{Batch: testBatch(1, 10), Err: errors.New("503 response returned")}}
+	err := storeFailedBatches(context.Background(), &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}, failedBatches, time.Now())
+	assert.ErrorContains(t, err, "503 response returned")
+	assert.ErrorContains(t, err, "access denied")
+}
+
+// TestSQSDestinationSplitsLargeBatches verifies that batches larger than an SQS message are sent as several messages.
+func TestSQSDestinationSplitsLargeBatches(t *testing.T) {
+	queue := new(MockQueue)
+	var bodies []string
+	queue.On("SendMessage", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		bodies = append(bodies, aws.ToString(args.Get(1).(*sqs.SendMessageInput).MessageBody))
+	}).Return(&sqs.SendMessageOutput{}, nil)
+
+	destination := &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}
+	err := destination.Write(context.Background(), &Artifact{Version: ArtifactVersion, Batch: testBatch(4, 150*1024)})
+	assert.NoError(t, err)
+
+	assert.Len(t, bodies, 4)
+	for _, body := range bodies {
+		assert.LessOrEqual(t, len(body), maxSQSMessageSize)
+		var artifact Artifact
+		assert.NoError(t, json.Unmarshal([]byte(body), &artifact))
+		assert.Len(t, artifact.Batch[0].Entries, 1)
+		assert.Equal(t, "test-bucket", artifact.Batch[0].CommonData.Attributes["logBucketName"])
+	}
+
+	err = destination.Write(context.Background(), &Artifact{Version: ArtifactVersion, Batch: testBatch(1, maxSQSMessageSize)})
+	assert.Error(t, err)
+}
+
+// TestSQSDestinationPartialWrite verifies that when some of the messages of a split batch are not sent, only their logs are
+// reported as not stored.
+func TestSQSDestinationPartialWrite(t *testing.T) {
+	queue := new(MockQueue)
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, nil).Times(3)
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, errors.New("throttled"))
+
+	destination := &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}
+	err := destination.Write(context.Background(), &Artifact{Version: ArtifactVersion, Batch: testBatch(4, 150*1024)})
+	var partial *PartialWriteError
+	assert.ErrorAs(t, err, &partial)
+	assert.Equal(t, 1, countLogs(partial.Unstored))
+	assert.ErrorContains(t, err, "throttled")
+
+	failedBatches := []util.FailedBatch{{Batch: testBatch(4, 150*1024), Err: errors.New("503 response returned")}}
+	err = storeFailedBatches(context.Background(), destination, failedBatches, time.Now())
+	assert.ErrorContains(t, err, "503 response returned (not stored: ")
+
+	queue = new(MockQueue)
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, nil).Once()
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, errors.New("throttled"))
+	destination.client = queue
+	err = storeFailedBatches(context.Background(), destination, failedBatches, time.Now())
+	assert.ErrorContains(t, err, "503 response returned (3 of 4 logs not stored")
+}
+
+// TestReplayS3 verifies that artifacts stored in S3 are resubmitted and deleted, that failed ones are kept unless they are
+// rejected permanently, and that objects that are not artifacts are skipped.
+func TestReplayS3(t *testing.T) {
+	artifact, _ := json.Marshal(&Artifact{Version: ArtifactVersion, Batch: testBatch(1, 10)})
+
+	objectStore := new(MockObjectStore)
+	objectStore.On("ListObjectsV2", mock.Anything, mock.Anything).Return(&s3.ListObjectsV2Output{
+		Contents: []types.Object{
+			{Key: aws.String("failed/a.json")}, {Key: aws.String("failed/b.json")}, {Key: aws.String("failed/c.json")},
+			{Key: aws.String("failed/manifest.json")}, {Key: aws.String("failed/readme.txt")},
+		},
+	}, nil)
+	for range 3 {
+		objectStore.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(artifact))}, nil).Once()
+	}
+	objectStore.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(`{"files": []}`))}, nil).Once()
+	objectStore.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+
+	nrClient := new(MockNRClient)
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nil).Once()
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnexpectedStatusCode(403, "")).Once()
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnexpectedStatusCode(413, "")).Once()
+
+	err := replay(context.Background(), &s3Destination{client: objectStore, bucket: "dead-letter-bucket", prefix: "failed/"}, 10, nrClient)
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "403")
+	assert.ErrorContains(t, err, "413")
+	assert.NotContains(t, err.Error(), "not a failed log batch")
+
+	objectStore.AssertNumberOfCalls(t, "GetObject", 4)
+	objectStore.AssertNumberOfCalls(t, "DeleteObject", 2)
+	for _, key := range []string{"failed/a.json", "failed/c.json"} {
+		objectStore.AssertCalled(t, "DeleteObject", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectInput) bool {
+			return aws.ToString(input.Key) == key
+		}))
+	}
+}
+
+// TestReplaySQS verifies that artifacts received from SQS are resubmitted and deleted, that artifacts behind other messages
+// are reached, and that the other messages are released back to the queue.
+func TestReplaySQS(t *testing.T) {
+	artifact, _ := json.Marshal(&Artifact{Version: ArtifactVersion, Batch: testBatch(1, 10)})
+
+	queue := new(MockQueue)
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []sqsTypes.Message{
+			{MessageId: aws.String("1"), Body: aws.String(`{"Records": []}`), ReceiptHandle: aws.String("receipt-1")},
+		},
+	}, nil).Once()
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []sqsTypes.Message{
+			{MessageId: aws.String("2"), Body: aws.String(string(artifact)), ReceiptHandle: aws.String("receipt-2")},
+		},
+	}, nil).Once()
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil)
+	queue.On("DeleteMessage", mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+	queue.On("ChangeMessageVisibility", mock.Anything, mock.Anything).Return(&sqs.ChangeMessageVisibilityOutput{}, nil)
+
+	nrClient := new(MockNRClient)
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nil)
+
+	err := replay(context.Background(), &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}, 10, nrClient)
+	assert.NoError(t, err)
+
+	nrClient.AssertNumberOfCalls(t, "CreateLogEntry", 1)
+	queue.AssertNumberOfCalls(t, "ReceiveMessage", 3)
+	queue.AssertNumberOfCalls(t, "DeleteMessage", 1)
+	queue.AssertCalled(t, "DeleteMessage", mock.Anything, mock.MatchedBy(func(input *sqs.DeleteMessageInput) bool {
+		return aws.ToString(input.ReceiptHandle) == "receipt-2"
+	}))
+	queue.AssertNumberOfCalls(t, "ChangeMessageVisibility", 1)
+	queue.AssertCalled(t, "ChangeMessageVisibility", mock.Anything, mock.MatchedBy(func(input *sqs.ChangeMessageVisibilityInput) bool {
+		return aws.ToString(input.ReceiptHandle) == "receipt-1" && input.VisibilityTimeout == 0
+	}))
+}
+
+// TestReplaySQSRejected verifies that artifacts rejected permanently are deleted from the queue, and that artifacts failing
+// with a credential error are kept.
+func TestReplaySQSRejected(t *testing.T) {
+	artifact, _ := json.Marshal(&Artifact{Version: ArtifactVersion, Batch: testBatch(1, 10)})
+
+	queue := new(MockQueue)
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []sqsTypes.Message{
+			{MessageId: aws.String("1"), Body: aws.String(string(artifact)), ReceiptHandle: aws.String("receipt-1")},
+			{MessageId: aws.String("2"), Body: aws.String(string(artifact)), ReceiptHandle: aws.String("receipt-2")},
+		},
+	}, nil).Once()
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil)
+	queue.On("DeleteMessage", mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	nrClient := new(MockNRClient)
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnexpectedStatusCode(400, "")).Once()
+	nrClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnauthorizedError()).Once()
+
+	err := replay(context.Background(), &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}, 10, nrClient)
+	assert.Error(t, err)
+
+	queue.AssertNumberOfCalls(t, "DeleteMessage", 1)
+	queue.AssertCalled(t, "DeleteMessage", mock.Anything, mock.MatchedBy(func(input *sqs.DeleteMessageInput) bool {
+		return aws.ToString(input.ReceiptHandle) == "receipt-1"
+	}))
+}
+
+// TestReplaySQSSentInPart verifies that an artifact sent in part is replaced by an artifact holding the logs that were not sent,
+// so that the logs that were sent are not replayed again.
+func TestReplaySQSSentInPart(t *testing.T) {
+	sent, unsent := testBatch(1, 10), testBatch(1, 20)
+	artifact, _ := json.Marshal(&Artifact{Version: ArtifactVersion, Attempts: 1, Batch: append(sent, unsent...)})
+
+	queue := new(MockQueue)
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{
+		Messages: []sqsTypes.Message{
+			{MessageId: aws.String("1"), Body: aws.String(string(artifact)), ReceiptHandle: aws.String("receipt-1")},
+		},
+	}, nil).Once()
+	queue.On("ReceiveMessage", mock.Anything, mock.Anything).Return(&sqs.ReceiveMessageOutput{}, nil)
+	queue.On("SendMessage", mock.Anything, mock.Anything).Return(&sqs.SendMessageOutput{}, nil)
+	queue.On("DeleteMessage", mock.Anything, mock.Anything).Return(&sqs.DeleteMessageOutput{}, nil)
+
+	nrClient := new(MockNRClient)
+	nrClient.On("CreateLogEntry", mock.Anything).Return(&util.PartialSendError{
+		Err:    errors.New("503 response returned"),
+		Unsent: unsent,
+		Resend: func(context.Context) error { return nrErrors.NewUnauthorizedError() },
+	}).Once()
+
+	err := replay(context.Background(), &sqsDestination{client: queue, queueURL: "https://sqs.us-east-1.amazonaws.com/123456789012/dlq"}, 10, nrClient)
+	assert.ErrorIs(t, err, errReplaced)
+
+	queue.AssertNumberOfCalls(t, "SendMessage", 1)
+	queue.AssertCalled(t, "SendMessage", mock.Anything, mock.MatchedBy(func(input *sqs.SendMessageInput) bool {
+		var replacement Artifact
+		return json.Unmarshal([]byte(aws.ToString(input.MessageBody)), &replacement) == nil &&
+			assert.ObjectsAreEqual(unsent, replacement.Batch) && replacement.Attempts == 3
+	}))
+	queue.AssertNumberOfCalls(t, "DeleteMessage", 1)
+	queue.AssertCalled(t, "DeleteMessage", mock.Anything, mock.MatchedBy(func(input *sqs.DeleteMessageInput) bool {
+		return aws.ToString(input.ReceiptHandle) == "receipt-1"
+	}))
+}
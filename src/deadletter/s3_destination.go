@@ -0,0 +1,136 @@
+package deadletter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// ObjectStore is an interface that defines the methods of the S3 service used to store artifacts.
+type ObjectStore interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// s3Destination stores every artifact as a JSON object under a prefix of an S3 bucket.
+type s3Destination struct {
+	client ObjectStore
+	bucket string
+	prefix string
+}
+
+// Write stores the artifact as an object keyed by the time of the failure, so artifacts are listed in order.
+func (d *s3Destination) Write(ctx context.Context, artifact *Artifact) error {
+	body, err := json.Marshal(artifact)
+	if err != nil {
+		return fmt.Errorf("failed to marshal failed log batch: %w", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	key := d.prefix + artifact.FailedAt.Format("2006/01/02/15/20060102T150405.000000000Z") + "-" + hex.EncodeToString(suffix) + ".json"
+
+	_, err = d.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(d.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put failed log batch in bucket %s: %w", d.bucket, err)
+	}
+	log.Debugf("stored failed log batch as %s in bucket %s", key, d.bucket)
+	return nil
+}
+
+// Replay resubmits the artifacts stored under the prefix, oldest first.
+// Objects that are not artifacts are left untouched and do not count towards maxArtifacts.
+func (d *s3Destination) Replay(ctx context.Context, maxArtifacts int, resubmit func(*Artifact) error) (int, error) {
+	var errs []error
+	replayed := 0
+	paginator := s3.NewListObjectsV2Paginator(d.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(d.bucket),
+		Prefix: aws.String(d.prefix),
+	})
+	for paginator.HasMorePages() && replayed+len(errs) < maxArtifacts {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return replayed, errors.Join(append(errs, util.NewStageError(util.StageFetch, fmt.Errorf("failed to list failed log batches in bucket %s: %w", d.bucket, err)))...)
+		}
+		for _, object := range page.Contents {
+			if replayed+len(errs) >= maxArtifacts {
+				break
+			}
+			key := aws.ToString(object.Key)
+			if !strings.HasSuffix(key, ".json") {
+				continue
+			}
+			err := d.replayObject(ctx, key, resubmit)
+			if errors.Is(err, errNotArtifact) {
+				log.Debugf("skipping object %s in bucket %s that is not a failed log batch", key, d.bucket)
+				continue
+			}
+			if err != nil {
+				log.Errorf("failed to replay %s in bucket %s: %v", key, d.bucket, err)
+				errs = append(errs, err)
+				continue
+			}
+			replayed++
+		}
+	}
+	return replayed, errors.Join(errs...)
+}
+
+// errNotArtifact is returned by replayObject for objects that do not hold an artifact.
+var errNotArtifact = errors.New("not a failed log batch")
+
+// replayObject resubmits the artifact stored in an object and deletes the object once the artifact is resubmitted,
+// once it is rejected permanently, or once it is replaced by the logs that were not sent.
+func (d *s3Destination) replayObject(ctx context.Context, key string, resubmit func(*Artifact) error) error {
+	output, err := d.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return util.NewStageError(util.StageFetch, err)
+	}
+	defer output.Body.Close()
+
+	var artifact Artifact
+	if err := json.NewDecoder(output.Body).Decode(&artifact); err != nil || artifact.Version == 0 {
+		return errNotArtifact
+	}
+	if err := resubmit(&artifact); err != nil {
+		if errors.Is(err, errReplaced) {
+			return errors.Join(err, d.delete(ctx, key))
+		}
+		if !isRejected(err) {
+			return err
+		}
+		log.Errorf("discarding %s in bucket %s, its log batch is rejected by New Relic", key, d.bucket)
+		return errors.Join(err, d.delete(ctx, key))
+	}
+	return d.delete(ctx, key)
+}
+
+// delete deletes an object holding an artifact.
+func (d *s3Destination) delete(ctx context.Context, key string) error {
+	_, err := d.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(key),
+	})
+	return util.NewStageError(util.StageFetch, err)
+}
@@ -0,0 +1,193 @@
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// maxSQSMessageSize is the maximum size of an SQS message body.
+const maxSQSMessageSize = 256 * 1024
+
+// maxSQSReceiveMessages is the maximum number of messages returned by a single ReceiveMessage call.
+const maxSQSReceiveMessages = 10
+
+// Queue is an interface that defines the methods of the SQS service used to store artifacts.
+type Queue interface {
+	SendMessage(ctx context.Context, params *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, params *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, params *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, params *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+}
+
+// sqsDestination stores every artifact as a message of an SQS queue.
+// Artifacts larger than the maximum message size are stored as several artifacts holding parts of the batch.
+type sqsDestination struct {
+	client   Queue
+	queueURL string
+}
+
+// Write sends the artifact to the queue, splitting its batch over several messages if needed.
+// When only some of the messages are sent, it returns a *PartialWriteError holding the logs of the others.
+func (d *sqsDestination) Write(ctx context.Context, artifact *Artifact) error {
+	parts, err := messageParts(artifact)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var unstored common.DetailedLogsBatch
+	for _, part := range parts {
+		_, err := d.client.SendMessage(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(d.queueURL),
+			MessageBody: aws.String(part.body),
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to send failed log batch to queue %s: %w", d.queueURL, err))
+			unstored = append(unstored, part.artifact.Batch...)
+		}
+	}
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) == len(parts):
+		return errors.Join(errs...)
+	default:
+		return &PartialWriteError{Unstored: unstored, Err: errors.Join(errs...)}
+	}
+}
+
+// messagePart is an artifact holding a part of a batch, with its encoding as the body of an SQS message.
+type messagePart struct {
+	artifact *Artifact
+	body     string
+}
+
+// messageParts splits an artifact into parts fitting in SQS messages.
+// Every part is encoded before any message is sent, so that a log too large for a message fails the artifact as a whole.
+func messageParts(artifact *Artifact) ([]messagePart, error) {
+	body, err := json.Marshal(artifact)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal failed log batch: %w", err)
+	}
+	if len(body) <= maxSQSMessageSize {
+		return []messagePart{{artifact: artifact, body: string(body)}}, nil
+	}
+
+	first, second, ok := splitArtifact(artifact)
+	if !ok {
+		return nil, fmt.Errorf("failed log batch of %d bytes with a single log does not fit in an SQS message", len(body))
+	}
+	firstParts, err := messageParts(first)
+	if err != nil {
+		return nil, err
+	}
+	secondParts, err := messageParts(second)
+	if err != nil {
+		return nil, err
+	}
+	return append(firstParts, secondParts...), nil
+}
+
+// Replay resubmits the artifacts received from the queue until it is empty or maxArtifacts have been handled.
+// Messages that are not artifacts, such as events of failed invocations, stay invisible while the queue is read,
+// so that the artifacts behind them are received, and are made visible again once replaying is done.
+func (d *sqsDestination) Replay(ctx context.Context, maxArtifacts int, resubmit func(*Artifact) error) (int, error) {
+	var errs []error
+	var skipped []*string
+	replayed := 0
+	for replayed+len(errs) < maxArtifacts {
+		output, err := d.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(d.queueURL),
+			MaxNumberOfMessages: int32(min(maxArtifacts-replayed-len(errs), maxSQSReceiveMessages)),
+			WaitTimeSeconds:     common.ReplayReceiveWaitSeconds,
+		})
+		if err != nil {
+			errs = append(errs, util.NewStageError(util.StageFetch, fmt.Errorf("failed to receive failed log batches from queue %s: %w", d.queueURL, err)))
+			break
+		}
+		if len(output.Messages) == 0 {
+			break
+		}
+
+		for _, message := range output.Messages {
+			var artifact Artifact
+			if err := json.Unmarshal([]byte(aws.ToString(message.Body)), &artifact); err != nil || artifact.Version == 0 {
+				log.Debugf("skipping message %s that is not a failed log batch", aws.ToString(message.MessageId))
+				skipped = append(skipped, message.ReceiptHandle)
+				continue
+			}
+			if err := resubmit(&artifact); err != nil {
+				log.Errorf("failed to replay message %s: %v", aws.ToString(message.MessageId), err)
+				errs = append(errs, err)
+				if isRejected(err) {
+					log.Errorf("discarding message %s, its log batch is rejected by New Relic", aws.ToString(message.MessageId))
+				}
+				if isRejected(err) || errors.Is(err, errReplaced) {
+					if err := d.delete(ctx, message); err != nil {
+						errs = append(errs, err)
+					}
+				}
+				continue
+			}
+			if err := d.delete(ctx, message); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			replayed++
+		}
+	}
+
+	d.release(ctx, skipped)
+	return replayed, errors.Join(errs...)
+}
+
+// delete deletes a received message from the queue.
+func (d *sqsDestination) delete(ctx context.Context, message types.Message) error {
+	if _, err := d.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(d.queueURL),
+		ReceiptHandle: message.ReceiptHandle,
+	}); err != nil {
+		return util.NewStageError(util.StageFetch, fmt.Errorf("failed to delete replayed message %s: %w", aws.ToString(message.MessageId), err))
+	}
+	return nil
+}
+
+// release makes the received messages visible again.
+// Messages that cannot be released become visible once their visibility timeout expires.
+func (d *sqsDestination) release(ctx context.Context, receiptHandles []*string) {
+	for _, receiptHandle := range receiptHandles {
+		if _, err := d.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(d.queueURL),
+			ReceiptHandle:     receiptHandle,
+			VisibilityTimeout: 0,
+		}); err != nil {
+			log.Warnf("failed to release message of queue %s: %v", d.queueURL, err)
+		}
+	}
+}
+
+// splitArtifact splits the batch of an artifact in two halves, each with the metadata of the artifact.
+// It returns false when the batch holds a single log.
+func splitArtifact(artifact *Artifact) (*Artifact, *Artifact, bool) {
+	first, second := *artifact, *artifact
+	batch := artifact.Batch
+	switch {
+	case len(batch) > 1:
+		first.Batch, second.Batch = batch[:len(batch)/2], batch[len(batch)/2:]
+	case len(batch) == 1 && len(batch[0].Entries) > 1:
+		entries := batch[0].Entries
+		first.Batch = []common.DetailedLog{{CommonData: batch[0].CommonData, Entries: entries[:len(entries)/2]}}
+		second.Batch = []common.DetailedLog{{CommonData: batch[0].CommonData, Entries: entries[len(entries)/2:]}}
+	default:
+		return nil, nil, false
+	}
+	return &first, &second, true
+}
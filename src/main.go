@@ -4,11 +4,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/newrelic/aws-unified-lambda-logging/cloudwatch"
 	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/deadletter"
 	"github.com/newrelic/aws-unified-lambda-logging/logger"
 	"github.com/newrelic/aws-unified-lambda-logging/s3"
 	"github.com/newrelic/aws-unified-lambda-logging/unmarshal"
@@ -19,57 +22,127 @@ var log = logger.NewLogrusLogger(logger.WithDebugLevel())
 
 // handlerWithArgs is the main Lambda handler function.
 // It processes the incoming event and sends the logs to New Relic for logging.
-// It supports CloudWatch and S3 events.
-// It tracks the consumer go routines using a WaitGroup.
-func handlerWithArgs(ctx context.Context, event unmarshal.Event, nrClient util.NewRelicClientAPI) error {
-	channel := make(chan common.DetailedLogsBatch)
+// It supports CloudWatch, S3 and replay events.
+// It tracks the consumer go routines using a WaitGroup, and always waits for them before returning,
+// so no batch is lost when reading the event fails part way.
+// The returned error is annotated with the stage of the pipeline that failed, see util.StageError.
+// Logs stop being read at the safety margin before the deadline of the invocation, see util.DeadlineMargin.
+// What was read is sent during the first half of the margin, and the batches still not sent are stored during the second half,
+// so the function returns a util.TimeoutError recording the logs left unread instead of being stopped by the runtime.
+// The metrics of the invocation are exported with the metrics exporter once it is done, when there is one.
+func handlerWithArgs(ctx context.Context, event unmarshal.Event, nrClient util.NewRelicClientAPI, metricsExporter util.MetricsExporter) error {
+	var metrics *util.Metrics
+	if metricsExporter != nil {
+		metrics = util.NewMetrics()
+		ctx = util.ContextWithMetrics(ctx, metrics)
+	}
+	defer func() {
+		if err := util.ExportMetrics(ctx, metricsExporter, metrics); err != nil {
+			log.Warnf("failed to export metrics: %v", err)
+		}
+	}()
+
+	margin := util.DeadlineMargin(ctx)
+	readCtx, cancelRead := util.WithDeadlineMargin(ctx, margin)
+	defer cancelRead()
+	sendCtx, cancelSend := util.WithDeadlineMargin(ctx, margin/2)
+	defer cancelSend()
+
+	// The buffered channel bounds the batches waiting for a sender worker, producers wait once it is full.
+	workers := util.SenderWorkerCount()
+	channel := make(chan common.DetailedLogsBatch, util.SenderQueueCapacity(workers))
 	var wg sync.WaitGroup
-	wg.Add(1)
 
-	go util.ConsumeLogBatches(ctx, channel, &wg, nrClient)
+	outcome := util.StartLogBatchConsumers(sendCtx, channel, &wg, nrClient, workers)
 
-	awsConfiguration, err := util.GetAWSConfiguration(ctx)
+	postProcess, err := produceLogs(readCtx, event, channel, nrClient)
+	if errors.Is(err, util.ErrDeadlineApproaching) {
+		log.Warnf("stopped reading logs %v before the invocation deadline, flushing the logs read", margin)
+	}
+
+	// The batches of the records read successfully are sent even if other records failed.
+	close(channel)
+
+	wg.Wait()
+	postProcess(ctx, outcome.FailedBatches())
+
+	sendErr := outcome.Err()
+
+	if sendErr != nil {
+		log.Errorf("failed to send %d of %d log batches", outcome.Failed(), outcome.Failed()+outcome.Sent())
+		// Batches stored for replay are no longer reported as errors.
+		sendErr = util.NewStageError(util.StageSend, deadletter.StoreFailedBatches(ctx, outcome.FailedBatches()))
+	}
+	if err := errors.Join(err, sendErr); err != nil {
+		log.Errorf("error processing event: %v", err)
+		return err
+	}
+	return nil
+}
+
+// produceLogs reads the logs of the event and sends them to the channel in batches.
+// It returns the function run once every batch has been sent to New Relic, with the context of the invocation
+// and the batches that could not be sent.
+func produceLogs(ctx context.Context, event unmarshal.Event, channel chan common.DetailedLogsBatch, nrClient util.NewRelicClientAPI) (func(ctx context.Context, failedBatches []util.FailedBatch), error) {
+	postProcess := func(ctx context.Context, failedBatches []util.FailedBatch) {}
 
+	awsConfiguration, err := util.GetAWSConfiguration(ctx)
 	if err != nil {
-		log.Fatal("Error getting AWS configuration")
+		log.Errorf("error getting AWS configuration: %v", err)
+		return postProcess, util.NewStageError(util.StageFetch, fmt.Errorf("error getting AWS configuration: %w", err))
 	}
+
 	switch event.EventType {
 	case unmarshal.CLOUDWATCH:
 		log.Debugf("processing cloudwatch event: %v", event.CloudwatchLogsData)
-		err = cloudwatch.GetLogs(event.CloudwatchLogsData, awsConfiguration, channel)
+		err = cloudwatch.GetLogs(ctx, event.CloudwatchLogsData, awsConfiguration, channel)
 	case unmarshal.S3:
 		log.Debugf("processing s3 event: %v", event.S3Event)
-		var s3Client s3.ObjectClient
-		s3Client, err = s3.NewS3Client(ctx)
+		s3Client, err := s3.NewS3Client(ctx)
 		if err != nil {
-			log.Fatalf("error creating s3 client: %v", err)
+			log.Errorf("error creating s3 client: %v", err)
+			return postProcess, util.NewStageError(util.StageFetch, fmt.Errorf("error creating s3 client: %w", err))
 		}
-		err = s3.GetLogsFromS3Event(ctx, event.S3Event, awsConfiguration, channel, s3Client, s3.DefaultReaderFactory)
+		results, err := s3.GetLogsFromS3Event(ctx, event.S3Event, awsConfiguration, channel, s3Client, s3.DefaultReaderFactory)
+		postProcess = func(ctx context.Context, failedBatches []util.FailedBatch) {
+			s3.PostProcessObjects(ctx, results, failedBatches, s3Client)
+		}
+		return postProcess, err
+	case unmarshal.REPLAY:
+		log.Debugf("processing replay event: %v", event.Replay)
+		err = deadletter.Replay(ctx, event.Replay.Source, event.Replay.MaxArtifacts, nrClient)
 	default:
-		log.Error("unable to process unknown event type. Supported event types are cloudwatch and s3")
-		return nil
-	}
-
-	if err != nil {
-		log.Fatalf("error processing event: %v", err)
+		log.Error("unable to process unknown event type. Supported event types are cloudwatch, s3 and replay")
+		return postProcess, util.NewStageError(util.StageDecode, errors.New("unsupported event type, supported event types are cloudwatch, s3 and replay"))
 	}
-
-	close(channel)
-
-	wg.Wait()
-	return nil
+	return postProcess, err
 }
 
 // main is the entry point of the program.
 // It initializes a new New Relic client and starts a Lambda handler.
+// If the client cannot be initialized, every invocation fails with the initialization error instead of the process exiting.
 func main() {
-	nrClient, err := util.NewNRClient()
+	nrClient, err := util.NewSink(func() (util.NewRelicClientAPI, error) {
+		nrClient, err := util.NewLogsClient()
+		if err != nil {
+			return nrClient, err
+		}
+		// Batches are routed to the accounts of NR_DESTINATIONS, the client of the function being the catch-all.
+		return util.NewRouter(nrClient)
+	})
 	if err != nil {
-		log.Fatalf("error initializing newrelic client: %v", err)
-	} else {
-		handler := func(ctx context.Context, event unmarshal.Event) error {
-			return handlerWithArgs(ctx, event, nrClient)
+		log.Errorf("error initializing newrelic client: %v", err)
+	}
+	// Logs are still forwarded when the metrics exporter cannot be created.
+	metricsExporter, metricsErr := util.NewMetricsExporter()
+	if metricsErr != nil {
+		log.Errorf("error initializing metrics exporter, metrics are not sent: %v", metricsErr)
+	}
+	handler := func(ctx context.Context, event unmarshal.Event) error {
+		if err != nil {
+			return util.NewStageError(util.StageSend, fmt.Errorf("error initializing newrelic client: %w", err))
 		}
-		lambda.Start(handler)
+		return handlerWithArgs(ctx, event, nrClient, metricsExporter)
 	}
+	lambda.Start(handler)
 }
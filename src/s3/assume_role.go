@@ -0,0 +1,142 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// BucketRole maps an S3 bucket to the IAM role assumed to read its objects.
+type BucketRole struct {
+	BucketName string `json:"BucketName"` // Name of the S3 bucket
+	RoleArn    string `json:"RoleArn"`    // ARN of the IAM role assumed through STS
+	ExternalID string `json:"ExternalId"` // Optional external ID required by the role trust policy
+}
+
+// ClientForRole defines a function type that creates an ObjectClient using the credentials of an assumed role.
+type ClientForRole func(BucketRole) ObjectClient
+
+// bucketRoleClient is an ObjectClient that sends requests for buckets with a configured role to a client
+// using the credentials of that role, and all other requests to the default client.
+type bucketRoleClient struct {
+	defaultClient ObjectClient
+	roles         map[string]BucketRole
+	clientForRole ClientForRole
+}
+
+// roleClients caches the clients of assumed roles across invocations.
+// The credentials of each client are refreshed before they expire.
+var roleClients = struct {
+	sync.Mutex
+	clients map[BucketRole]ObjectClient
+}{clients: map[BucketRole]ObjectClient{}}
+
+// ParseBucketRoles parses the bucket to role mapping configuration.
+func ParseBucketRoles(jsonString string) ([]BucketRole, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var bucketRoles []BucketRole
+	if err := json.Unmarshal([]byte(jsonString), &bucketRoles); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bucket roles config: %w", err)
+	}
+	for _, bucketRole := range bucketRoles {
+		if bucketRole.BucketName == "" || bucketRole.RoleArn == "" {
+			return nil, fmt.Errorf("bucket role %+v requires a BucketName and a RoleArn", bucketRole)
+		}
+	}
+	return bucketRoles, nil
+}
+
+// newBucketRoleClient creates an ObjectClient that assumes the configured role of a bucket before accessing it.
+func newBucketRoleClient(defaultClient ObjectClient, bucketRoles []BucketRole, clientForRole ClientForRole) ObjectClient {
+	if len(bucketRoles) == 0 {
+		return defaultClient
+	}
+	roles := make(map[string]BucketRole, len(bucketRoles))
+	for _, bucketRole := range bucketRoles {
+		roles[bucketRole.BucketName] = bucketRole
+	}
+	return &bucketRoleClient{
+		defaultClient: defaultClient,
+		roles:         roles,
+		clientForRole: clientForRole,
+	}
+}
+
+// clientFor returns the client used to access the bucket.
+func (c *bucketRoleClient) clientFor(bucketName *string) ObjectClient {
+	bucketRole, ok := c.roles[aws.ToString(bucketName)]
+	if !ok {
+		return c.defaultClient
+	}
+
+	// The bucket name is not part of the cache key so that buckets sharing a role share its session.
+	bucketRole.BucketName = ""
+
+	roleClients.Lock()
+	defer roleClients.Unlock()
+	client, ok := roleClients.clients[bucketRole]
+	if !ok {
+		log.Debugf("creating s3 client for role %s", bucketRole.RoleArn)
+		client = c.clientForRole(bucketRole)
+		roleClients.clients[bucketRole] = client
+	}
+	return client
+}
+
+// GetObject retrieves an object using the client of the bucket.
+func (c *bucketRoleClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return c.clientFor(params.Bucket).GetObject(ctx, params, optFns...)
+}
+
+// HeadObject retrieves the metadata of an object using the client of the bucket.
+func (c *bucketRoleClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	return c.clientFor(params.Bucket).HeadObject(ctx, params, optFns...)
+}
+
+// GetObjectTagging retrieves the tags of an object using the client of the bucket.
+func (c *bucketRoleClient) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	return c.clientFor(params.Bucket).GetObjectTagging(ctx, params, optFns...)
+}
+
+// PutObjectTagging replaces the tags of an object using the client of the bucket.
+func (c *bucketRoleClient) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	return c.clientFor(params.Bucket).PutObjectTagging(ctx, params, optFns...)
+}
+
+// CopyObject copies an object using the client of the source bucket, whose role must also be allowed to write the destination.
+func (c *bucketRoleClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	return c.clientFor(aws.String(copySourceBucket(aws.ToString(params.CopySource)))).CopyObject(ctx, params, optFns...)
+}
+
+// DeleteObject deletes an object using the client of the bucket.
+func (c *bucketRoleClient) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	return c.clientFor(params.Bucket).DeleteObject(ctx, params, optFns...)
+}
+
+// assumeRoleClientFactory returns a ClientForRole that assumes roles through STS using the given configuration.
+// The credentials are cached and refreshed before they expire.
+func assumeRoleClientFactory(cfg aws.Config) ClientForRole {
+	stsClient := sts.NewFromConfig(cfg)
+	return func(bucketRole BucketRole) ObjectClient {
+		provider := stscreds.NewAssumeRoleProvider(stsClient, bucketRole.RoleArn, func(options *stscreds.AssumeRoleOptions) {
+			options.RoleSessionName = common.AssumeRoleSessionName
+			if bucketRole.ExternalID != "" {
+				options.ExternalID = aws.String(bucketRole.ExternalID)
+			}
+		})
+		roleConfig := cfg.Copy()
+		roleConfig.Credentials = aws.NewCredentialsCache(provider, func(options *aws.CredentialsCacheOptions) {
+			options.ExpiryWindow = common.AssumeRoleExpiryWindow
+		})
+		return s3.NewFromConfig(roleConfig)
+	}
+}
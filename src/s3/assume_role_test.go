@@ -0,0 +1,80 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestParseBucketRoles tests parsing of the bucket to role mapping configuration.
+func TestParseBucketRoles(t *testing.T) {
+	tests := []struct {
+		name       string       // Name of the test case
+		jsonString string       // Configuration to parse
+		expected   []BucketRole // Expected bucket roles
+		wantErr    bool         // Whether an error is expected
+	}{
+		{name: "Empty config"},
+		{
+			name:       "Valid config",
+			jsonString: `[{"BucketName": "remote", "RoleArn": "arn:aws:iam::111111111111:role/reader", "ExternalId": "secret"}]`,
+			expected:   []BucketRole{{BucketName: "remote", RoleArn: "arn:aws:iam::111111111111:role/reader", ExternalID: "secret"}},
+		},
+		{name: "Missing role", jsonString: `[{"BucketName": "remote"}]`, wantErr: true},
+		{name: "Invalid JSON", jsonString: `[{"BucketName": "remote"`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			bucketRoles, err := ParseBucketRoles(tc.jsonString)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, bucketRoles)
+		})
+	}
+}
+
+// TestBucketRoleClient verifies that requests are sent to the client of the role configured for the bucket,
+// and that the client of a role is created once and reused.
+func TestBucketRoleClient(t *testing.T) {
+	roleClients.clients = map[BucketRole]ObjectClient{}
+	defer func() { roleClients.clients = map[BucketRole]ObjectClient{} }()
+
+	defaultClient := new(MockAPI)
+	defaultClient.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("local"))),
+	}, nil).Once()
+
+	remoteClient := new(MockAPI)
+	remoteClient.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("remote"))),
+	}, nil).Twice()
+
+	createdClients := 0
+	client := newBucketRoleClient(defaultClient, []BucketRole{
+		{BucketName: "remote-a", RoleArn: "arn:aws:iam::111111111111:role/reader"},
+		{BucketName: "remote-b", RoleArn: "arn:aws:iam::111111111111:role/reader"},
+	}, func(bucketRole BucketRole) ObjectClient {
+		createdClients++
+		assert.Equal(t, "arn:aws:iam::111111111111:role/reader", bucketRole.RoleArn)
+		return remoteClient
+	})
+
+	for _, bucket := range []string{"local", "remote-a", "remote-b"} {
+		_, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String("key")})
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, createdClients)
+	defaultClient.AssertExpectations(t)
+	remoteClient.AssertExpectations(t)
+}
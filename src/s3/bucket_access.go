@@ -0,0 +1,291 @@
+package s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// sseCustomerAlgorithm is the only algorithm supported by S3 for customer-provided encryption keys.
+const sseCustomerAlgorithm = "AES256"
+
+// sseCustomerKeySize is the size in bytes of an AES256 customer-provided encryption key.
+const sseCustomerKeySize = 32
+
+// BucketAccess describes how the objects of an S3 bucket are read.
+// AccessPointArn may be the ARN of an S3 access point or of an S3 Object Lambda access point;
+// requests for the bucket are sent to it instead of the bucket. Object Lambda access points do not support tagging,
+// so tags are read from the bucket, like writes.
+// The SSE-C key is read from the SSECustomerKey field of the Secrets Manager secret as a base64 encoded 256-bit key.
+type BucketAccess struct {
+	BucketName               string `json:"BucketName"`               // Name of the S3 bucket from the event
+	RequesterPays            bool   `json:"RequesterPays"`            // Whether requests acknowledge that the requester pays
+	SSECustomerKeySecretName string `json:"SSECustomerKeySecretName"` // Secret holding the SSE-C key of the objects
+	AccessPointArn           string `json:"AccessPointArn"`           // Access point or Object Lambda access point ARN used instead of the bucket
+}
+
+// sseCustomerKey is a customer-provided encryption key in the format expected by the S3 API.
+type sseCustomerKey struct {
+	key    string
+	keyMD5 string
+}
+
+// SSECustomerKeyProvider defines a function type that returns the base64 encoded SSE-C key stored in a secret.
+type SSECustomerKeyProvider func(ctx context.Context, secretName string) (string, error)
+
+// bucketAccessClient is an ObjectClient that applies the configured read mode of a bucket to every request.
+type bucketAccessClient struct {
+	client      ObjectClient
+	accesses    map[string]BucketAccess
+	keyProvider SSECustomerKeyProvider
+}
+
+// sseCustomerKeys caches the SSE-C keys read from Secrets Manager across invocations.
+var sseCustomerKeys = struct {
+	sync.Mutex
+	keys map[string]sseCustomerKey
+}{keys: map[string]sseCustomerKey{}}
+
+// ParseBucketAccesses parses the bucket read mode configuration.
+func ParseBucketAccesses(jsonString string) ([]BucketAccess, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var bucketAccesses []BucketAccess
+	if err := json.Unmarshal([]byte(jsonString), &bucketAccesses); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal bucket access config: %w", err)
+	}
+	for _, bucketAccess := range bucketAccesses {
+		if bucketAccess.BucketName == "" {
+			return nil, fmt.Errorf("bucket access %+v requires a BucketName", bucketAccess)
+		}
+	}
+	return bucketAccesses, nil
+}
+
+// newBucketAccessClient creates an ObjectClient that applies the read mode configured for a bucket.
+func newBucketAccessClient(client ObjectClient, bucketAccesses []BucketAccess, keyProvider SSECustomerKeyProvider) ObjectClient {
+	if len(bucketAccesses) == 0 {
+		return client
+	}
+	accesses := make(map[string]BucketAccess, len(bucketAccesses))
+	for _, bucketAccess := range bucketAccesses {
+		accesses[bucketAccess.BucketName] = bucketAccess
+	}
+	return &bucketAccessClient{
+		client:      client,
+		accesses:    accesses,
+		keyProvider: keyProvider,
+	}
+}
+
+// GetObject retrieves an object using the read mode of its bucket.
+func (c *bucketAccessClient) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	access, ok := c.accesses[aws.ToString(params.Bucket)]
+	if !ok {
+		return c.client.GetObject(ctx, params, optFns...)
+	}
+
+	input := *params
+	input.Bucket = accessBucket(access, params.Bucket)
+	if access.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	if access.SSECustomerKeySecretName != "" {
+		key, err := c.getSSECustomerKey(ctx, access.SSECustomerKeySecretName)
+		if err != nil {
+			return nil, err
+		}
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(key.key)
+		input.SSECustomerKeyMD5 = aws.String(key.keyMD5)
+	}
+	return c.client.GetObject(ctx, &input, optFns...)
+}
+
+// HeadObject retrieves the metadata of an object using the read mode of its bucket.
+func (c *bucketAccessClient) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	access, ok := c.accesses[aws.ToString(params.Bucket)]
+	if !ok {
+		return c.client.HeadObject(ctx, params, optFns...)
+	}
+
+	input := *params
+	input.Bucket = accessBucket(access, params.Bucket)
+	if access.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	if access.SSECustomerKeySecretName != "" {
+		key, err := c.getSSECustomerKey(ctx, access.SSECustomerKeySecretName)
+		if err != nil {
+			return nil, err
+		}
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(key.key)
+		input.SSECustomerKeyMD5 = aws.String(key.keyMD5)
+	}
+	return c.client.HeadObject(ctx, &input, optFns...)
+}
+
+// GetObjectTagging retrieves the tags of an object using the read mode of its bucket.
+func (c *bucketAccessClient) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	access, ok := c.accesses[aws.ToString(params.Bucket)]
+	if !ok {
+		return c.client.GetObjectTagging(ctx, params, optFns...)
+	}
+
+	input := *params
+	if !isObjectLambdaAccessPoint(access.AccessPointArn) {
+		input.Bucket = accessBucket(access, params.Bucket)
+	}
+	if access.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	return c.client.GetObjectTagging(ctx, &input, optFns...)
+}
+
+// PutObjectTagging replaces the tags of an object using the read mode of its bucket.
+// Access points are not used for writes, the request is always sent to the bucket.
+func (c *bucketAccessClient) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	access, ok := c.accesses[aws.ToString(params.Bucket)]
+	if !ok {
+		return c.client.PutObjectTagging(ctx, params, optFns...)
+	}
+
+	input := *params
+	if access.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	return c.client.PutObjectTagging(ctx, &input, optFns...)
+}
+
+// CopyObject copies an object using the read mode of its source bucket and the mode of its destination bucket.
+// Objects encrypted with SSE-C are decrypted with the key of the source bucket and encrypted with the key of the
+// destination bucket, or with the same key when the destination bucket has none.
+// Access points are not used for writes, the request is always sent to the bucket.
+func (c *bucketAccessClient) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	source, sourceOK := c.accesses[copySourceBucket(aws.ToString(params.CopySource))]
+	destination, destinationOK := c.accesses[aws.ToString(params.Bucket)]
+	if !sourceOK && !destinationOK {
+		return c.client.CopyObject(ctx, params, optFns...)
+	}
+
+	input := *params
+	if source.RequesterPays || destination.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	if source.SSECustomerKeySecretName != "" {
+		key, err := c.getSSECustomerKey(ctx, source.SSECustomerKeySecretName)
+		if err != nil {
+			return nil, err
+		}
+		input.CopySourceSSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.CopySourceSSECustomerKey = aws.String(key.key)
+		input.CopySourceSSECustomerKeyMD5 = aws.String(key.keyMD5)
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(key.key)
+		input.SSECustomerKeyMD5 = aws.String(key.keyMD5)
+	}
+	if destination.SSECustomerKeySecretName != "" {
+		key, err := c.getSSECustomerKey(ctx, destination.SSECustomerKeySecretName)
+		if err != nil {
+			return nil, err
+		}
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(key.key)
+		input.SSECustomerKeyMD5 = aws.String(key.keyMD5)
+	}
+	return c.client.CopyObject(ctx, &input, optFns...)
+}
+
+// DeleteObject deletes an object using the read mode of its bucket.
+// Access points are not used for writes, the request is always sent to the bucket.
+func (c *bucketAccessClient) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	access, ok := c.accesses[aws.ToString(params.Bucket)]
+	if !ok {
+		return c.client.DeleteObject(ctx, params, optFns...)
+	}
+
+	input := *params
+	if access.RequesterPays {
+		input.RequestPayer = types.RequestPayerRequester
+	}
+	return c.client.DeleteObject(ctx, &input, optFns...)
+}
+
+// accessBucket returns the access point ARN of the bucket if one is configured, otherwise the bucket itself.
+func accessBucket(access BucketAccess, bucket *string) *string {
+	if access.AccessPointArn != "" {
+		return aws.String(access.AccessPointArn)
+	}
+	return bucket
+}
+
+// isObjectLambdaAccessPoint checks whether an access point ARN is the ARN of an S3 Object Lambda access point.
+func isObjectLambdaAccessPoint(accessPointArn string) bool {
+	parsed, err := arn.Parse(accessPointArn)
+	return err == nil && parsed.Service == "s3-object-lambda"
+}
+
+// getSSECustomerKey returns the SSE-C key stored in the secret, reading it from Secrets Manager on first use.
+// The secret is read without holding the lock of the cache, so that the workers reading other objects are not blocked.
+func (c *bucketAccessClient) getSSECustomerKey(ctx context.Context, secretName string) (sseCustomerKey, error) {
+	sseCustomerKeys.Lock()
+	key, ok := sseCustomerKeys.keys[secretName]
+	sseCustomerKeys.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	encodedKey, err := c.keyProvider(ctx, secretName)
+	if err != nil {
+		log.Errorf("failed to get SSE-C key from secret %s: %v", secretName, err)
+		return sseCustomerKey{}, err
+	}
+	rawKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return sseCustomerKey{}, fmt.Errorf("SSE-C key in secret %s is not base64 encoded: %w", secretName, err)
+	}
+	if len(rawKey) != sseCustomerKeySize {
+		return sseCustomerKey{}, fmt.Errorf("SSE-C key in secret %s is %d bytes long, expected a %d-byte key", secretName, len(rawKey), sseCustomerKeySize)
+	}
+	keyMD5 := md5.Sum(rawKey)
+
+	key = sseCustomerKey{
+		key:    encodedKey,
+		keyMD5: base64.StdEncoding.EncodeToString(keyMD5[:]),
+	}
+	sseCustomerKeys.Lock()
+	sseCustomerKeys.keys[secretName] = key
+	sseCustomerKeys.Unlock()
+	return key, nil
+}
+
+// secretsManagerKeyProvider returns an SSECustomerKeyProvider reading keys from AWS Secrets Manager.
+func secretsManagerKeyProvider() SSECustomerKeyProvider {
+	return func(ctx context.Context, secretName string) (string, error) {
+		secretsManagerClient, err := util.NewSecretsManagerClient()
+		if err != nil {
+			return "", err
+		}
+		secretMap, err := util.GetSecretFromSecretManager(ctx, secretsManagerClient, secretName)
+		if err != nil {
+			return "", err
+		}
+		if secretMap[common.SSECustomerKey] == "" {
+			return "", errors.New("either SSECustomerKey is empty or not present in the secrets manager")
+		}
+		return secretMap[common.SSECustomerKey], nil
+	}
+}
@@ -0,0 +1,144 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestBucketAccessClient verifies that the configured read mode of a bucket is applied to GetObject requests.
+func TestBucketAccessClient(t *testing.T) {
+	sseCustomerKeys.keys = map[string]sseCustomerKey{}
+	defer func() { sseCustomerKeys.keys = map[string]sseCustomerKey{} }()
+
+	rawKey := bytes.Repeat([]byte{1}, 32)
+	encodedKey := base64.StdEncoding.EncodeToString(rawKey)
+	keyMD5 := md5.Sum(rawKey)
+
+	accesses := []BucketAccess{
+		{BucketName: "payer", RequesterPays: true},
+		{BucketName: "encrypted", SSECustomerKeySecretName: "sse-key"},
+		{BucketName: "lambda", AccessPointArn: "arn:aws:s3-object-lambda:us-east-1:111111111111:accesspoint/redact"},
+		{BucketName: "missing-key", SSECustomerKeySecretName: "missing"},
+		{BucketName: "short-key", SSECustomerKeySecretName: "short"},
+	}
+	keyProvider := func(ctx context.Context, secretName string) (string, error) {
+		switch secretName {
+		case "sse-key":
+			return encodedKey, nil
+		case "short":
+			return base64.StdEncoding.EncodeToString(rawKey[:16]), nil
+		}
+		return "", errors.New("secret not found")
+	}
+
+	tests := []struct {
+		name    string                        // Name of the test case
+		bucket  string                        // Bucket of the request
+		matches func(*s3.GetObjectInput) bool // Expected request sent to the underlying client
+		wantErr bool                          // Whether an error is expected
+	}{
+		{
+			name:   "Unconfigured bucket",
+			bucket: "plain",
+			matches: func(input *s3.GetObjectInput) bool {
+				return aws.ToString(input.Bucket) == "plain" && input.RequestPayer == "" && input.SSECustomerKey == nil
+			},
+		},
+		{
+			name:   "Requester pays",
+			bucket: "payer",
+			matches: func(input *s3.GetObjectInput) bool {
+				return input.RequestPayer == types.RequestPayerRequester
+			},
+		},
+		{
+			name:   "SSE-C",
+			bucket: "encrypted",
+			matches: func(input *s3.GetObjectInput) bool {
+				return aws.ToString(input.SSECustomerAlgorithm) == "AES256" &&
+					aws.ToString(input.SSECustomerKey) == encodedKey &&
+					aws.ToString(input.SSECustomerKeyMD5) == base64.StdEncoding.EncodeToString(keyMD5[:])
+			},
+		},
+		{
+			name:   "Object Lambda access point",
+			bucket: "lambda",
+			matches: func(input *s3.GetObjectInput) bool {
+				return aws.ToString(input.Bucket) == "arn:aws:s3-object-lambda:us-east-1:111111111111:accesspoint/redact"
+			},
+		},
+		{
+			name:    "Missing SSE-C key",
+			bucket:  "missing-key",
+			wantErr: true,
+		},
+		{
+			name:    "SSE-C key of the wrong size",
+			bucket:  "short-key",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockS3Client := new(MockAPI)
+			if tc.matches != nil {
+				mockS3Client.On("GetObject", mock.Anything, mock.MatchedBy(tc.matches)).Return(&s3.GetObjectOutput{
+					Body: io.NopCloser(bytes.NewReader([]byte("log content"))),
+				}, nil)
+			}
+
+			client := newBucketAccessClient(mockS3Client, accesses, keyProvider)
+			_, err := client.GetObject(context.Background(), &s3.GetObjectInput{Bucket: aws.String(tc.bucket), Key: aws.String("key")})
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
+
+// TestBucketAccessClientTagging verifies that tags are read through access points, except Object Lambda access points
+// which do not support tagging.
+func TestBucketAccessClientTagging(t *testing.T) {
+	accesses := []BucketAccess{
+		{BucketName: "lambda", AccessPointArn: "arn:aws:s3-object-lambda:us-east-1:111111111111:accesspoint/redact"},
+		{BucketName: "shared", AccessPointArn: "arn:aws:s3:us-east-1:111111111111:accesspoint/logs"},
+	}
+
+	tests := []struct {
+		name   string // Name of the test case
+		bucket string // Bucket of the request
+		target string // Expected bucket or access point of the request sent to the underlying client
+	}{
+		{name: "Object Lambda access point", bucket: "lambda", target: "lambda"},
+		{name: "Access point", bucket: "shared", target: "arn:aws:s3:us-east-1:111111111111:accesspoint/logs"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockS3Client := new(MockAPI)
+			mockS3Client.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+				return aws.ToString(input.Bucket) == tc.target
+			})).Return(&s3.GetObjectTaggingOutput{}, nil)
+
+			client := newBucketAccessClient(mockS3Client, accesses, nil)
+			_, err := client.GetObjectTagging(context.Background(), &s3.GetObjectTaggingInput{Bucket: aws.String(tc.bucket), Key: aws.String("key")})
+			assert.NoError(t, err)
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// regexPatternPrefix marks a key pattern as a regular expression instead of a glob.
+const regexPatternPrefix = "regex:"
+
+// ObjectFilterRule describes which S3 objects in its scope are forwarded.
+// Key patterns are globs matched against the whole key, or against the file name when the glob has no "/".
+// Patterns prefixed with "regex:" are regular expressions matched against the whole key.
+// Content types are globs such as "text/*" matched against the media type of the object.
+type ObjectFilterRule struct {
+	util.SourceScope
+	Include             []string `json:"Include"`             // Key patterns of which at least one must match
+	Exclude             []string `json:"Exclude"`             // Key patterns of which none may match
+	MaxObjectSize       int64    `json:"MaxObjectSize"`       // Maximum object size in bytes, 0 means unlimited
+	IncludeContentTypes []string `json:"IncludeContentTypes"` // Content types of which at least one must match
+	ExcludeContentTypes []string `json:"ExcludeContentTypes"` // Content types of which none may match
+}
+
+// objectFilter is a compiled ObjectFilterRule.
+type objectFilter struct {
+	rule    ObjectFilterRule
+	include []keyPattern
+	exclude []keyPattern
+}
+
+// keyPattern matches S3 object keys against a glob or a regular expression.
+type keyPattern struct {
+	pattern string
+	regex   *regexp.Regexp
+}
+
+// newKeyPattern compiles a key pattern.
+func newKeyPattern(pattern string) (keyPattern, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		regex, err := regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+		if err != nil {
+			return keyPattern{}, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+		}
+		return keyPattern{pattern: pattern, regex: regex}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return keyPattern{}, fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+	}
+	return keyPattern{pattern: pattern}, nil
+}
+
+// matches checks whether the key matches the pattern.
+func (p keyPattern) matches(key string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(key)
+	}
+	name := key
+	if !strings.Contains(p.pattern, "/") {
+		name = path.Base(key)
+	}
+	matched, _ := path.Match(p.pattern, name)
+	return matched
+}
+
+// newObjectFilterForObject compiles the first rule of the configuration that matches the S3 object.
+// It returns nil when no rule matches.
+func newObjectFilterForObject(jsonString string, bucketName string, objectKey string) (*objectFilter, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var rules []ObjectFilterRule
+	if err := json.Unmarshal([]byte(jsonString), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object filter config: %w", err)
+	}
+	for _, rule := range rules {
+		if !rule.MatchesObject(bucketName, objectKey) {
+			continue
+		}
+		filter := &objectFilter{rule: rule}
+		for _, pattern := range rule.Include {
+			compiled, err := newKeyPattern(pattern)
+			if err != nil {
+				return nil, err
+			}
+			filter.include = append(filter.include, compiled)
+		}
+		for _, pattern := range rule.Exclude {
+			compiled, err := newKeyPattern(pattern)
+			if err != nil {
+				return nil, err
+			}
+			filter.exclude = append(filter.exclude, compiled)
+		}
+		return filter, nil
+	}
+	return nil, nil
+}
+
+// needsHeadObject checks whether the filter needs object metadata that is not part of the S3 event.
+func (f *objectFilter) needsHeadObject(eventSize int64) bool {
+	if len(f.rule.IncludeContentTypes) > 0 || len(f.rule.ExcludeContentTypes) > 0 {
+		return true
+	}
+	return f.rule.MaxObjectSize > 0 && eventSize <= 0
+}
+
+// skipReason returns the rule that excludes the object, or an empty string if the object is forwarded.
+func (f *objectFilter) skipReason(objectKey string, size int64, contentType string) string {
+	if len(f.include) > 0 {
+		included := false
+		for _, pattern := range f.include {
+			if pattern.matches(objectKey) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return fmt.Sprintf("key matches no include pattern %v", f.rule.Include)
+		}
+	}
+	for _, pattern := range f.exclude {
+		if pattern.matches(objectKey) {
+			return fmt.Sprintf("key matches exclude pattern %q", pattern.pattern)
+		}
+	}
+	if f.rule.MaxObjectSize > 0 && size > f.rule.MaxObjectSize {
+		return fmt.Sprintf("object size %d exceeds maximum object size %d", size, f.rule.MaxObjectSize)
+	}
+	if len(f.rule.IncludeContentTypes) > 0 && !matchesContentType(f.rule.IncludeContentTypes, contentType) {
+		return fmt.Sprintf("content type %q matches no include content type %v", contentType, f.rule.IncludeContentTypes)
+	}
+	if len(f.rule.ExcludeContentTypes) > 0 && matchesContentType(f.rule.ExcludeContentTypes, contentType) {
+		return fmt.Sprintf("content type %q matches an exclude content type %v", contentType, f.rule.ExcludeContentTypes)
+	}
+	return ""
+}
+
+// matchesContentType checks whether the media type of the content type matches any of the patterns.
+func matchesContentType(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldSkipObject evaluates the CloudTrail digest check and the configured object filters for an S3 object
+// before it is fetched. It returns the reason the object is skipped, or an empty string if it is forwarded.
+func shouldSkipObject(ctx context.Context, bucketName string, objectKey string, eventSize int64, s3Client ObjectClient) (string, error) {
+	if isCloudTrailDigest(objectKey) {
+		return "CloudTrail digest file", nil
+	}
+
+	archived, err := isArchivedObject(os.Getenv(common.S3PostProcessing), bucketName, objectKey)
+	if err != nil {
+		return "", err
+	}
+	if archived {
+		return "archive copy written by post processing", nil
+	}
+
+	filter, err := newObjectFilterForObject(os.Getenv(common.S3ObjectFilters), bucketName, objectKey)
+	if err != nil || filter == nil {
+		return "", err
+	}
+
+	size := eventSize
+	contentType := ""
+	if filter.needsHeadObject(eventSize) {
+		head, err := s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			log.Errorf("failed to get S3 object metadata: %v", err)
+			return "", err
+		}
+		size = aws.ToInt64(head.ContentLength)
+		contentType = aws.ToString(head.ContentType)
+	}
+
+	return filter.skipReason(objectKey, size, contentType), nil
+}
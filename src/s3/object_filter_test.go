@@ -0,0 +1,139 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestShouldSkipObject tests the evaluation of object filter rules for different keys, sizes and content types.
+func TestShouldSkipObject(t *testing.T) {
+	config := `[
+		{"BucketName": "shared", "KeyPrefix": "logs/", "Include": ["*.log", "*.gz"], "Exclude": ["_SUCCESS", "regex:\\.parquet\\.crc$", "logs/tmp/*"], "MaxObjectSize": 100},
+		{"BucketName": "typed", "IncludeContentTypes": ["text/*"]}
+	]`
+
+	tests := []struct {
+		name        string         // Name of the test case
+		bucket      string         // Bucket of the object
+		key         string         // Key of the object
+		size        int64          // Size of the object from the event
+		setupS3Mock func(*MockAPI) // Function to set up the S3 mock
+		skip        bool           // Whether the object is expected to be skipped
+	}{
+		{name: "Included key", bucket: "shared", key: "logs/app/server.log", size: 10, setupS3Mock: func(m *MockAPI) {}},
+		{name: "Key matches no include pattern", bucket: "shared", key: "logs/app/manifest.json", size: 10, setupS3Mock: func(m *MockAPI) {}, skip: true},
+		{name: "Excluded glob", bucket: "shared", key: "logs/app/_SUCCESS", size: 10, setupS3Mock: func(m *MockAPI) {}, skip: true},
+		{name: "Excluded path glob", bucket: "shared", key: "logs/tmp/server.log", size: 10, setupS3Mock: func(m *MockAPI) {}, skip: true},
+		{name: "Object too large", bucket: "shared", key: "logs/app/server.log", size: 1000, setupS3Mock: func(m *MockAPI) {}, skip: true},
+		{
+			name:   "Object size from HeadObject",
+			bucket: "shared",
+			key:    "logs/app/server.log",
+			setupS3Mock: func(m *MockAPI) {
+				m.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{ContentLength: aws.Int64(1000)}, nil)
+			},
+			skip: true,
+		},
+		{name: "Key outside of rule scope", bucket: "other", key: "manifest.json", setupS3Mock: func(m *MockAPI) {}},
+		{
+			name:   "Included content type",
+			bucket: "typed",
+			key:    "file",
+			setupS3Mock: func(m *MockAPI) {
+				m.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{ContentType: aws.String("text/plain; charset=utf-8")}, nil)
+			},
+		},
+		{
+			name:   "Excluded content type",
+			bucket: "typed",
+			key:    "file",
+			setupS3Mock: func(m *MockAPI) {
+				m.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{ContentType: aws.String("application/octet-stream")}, nil)
+			},
+			skip: true,
+		},
+	}
+
+	os.Setenv(common.S3ObjectFilters, config)
+	defer os.Unsetenv(common.S3ObjectFilters)
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockS3Client := new(MockAPI)
+			tc.setupS3Mock(mockS3Client)
+
+			reason, err := shouldSkipObject(context.Background(), tc.bucket, tc.key, tc.size, mockS3Client)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.skip, reason != "", "unexpected skip reason %q", reason)
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
+
+// TestGetLogsFromS3EventSkipsFilteredObjects verifies that filtered objects are not fetched while the remaining records are processed.
+func TestGetLogsFromS3EventSkipsFilteredObjects(t *testing.T) {
+	os.Setenv(common.S3ObjectFilters, `[{"BucketName": "test-bucket", "Exclude": ["_SUCCESS"]}]`)
+	defer os.Unsetenv(common.S3ObjectFilters)
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return aws.ToString(input.Key) == "data/app.log"
+	})).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte("log content"))),
+	}, nil).Once()
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "test-bucket"}, Object: events.S3Object{URLDecodedKey: "data/_SUCCESS"}}},
+			{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "test-bucket"}, Object: events.S3Object{URLDecodedKey: "data/app.log"}}},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	batchCount := 0
+	for range channel {
+		batchCount++
+	}
+	assert.Equal(t, 1, batchCount)
+	mockS3Client.AssertExpectations(t)
+}
+
+// TestGetLogsFromS3EventFilterError verifies that an object whose filter cannot be evaluated is reported as failed in the results.
+func TestGetLogsFromS3EventFilterError(t *testing.T) {
+	os.Setenv(common.S3ObjectFilters, `[{"BucketName": "test-bucket", "IncludeContentTypes": ["text/*"]}]`)
+	defer os.Unsetenv(common.S3ObjectFilters)
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("HeadObject", mock.Anything, mock.Anything).Return(&s3.HeadObjectOutput{}, errors.New("access denied"))
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "test-bucket"}, Object: events.S3Object{URLDecodedKey: "data/app.log"}}},
+		},
+	}
+
+	results, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	close(channel)
+	assert.EqualError(t, err, "fetch failed: access denied")
+	assert.Len(t, results, 1)
+	assert.Equal(t, "data/app.log", results[0].Object.URLDecodedKey)
+	assert.EqualError(t, results[0].Err, "fetch failed: access denied")
+	mockS3Client.AssertExpectations(t)
+}
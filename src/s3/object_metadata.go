@@ -0,0 +1,181 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// allKeys selects every metadata or tag key of an object.
+const allKeys = "*"
+
+const (
+	tagCacheScopePrefix = "prefix" // tagCacheScopePrefix caches the tags of the first object read under a bucket and key prefix for all of its objects.
+	tagCacheScopeObject = "object" // tagCacheScopeObject caches the tags of every object version separately.
+)
+
+// ObjectMetadataRule describes which user metadata and tags of the S3 objects in its scope are added as log attributes.
+// User metadata is read from the x-amz-meta-* headers of the object, tags are fetched with GetObjectTagging.
+// Keys are added as attributes named AttributePrefix followed by the key. "*" selects every key.
+// Tags are cached per bucket and key prefix by default, which suits buckets where every object under a prefix is tagged alike,
+// or per object version when TagCacheScope is "object".
+type ObjectMetadataRule struct {
+	util.SourceScope
+	MetadataKeys       []string `json:"MetadataKeys"`       // User metadata keys to add as attributes
+	TagKeys            []string `json:"TagKeys"`            // Tag keys to add as attributes
+	AttributePrefix    string   `json:"AttributePrefix"`    // Prefix of the attribute names
+	TagCacheTTLSeconds int      `json:"TagCacheTTLSeconds"` // Time fetched tags are cached
+	TagCacheScope      string   `json:"TagCacheScope"`      // "prefix" (default) or "object"
+}
+
+// tagCacheEntry holds the tags fetched for an S3 key prefix or object version.
+type tagCacheEntry struct {
+	tags    map[string]string
+	expires time.Time
+}
+
+// tagCache caches object tags per bucket and key prefix, or per object version, across invocations,
+// so that the tags are not fetched again for every object. It holds at most common.MaxTagCacheEntries entries.
+var tagCache = struct {
+	sync.Mutex
+	entries map[string]tagCacheEntry
+}{entries: map[string]tagCacheEntry{}}
+
+// newObjectMetadataRuleForObject returns the first rule of the configuration that matches the S3 object.
+// It returns nil when no rule matches.
+func newObjectMetadataRuleForObject(jsonString string, bucketName string, objectKey string) (*ObjectMetadataRule, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var rules []ObjectMetadataRule
+	if err := json.Unmarshal([]byte(jsonString), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object metadata config: %w", err)
+	}
+	for i := range rules {
+		if scope := rules[i].TagCacheScope; scope != "" && scope != tagCacheScopePrefix && scope != tagCacheScopeObject {
+			return nil, fmt.Errorf("invalid tag cache scope %q in object metadata rule %+v", scope, rules[i].SourceScope)
+		}
+	}
+	for i := range rules {
+		if rules[i].MatchesObject(bucketName, objectKey) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// addObjectMetadata adds the user metadata and tags of the S3 object selected by the configuration to the attributes.
+// Existing attributes are not overwritten.
+func addObjectMetadata(ctx context.Context, bucketName string, objectKey string, s3Object *s3.GetObjectOutput, attributes common.LogAttributes, s3Client ObjectClient) error {
+	rule, err := newObjectMetadataRuleForObject(os.Getenv(common.S3ObjectMetadata), bucketName, objectKey)
+	if err != nil || rule == nil {
+		return err
+	}
+
+	addSelectedKeys(s3Object.Metadata, rule.MetadataKeys, rule.AttributePrefix, attributes)
+
+	if len(rule.TagKeys) > 0 {
+		tags, err := getObjectTags(ctx, bucketName, objectKey, aws.ToString(s3Object.VersionId), rule, s3Client)
+		if err != nil {
+			return err
+		}
+		addSelectedKeys(tags, rule.TagKeys, rule.AttributePrefix, attributes)
+	}
+	return nil
+}
+
+// addSelectedKeys adds the selected keys of values to the attributes using the prefix.
+func addSelectedKeys(values map[string]string, keys []string, prefix string, attributes common.LogAttributes) {
+	for _, key := range keys {
+		if key == allKeys {
+			for name, value := range values {
+				if _, exists := attributes[prefix+name]; !exists {
+					attributes[prefix+name] = value
+				}
+			}
+			continue
+		}
+		if value, ok := values[key]; ok {
+			if _, exists := attributes[prefix+key]; !exists {
+				attributes[prefix+key] = value
+			}
+		}
+	}
+}
+
+// getObjectTags returns the tags of the S3 object version, using the tags cached for its prefix or version when available.
+func getObjectTags(ctx context.Context, bucketName string, objectKey string, versionID string, rule *ObjectMetadataRule, s3Client ObjectClient) (map[string]string, error) {
+	cacheKey := bucketName + "/" + path.Dir(objectKey) + "/"
+	if rule.TagCacheScope == tagCacheScopeObject {
+		cacheKey = bucketName + "/" + objectKey + "?versionId=" + versionID
+	}
+
+	tagCache.Lock()
+	entry, ok := tagCache.entries[cacheKey]
+	tagCache.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.tags, nil
+	}
+
+	// The tags of the version that was read are fetched, those of the object when the bucket is not versioned.
+	var versionIDParam *string
+	if versionID != "" {
+		versionIDParam = aws.String(versionID)
+	}
+	resp, err := s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(bucketName),
+		Key:       aws.String(objectKey),
+		VersionId: versionIDParam,
+	})
+	if err != nil {
+		log.Errorf("failed to get S3 object tags: %v", err)
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(resp.TagSet))
+	for _, tag := range resp.TagSet {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+
+	ttl := time.Duration(rule.TagCacheTTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = common.DefaultTagCacheTTL
+	}
+	now := time.Now()
+	tagCache.Lock()
+	if len(tagCache.entries) >= common.MaxTagCacheEntries {
+		evictTagCacheEntries(now)
+	}
+	tagCache.entries[cacheKey] = tagCacheEntry{tags: tags, expires: now.Add(ttl)}
+	tagCache.Unlock()
+
+	return tags, nil
+}
+
+// evictTagCacheEntries removes the expired entries of the tag cache, or the entry expiring first when none has expired.
+// The caller must hold the lock of the cache.
+func evictTagCacheEntries(now time.Time) {
+	oldestKey := ""
+	var oldest time.Time
+	for key, entry := range tagCache.entries {
+		if !now.Before(entry.expires) {
+			delete(tagCache.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+	if len(tagCache.entries) >= common.MaxTagCacheEntries {
+		delete(tagCache.entries, oldestKey)
+	}
+}
@@ -0,0 +1,135 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// TestGetLogsFromS3EventObjectMetadata verifies that selected user metadata and tags are added as common attributes,
+// and that the tags of every object are its own when they are cached per object.
+func TestGetLogsFromS3EventObjectMetadata(t *testing.T) {
+	os.Setenv(common.S3ObjectMetadata, `[{"BucketName": "tagged-bucket", "MetadataKeys": ["owner"], "TagKeys": ["team", "env"], "AttributePrefix": "s3.", "TagCacheScope": "object"}]`)
+	defer os.Unsetenv(common.S3ObjectMetadata)
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader([]byte("log content"))),
+		Metadata: map[string]string{"owner": "alice", "ignored": "value"},
+	}, nil).Once()
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body:     io.NopCloser(bytes.NewReader([]byte("log content"))),
+		Metadata: map[string]string{"owner": "bob"},
+	}, nil).Once()
+	mockS3Client.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+		return aws.ToString(input.Key) == "app/first.log"
+	})).Return(&s3.GetObjectTaggingOutput{
+		TagSet: []types.Tag{
+			{Key: aws.String("team"), Value: aws.String("payments")},
+			{Key: aws.String("env"), Value: aws.String("prod")},
+			{Key: aws.String("cost-center"), Value: aws.String("42")},
+		},
+	}, nil).Once()
+	mockS3Client.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+		return aws.ToString(input.Key) == "app/second.log"
+	})).Return(&s3.GetObjectTaggingOutput{
+		TagSet: []types.Tag{{Key: aws.String("team"), Value: aws.String("search")}},
+	}, nil).Once()
+
+	channel := make(chan common.DetailedLogsBatch, 2)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "tagged-bucket"}, Object: events.S3Object{URLDecodedKey: "app/first.log"}}},
+			{S3: events.S3Entity{Bucket: events.S3Bucket{Name: "tagged-bucket"}, Object: events.S3Object{URLDecodedKey: "app/second.log"}}},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	var owners, teams []interface{}
+	for batch := range channel {
+		attributes := batch[0].CommonData.Attributes
+		owners = append(owners, attributes["s3.owner"])
+		teams = append(teams, attributes["s3.team"])
+		assert.NotContains(t, attributes, "s3.cost-center")
+		assert.NotContains(t, attributes, "s3.ignored")
+	}
+	assert.Equal(t, []interface{}{"alice", "bob"}, owners)
+	assert.Equal(t, []interface{}{"payments", "search"}, teams)
+	mockS3Client.AssertExpectations(t)
+}
+
+// TestGetObjectTagsCache verifies that the tags of an object version are cached, and that the cache is bounded.
+func TestGetObjectTagsCache(t *testing.T) {
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObjectTagging", mock.Anything, mock.Anything).Return(&s3.GetObjectTaggingOutput{}, nil)
+	rule := &ObjectMetadataRule{TagKeys: []string{allKeys}, TagCacheScope: tagCacheScopeObject}
+
+	for range 2 {
+		_, err := getObjectTags(context.Background(), "cached-bucket", "app.log", "v1", rule, mockS3Client)
+		assert.NoError(t, err)
+	}
+	mockS3Client.AssertNumberOfCalls(t, "GetObjectTagging", 1)
+
+	_, err := getObjectTags(context.Background(), "cached-bucket", "app.log", "v2", rule, mockS3Client)
+	assert.NoError(t, err)
+	mockS3Client.AssertNumberOfCalls(t, "GetObjectTagging", 2)
+
+	for i := range common.MaxTagCacheEntries + 10 {
+		_, err := getObjectTags(context.Background(), "cached-bucket", fmt.Sprintf("app-%d.log", i), "", rule, mockS3Client)
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, len(tagCache.entries), common.MaxTagCacheEntries)
+}
+
+// TestGetObjectTagsPrefixCache verifies that by default the tags are fetched once per bucket and key prefix.
+func TestGetObjectTagsPrefixCache(t *testing.T) {
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+		return aws.ToString(input.Key) == "app/first.log"
+	})).Return(&s3.GetObjectTaggingOutput{
+		TagSet: []types.Tag{{Key: aws.String("team"), Value: aws.String("payments")}},
+	}, nil).Once()
+	mockS3Client.On("GetObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectTaggingInput) bool {
+		return aws.ToString(input.Key) == "other/first.log"
+	})).Return(&s3.GetObjectTaggingOutput{
+		TagSet: []types.Tag{{Key: aws.String("team"), Value: aws.String("search")}},
+	}, nil).Once()
+	rule := &ObjectMetadataRule{TagKeys: []string{allKeys}}
+
+	testCases := []struct {
+		name         string // name of the test case
+		key          string // key of the object
+		expectedTeam string // expected team tag
+	}{
+		{name: "First object of a prefix", key: "app/first.log", expectedTeam: "payments"},
+		{name: "Other object of the same prefix", key: "app/second.log", expectedTeam: "payments"},
+		{name: "Object of another prefix", key: "other/first.log", expectedTeam: "search"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tags, err := getObjectTags(context.Background(), "prefix-cached-bucket", tc.key, "", rule, mockS3Client)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedTeam, tags["team"])
+		})
+	}
+	mockS3Client.AssertExpectations(t)
+
+	_, err := newObjectMetadataRuleForObject(`[{"BucketName": "*", "TagKeys": ["team"], "TagCacheScope": "bucket"}]`, "bucket", "key")
+	assert.Error(t, err)
+}
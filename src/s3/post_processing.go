@@ -0,0 +1,255 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+)
+
+// Tags set on S3 objects by the post-processing actions.
+const (
+	ForwardedTag    = "nr-forwarded"     // ForwardedTag marks an object whose logs were all accepted by New Relic.
+	ForwardErrorTag = "nr-forward-error" // ForwardErrorTag records why the logs of an object could not be forwarded.
+)
+
+// maxTagValueLength is the maximum length of an S3 tag value.
+const maxTagValueLength = 256
+
+// PostProcessingRule describes the actions run on the S3 objects in its scope once they have been forwarded.
+// On success the object is tagged, moved to ArchivePrefix (in ArchiveBucket, defaulting to the same bucket) and/or deleted, in that order.
+// On failure the object is tagged with the error reason instead.
+// Objects under ArchivePrefix are archive copies and are never forwarded or post-processed again. When ArchiveBucket
+// is empty the copy lands in the bucket that triggered the forwarder, so ArchivePrefix must lie outside KeyPrefix.
+type PostProcessingRule struct {
+	util.SourceScope
+	Tag           bool   `json:"Tag"`           // Whether to tag forwarded objects with nr-forwarded=true and failed objects with nr-forward-error
+	ArchivePrefix string `json:"ArchivePrefix"` // Key prefix forwarded objects are moved to
+	ArchiveBucket string `json:"ArchiveBucket"` // Bucket forwarded objects are moved to
+	Delete        bool   `json:"Delete"`        // Whether to delete forwarded objects
+}
+
+// newPostProcessingRuleForObject returns the first rule of the configuration that matches the S3 object.
+// It returns nil when no rule matches.
+func newPostProcessingRuleForObject(jsonString string, bucketName string, objectKey string) (*PostProcessingRule, error) {
+	rules, err := parsePostProcessingRules(jsonString)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].MatchesObject(bucketName, objectKey) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// parsePostProcessingRules unmarshals the post-processing configuration and validates its rules.
+// A rule archiving to its own bucket is rejected when its scope would still match the archive copies, since every copy
+// would trigger the forwarder again, be forwarded twice and be archived again under the prefix, endlessly.
+func parsePostProcessingRules(jsonString string) ([]PostProcessingRule, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var rules []PostProcessingRule
+	if err := json.Unmarshal([]byte(jsonString), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal post processing config: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.ArchivePrefix != "" && rule.ArchiveBucket == "" && strings.HasPrefix(rule.ArchivePrefix, rule.KeyPrefix) {
+			return nil, fmt.Errorf("post processing rule for bucket %s archives to prefix %q inside its key prefix %q; set ArchiveBucket or an ArchivePrefix outside KeyPrefix",
+				rule.BucketName, rule.ArchivePrefix, rule.KeyPrefix)
+		}
+	}
+	return rules, nil
+}
+
+// isArchivedObject checks whether an S3 object is an archive copy written by a post-processing rule.
+func isArchivedObject(jsonString string, bucketName string, objectKey string) (bool, error) {
+	rules, err := parsePostProcessingRules(jsonString)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if rule.ArchivePrefix == "" || !strings.HasPrefix(objectKey, rule.ArchivePrefix) {
+			continue
+		}
+		if rule.ArchiveBucket == bucketName ||
+			(rule.ArchiveBucket == "" && (rule.BucketName == "*" || rule.BucketName == bucketName)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// PostProcessObjects runs the configured post-processing actions on the objects read from an S3 event.
+// It must only be called once every batch produced for the objects has been acknowledged by New Relic, or has failed.
+// failedBatches are the batches that could not be sent; only the objects whose logs they hold are marked as failed.
+// Failures of the actions themselves are logged and do not stop the remaining objects from being processed.
+func PostProcessObjects(ctx context.Context, results []ObjectResult, failedBatches []util.FailedBatch, s3Client ObjectClient) {
+	sendErrs := objectSendErrors(failedBatches)
+	for _, result := range results {
+		objectKey := result.Object.URLDecodedKey
+		rule, err := newPostProcessingRuleForObject(os.Getenv(common.S3PostProcessing), result.BucketName, objectKey)
+		if err != nil {
+			log.Errorf("failed to load post processing config: %v", err)
+			return
+		}
+		if rule == nil {
+			continue
+		}
+
+		forwardErr := result.Err
+		if forwardErr == nil {
+			forwardErr = sendErrs[result.BucketName+"/"+objectKey]
+		}
+
+		if forwardErr != nil {
+			if rule.Tag {
+				if err := addObjectTag(ctx, result, ForwardErrorTag, tagValue(forwardErr.Error()), s3Client); err != nil {
+					log.Errorf("failed to tag object %s in bucket %s with forward error: %v", objectKey, result.BucketName, err)
+				}
+			}
+			continue
+		}
+
+		if err := runSuccessActions(ctx, result, rule, s3Client); err != nil {
+			log.Errorf("failed to post process object %s in bucket %s: %v", objectKey, result.BucketName, err)
+		}
+	}
+}
+
+// objectSendErrors maps the S3 objects whose logs are held by the failed batches, keyed by bucket and key, to the
+// error of the first batch that failed. Objects are identified by the common attributes of their logs.
+func objectSendErrors(failedBatches []util.FailedBatch) map[string]error {
+	sendErrs := make(map[string]error)
+	for _, failed := range failedBatches {
+		for _, detailedLog := range failed.Batch {
+			bucketName, _ := detailedLog.CommonData.Attributes["logBucketName"].(string)
+			objectKey, ok := detailedLog.CommonData.Attributes["logObjectKey"].(string)
+			if !ok {
+				continue
+			}
+			if _, seen := sendErrs[bucketName+"/"+objectKey]; !seen {
+				sendErrs[bucketName+"/"+objectKey] = failed.Err
+			}
+		}
+	}
+	return sendErrs
+}
+
+// runSuccessActions tags, archives and deletes a forwarded object according to the rule.
+func runSuccessActions(ctx context.Context, result ObjectResult, rule *PostProcessingRule, s3Client ObjectClient) error {
+	objectKey := result.Object.URLDecodedKey
+
+	if rule.Tag {
+		if err := addObjectTag(ctx, result, ForwardedTag, "true", s3Client); err != nil {
+			return err
+		}
+	}
+
+	if rule.ArchivePrefix != "" || rule.ArchiveBucket != "" {
+		archiveBucket := rule.ArchiveBucket
+		if archiveBucket == "" {
+			archiveBucket = result.BucketName
+		}
+		// The role, SSE-C key and requester-pays setting of the source bucket are applied by the client from the copy source.
+		if _, err := s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(archiveBucket),
+			Key:        aws.String(rule.ArchivePrefix + objectKey),
+			CopySource: aws.String(copySource(result)),
+		}); err != nil {
+			return fmt.Errorf("failed to archive object: %w", err)
+		}
+		log.Debugf("archived object %s in bucket %s to %s in bucket %s", objectKey, result.BucketName, rule.ArchivePrefix+objectKey, archiveBucket)
+	}
+
+	if rule.Delete || rule.ArchivePrefix != "" || rule.ArchiveBucket != "" {
+		if _, err := s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(result.BucketName),
+			Key:    aws.String(objectKey),
+		}); err != nil {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+		log.Debugf("deleted object %s in bucket %s", objectKey, result.BucketName)
+	}
+	return nil
+}
+
+// copySource returns the URL encoded CopySource of the object version of the result.
+func copySource(result ObjectResult) string {
+	source := (&url.URL{Path: result.BucketName + "/" + result.Object.URLDecodedKey}).EscapedPath()
+	if result.Object.VersionID != "" {
+		source += "?versionId=" + url.QueryEscape(result.Object.VersionID)
+	}
+	return source
+}
+
+// copySourceBucket returns the bucket of a URL encoded CopySource.
+func copySourceBucket(copySource string) string {
+	bucketName, _, _ := strings.Cut(strings.TrimPrefix(copySource, "/"), "/")
+	if unescaped, err := url.PathUnescape(bucketName); err == nil {
+		return unescaped
+	}
+	return bucketName
+}
+
+// addObjectTag adds a tag to the existing tags of the object.
+func addObjectTag(ctx context.Context, result ObjectResult, key string, value string, s3Client ObjectClient) error {
+	var versionID *string
+	if result.Object.VersionID != "" {
+		versionID = aws.String(result.Object.VersionID)
+	}
+
+	existing, err := s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket:    aws.String(result.BucketName),
+		Key:       aws.String(result.Object.URLDecodedKey),
+		VersionId: versionID,
+	})
+	if err != nil {
+		return err
+	}
+
+	tagSet := []types.Tag{{Key: aws.String(key), Value: aws.String(value)}}
+	for _, tag := range existing.TagSet {
+		if aws.ToString(tag.Key) != key {
+			tagSet = append(tagSet, tag)
+		}
+	}
+
+	_, err = s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:    aws.String(result.BucketName),
+		Key:       aws.String(result.Object.URLDecodedKey),
+		VersionId: versionID,
+		Tagging:   &types.Tagging{TagSet: tagSet},
+	})
+	return err
+}
+
+// tagValue converts a message into a valid S3 tag value.
+// Characters not allowed in tag values are replaced with underscores.
+func tagValue(message string) string {
+	value := []rune(strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), strings.ContainsRune("+-=._:/@ ", r):
+			return r
+		case unicode.IsSpace(r):
+			return ' '
+		default:
+			return '_'
+		}
+	}, message))
+	if len(value) > maxTagValueLength {
+		value = value[:maxTagValueLength]
+	}
+	return strings.TrimSpace(string(value))
+}
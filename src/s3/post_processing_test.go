@@ -0,0 +1,219 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/aws-unified-lambda-logging/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// hasTag returns a matcher for PutObjectTaggingInput requests containing the tag.
+func hasTag(key string, value string) interface{} {
+	return mock.MatchedBy(func(input *s3.PutObjectTaggingInput) bool {
+		for _, tag := range input.Tagging.TagSet {
+			if aws.ToString(tag.Key) == key && aws.ToString(tag.Value) == value {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// failedBatchOf returns a failed batch holding logs of the S3 object.
+func failedBatchOf(bucketName string, objectKey string, err error) util.FailedBatch {
+	return util.FailedBatch{
+		Batch: common.DetailedLogsBatch{{
+			CommonData: common.Common{Attributes: common.LogAttributes{"logBucketName": bucketName, "logObjectKey": objectKey}},
+			Entries:    common.LogData{{Log: "log"}},
+		}},
+		Err: err,
+	}
+}
+
+// TestPostProcessObjects verifies the actions run on forwarded and failed objects.
+func TestPostProcessObjects(t *testing.T) {
+	os.Setenv(common.S3PostProcessing, `[
+		{"BucketName": "queue", "KeyPrefix": "incoming/", "Tag": true, "ArchivePrefix": "archive/"},
+		{"BucketName": "queue", "KeyPrefix": "scratch/", "Delete": true}
+	]`)
+	defer os.Unsetenv(common.S3PostProcessing)
+
+	tests := []struct {
+		name        string             // Name of the test case
+		result      ObjectResult       // Result of the object
+		failed      []util.FailedBatch // Batches that could not be sent
+		setupS3Mock func(*MockAPI)     // Function to set up the S3 mock
+	}{
+		{
+			name:   "Forwarded object is tagged and archived",
+			result: ObjectResult{BucketName: "queue", Object: events.S3Object{URLDecodedKey: "incoming/app log.gz"}},
+			setupS3Mock: func(m *MockAPI) {
+				m.On("GetObjectTagging", mock.Anything, mock.Anything).Return(&s3.GetObjectTaggingOutput{
+					TagSet: []types.Tag{{Key: aws.String("team"), Value: aws.String("payments")}},
+				}, nil)
+				m.On("PutObjectTagging", mock.Anything, mock.MatchedBy(func(input *s3.PutObjectTaggingInput) bool {
+					return len(input.Tagging.TagSet) == 2 && aws.ToString(input.Tagging.TagSet[0].Key) == ForwardedTag
+				})).Return(&s3.PutObjectTaggingOutput{}, nil)
+				m.On("CopyObject", mock.Anything, mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+					return aws.ToString(input.Bucket) == "queue" &&
+						aws.ToString(input.Key) == "archive/incoming/app log.gz" &&
+						aws.ToString(input.CopySource) == "queue/incoming/app%20log.gz"
+				})).Return(&s3.CopyObjectOutput{}, nil)
+				m.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+			},
+		},
+		{
+			name:   "Object that failed to be read is tagged with the error",
+			result: ObjectResult{BucketName: "queue", Object: events.S3Object{URLDecodedKey: "incoming/app.log"}, Err: errors.New("failed to parse CloudTrail events")},
+			setupS3Mock: func(m *MockAPI) {
+				m.On("GetObjectTagging", mock.Anything, mock.Anything).Return(&s3.GetObjectTaggingOutput{}, nil)
+				m.On("PutObjectTagging", mock.Anything, hasTag(ForwardErrorTag, "failed to parse CloudTrail events")).Return(&s3.PutObjectTaggingOutput{}, nil)
+			},
+		},
+		{
+			name:   "Object whose batches failed to be sent is tagged with the error",
+			result: ObjectResult{BucketName: "queue", Object: events.S3Object{URLDecodedKey: "incoming/app.log"}},
+			failed: []util.FailedBatch{failedBatchOf("queue", "incoming/app.log", errors.New("413 (payload too large)"))},
+			setupS3Mock: func(m *MockAPI) {
+				m.On("GetObjectTagging", mock.Anything, mock.Anything).Return(&s3.GetObjectTaggingOutput{}, nil)
+				m.On("PutObjectTagging", mock.Anything, hasTag(ForwardErrorTag, "413 _payload too large_")).Return(&s3.PutObjectTaggingOutput{}, nil)
+			},
+		},
+		{
+			name:   "Object forwarded while the batches of another object failed",
+			result: ObjectResult{BucketName: "queue", Object: events.S3Object{URLDecodedKey: "scratch/app.log"}},
+			failed: []util.FailedBatch{failedBatchOf("queue", "scratch/other.log", errors.New("413 (payload too large)"))},
+			setupS3Mock: func(m *MockAPI) {
+				m.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+			},
+		},
+		{
+			name:   "Forwarded object is deleted",
+			result: ObjectResult{BucketName: "queue", Object: events.S3Object{URLDecodedKey: "scratch/app.log"}},
+			setupS3Mock: func(m *MockAPI) {
+				m.On("DeleteObject", mock.Anything, mock.Anything).Return(&s3.DeleteObjectOutput{}, nil)
+			},
+		},
+		{
+			name:        "Object outside of rule scope",
+			result:      ObjectResult{BucketName: "other", Object: events.S3Object{URLDecodedKey: "incoming/app.log"}},
+			setupS3Mock: func(m *MockAPI) {},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mockS3Client := new(MockAPI)
+			tc.setupS3Mock(mockS3Client)
+
+			PostProcessObjects(context.Background(), []ObjectResult{tc.result}, tc.failed, mockS3Client)
+			mockS3Client.AssertExpectations(t)
+		})
+	}
+}
+
+// TestParsePostProcessingRules verifies that rules archiving inside their own scope are rejected.
+func TestParsePostProcessingRules(t *testing.T) {
+	tests := []struct {
+		name       string // Name of the test case
+		jsonString string // Post-processing configuration
+		wantErr    bool   // Whether an error is expected
+	}{
+		{name: "Archive prefix outside of key prefix", jsonString: `[{"BucketName": "queue", "KeyPrefix": "incoming/", "ArchivePrefix": "archive/"}]`},
+		{name: "Archive prefix in another bucket", jsonString: `[{"BucketName": "queue", "ArchivePrefix": "archive/", "ArchiveBucket": "cold"}]`},
+		{name: "Archive prefix without key prefix", jsonString: `[{"BucketName": "queue", "ArchivePrefix": "archive/"}]`, wantErr: true},
+		{name: "Archive prefix inside key prefix", jsonString: `[{"BucketName": "queue", "KeyPrefix": "logs/", "ArchivePrefix": "logs/archive/"}]`, wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parsePostProcessingRules(tc.jsonString)
+			assert.Equal(t, tc.wantErr, err != nil, "unexpected error %v", err)
+		})
+	}
+}
+
+// TestShouldSkipObjectArchiveCopy verifies that archive copies written by post processing are not forwarded again.
+func TestShouldSkipObjectArchiveCopy(t *testing.T) {
+	os.Setenv(common.S3PostProcessing, `[
+		{"BucketName": "queue", "KeyPrefix": "incoming/", "ArchivePrefix": "archive/"},
+		{"BucketName": "*", "KeyPrefix": "exports/", "ArchivePrefix": "forwarded/", "ArchiveBucket": "cold"}
+	]`)
+	defer os.Unsetenv(common.S3PostProcessing)
+
+	tests := []struct {
+		name   string // Name of the test case
+		bucket string // Bucket of the object
+		key    string // Key of the object
+		skip   bool   // Whether the object is expected to be skipped
+	}{
+		{name: "Archive copy in the source bucket", bucket: "queue", key: "archive/incoming/app.log", skip: true},
+		{name: "Archive copy in the archive bucket", bucket: "cold", key: "forwarded/exports/app.log", skip: true},
+		{name: "Object to forward", bucket: "queue", key: "incoming/app.log"},
+		{name: "Archive prefix in another bucket", bucket: "other", key: "archive/app.log"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reason, err := shouldSkipObject(context.Background(), tc.bucket, tc.key, 10, new(MockAPI))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.skip, reason != "", "unexpected skip reason %q", reason)
+		})
+	}
+}
+
+// TestPostProcessObjectsCrossBucketArchive verifies that an SSE-C object of a requester-pays bucket read through a role
+// is copied to another bucket with the role, key and requester-pays setting of its source bucket.
+func TestPostProcessObjectsCrossBucketArchive(t *testing.T) {
+	os.Setenv(common.S3PostProcessing, `[{"BucketName": "source", "ArchivePrefix": "archive/", "ArchiveBucket": "archive"}]`)
+	defer os.Unsetenv(common.S3PostProcessing)
+	sseCustomerKeys.keys = map[string]sseCustomerKey{}
+	roleClients.clients = map[BucketRole]ObjectClient{}
+	defer func() {
+		sseCustomerKeys.keys = map[string]sseCustomerKey{}
+		roleClients.clients = map[BucketRole]ObjectClient{}
+	}()
+
+	rawKey := bytes.Repeat([]byte{1}, 32)
+	encodedKey := base64.StdEncoding.EncodeToString(rawKey)
+	keyProvider := func(ctx context.Context, secretName string) (string, error) {
+		return encodedKey, nil
+	}
+	accesses := []BucketAccess{{BucketName: "source", RequesterPays: true, SSECustomerKeySecretName: "sse-key"}}
+
+	defaultClient := new(MockAPI)
+	roleClient := new(MockAPI)
+	roleClient.On("CopyObject", mock.Anything, mock.MatchedBy(func(input *s3.CopyObjectInput) bool {
+		return aws.ToString(input.Bucket) == "archive" &&
+			aws.ToString(input.Key) == "archive/app.log" &&
+			aws.ToString(input.CopySource) == "source/app.log?versionId=v1" &&
+			input.RequestPayer == types.RequestPayerRequester &&
+			aws.ToString(input.CopySourceSSECustomerKey) == encodedKey &&
+			aws.ToString(input.SSECustomerKey) == encodedKey
+	})).Return(&s3.CopyObjectOutput{}, nil).Once()
+	roleClient.On("DeleteObject", mock.Anything, mock.MatchedBy(func(input *s3.DeleteObjectInput) bool {
+		return aws.ToString(input.Bucket) == "source" && input.RequestPayer == types.RequestPayerRequester
+	})).Return(&s3.DeleteObjectOutput{}, nil).Once()
+
+	client := newBucketRoleClient(newBucketAccessClient(defaultClient, accesses, keyProvider), []BucketRole{
+		{BucketName: "source", RoleArn: "arn:aws:iam::111111111111:role/reader"},
+	}, func(bucketRole BucketRole) ObjectClient {
+		return newBucketAccessClient(roleClient, accesses, keyProvider)
+	})
+
+	result := ObjectResult{BucketName: "source", Object: events.S3Object{URLDecodedKey: "app.log", VersionID: "v1"}}
+	PostProcessObjects(context.Background(), []ObjectResult{result}, nil, client)
+	defaultClient.AssertExpectations(t)
+	roleClient.AssertExpectations(t)
+}
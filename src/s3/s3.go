@@ -2,19 +2,28 @@
 package s3
 
 import (
-	"bufio"
 	"compress/bzip2"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 	"github.com/newrelic/aws-unified-lambda-logging/common"
 	"github.com/newrelic/aws-unified-lambda-logging/logger"
 	"github.com/newrelic/aws-unified-lambda-logging/util"
@@ -23,6 +32,18 @@ import (
 // ObjectClient is an interface that defines the methods for interacting with the S3 service.
 type ObjectClient interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+	PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// ObjectResult records the outcome of reading an S3 object referenced by an event.
+type ObjectResult struct {
+	BucketName string          // BucketName is the name of the bucket holding the object.
+	Object     events.S3Object // Object is the object referenced by the event.
+	Err        error           // Err is the error encountered while reading the object, if any.
 }
 
 // ReaderFactory defines a function type that creates a new io.Reader based on the input reader and file extension.
@@ -32,126 +53,389 @@ type ReaderFactory func(io.ReadCloser, string) (io.Reader, error)
 var log = logger.NewLogrusLogger(logger.WithDebugLevel())
 
 // GetLogsFromS3Event batches logs from S3 into DetailedJson format and sends them to the specified channel.
-// It returns an error if there is a problem retrieving or sending the logs.
-func GetLogsFromS3Event(ctx context.Context, s3Event events.S3Event, awsConfiguration util.AWSConfiguration, channel chan common.DetailedLogsBatch, s3Client ObjectClient, readerFactory ReaderFactory) error {
-	for _, record := range s3Event.Records {
-
-		// The Following are the common attributes for all log messages.
-		// New Relic uses these common attributes to generate Unique Entity ID.
-		attributes := common.LogAttributes{
-			"aws.accountId":            awsConfiguration.AccountID,
-			"logBucketName":            record.S3.Bucket.Name,
-			"logObjectKey":             record.S3.Object.URLDecodedKey,
-			"aws.realm":                awsConfiguration.Realm,
-			"aws.region":               awsConfiguration.Region,
-			"instrumentation.provider": common.InstrumentationProvider,
-			"instrumentation.name":     common.InstrumentationName,
-			"instrumentation.version":  common.InstrumentationVersion,
-		}
+// The objects of the event are read in parallel by a bounded pool of workers, see objectWorkers.
+// It returns the result of every object that was read, in the order of the event records, and the errors of all records joined together.
+// An error reading one object does not stop the other objects from being read.
+// Objects excluded by the CloudTrail digest check or the configured object filters are skipped without being fetched.
+func GetLogsFromS3Event(ctx context.Context, s3Event events.S3Event, awsConfiguration util.AWSConfiguration, channel chan common.DetailedLogsBatch, s3Client ObjectClient, readerFactory ReaderFactory) ([]ObjectResult, error) {
+	records := make(chan int)
+	recordResults := make([]*ObjectResult, len(s3Event.Records))
+	recordErrors := make([]error, len(s3Event.Records))
+	var skippedObjects atomic.Int32
+
+	var wg sync.WaitGroup
+	for range objectWorkers(len(s3Event.Records)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range records {
+				result, skipped, err := processRecord(ctx, s3Event.Records[i], awsConfiguration, channel, s3Client, readerFactory)
+				if skipped {
+					skippedObjects.Add(1)
+				}
+				recordResults[i] = result
+				recordErrors[i] = err
+			}
+		}()
+	}
+	for i := range s3Event.Records {
+		records <- i
+	}
+	close(records)
+	wg.Wait()
 
-		if err := util.AddCustomMetaData(os.Getenv(common.CustomMetaData), attributes); err != nil {
-			log.Errorf("failed to add custom metadata %v", err)
-			return err
-		}
+	log.Debugf("skipped %d of %d objects", skippedObjects.Load(), len(s3Event.Records))
 
-		if err := buildMeltLogsFromS3Bucket(ctx, record.S3.Bucket.Name, record.S3.Object.URLDecodedKey, channel, attributes, s3Client, readerFactory); err != nil {
-			return err
+	var results []ObjectResult
+	for _, result := range recordResults {
+		if result != nil {
+			results = append(results, *result)
 		}
 	}
+	return results, errors.Join(recordErrors...)
+}
 
-	return nil
+// processRecord reads the object referenced by an S3 event record and sends its logs to the channel.
+// It returns the result of the object when it was read, whether the object was skipped, and any error encountered.
+func processRecord(ctx context.Context, record events.S3EventRecord, awsConfiguration util.AWSConfiguration, channel chan common.DetailedLogsBatch, s3Client ObjectClient, readerFactory ReaderFactory) (*ObjectResult, bool, error) {
+	if ctx.Err() != nil {
+		// The object is not read once the deadline of the invocation is approaching, and is reported as failed.
+		err := util.NewStageError(util.StageParse, unreadObjectError(ctx, record.S3.Bucket.Name, record.S3.Object.URLDecodedKey, "whole object"))
+		return &ObjectResult{BucketName: record.S3.Bucket.Name, Object: record.S3.Object, Err: err}, false, err
+	}
+	skipReason, err := shouldSkipObject(ctx, record.S3.Bucket.Name, record.S3.Object.URLDecodedKey, record.S3.Object.Size, s3Client)
+	if err != nil {
+		// The object is reported as failed, so that post-processing tags it with the error.
+		err = util.NewStageError(util.StageFetch, err)
+		return &ObjectResult{BucketName: record.S3.Bucket.Name, Object: record.S3.Object, Err: err}, false, err
+	}
+	if skipReason != "" {
+		log.Debugf("skipping object %s in bucket %s: %s", record.S3.Object.URLDecodedKey, record.S3.Bucket.Name, skipReason)
+		return nil, true, nil
+	}
+
+	// The Following are the common attributes for all log messages.
+	// New Relic uses these common attributes to generate Unique Entity ID.
+	attributes := common.LogAttributes{
+		"aws.accountId":            awsConfiguration.AccountID,
+		"logBucketName":            record.S3.Bucket.Name,
+		"logObjectKey":             record.S3.Object.URLDecodedKey,
+		"aws.realm":                awsConfiguration.Realm,
+		"aws.region":               awsConfiguration.Region,
+		"instrumentation.provider": common.InstrumentationProvider,
+		"instrumentation.name":     common.InstrumentationName,
+		"instrumentation.version":  common.InstrumentationVersion,
+	}
+
+	// The object revision attributes trace a log back to the exact object version that triggered the event.
+	if record.S3.Object.VersionID != "" {
+		attributes["logObjectVersionId"] = record.S3.Object.VersionID
+	}
+	if record.S3.Object.ETag != "" {
+		attributes["logObjectETag"] = record.S3.Object.ETag
+	}
+	if record.S3.Object.Size > 0 {
+		attributes["logObjectSize"] = record.S3.Object.Size
+	}
+
+	if err := util.AddCustomMetaData(os.Getenv(common.CustomMetaData), attributes); err != nil {
+		log.Errorf("failed to add custom metadata %v", err)
+		err = util.NewStageError(util.StageParse, err)
+		return &ObjectResult{BucketName: record.S3.Bucket.Name, Object: record.S3.Object, Err: err}, false, err
+	}
+
+	err = buildMeltLogsFromS3Bucket(ctx, record.S3.Bucket.Name, record.S3.Object, channel, attributes, s3Client, readerFactory)
+	return &ObjectResult{BucketName: record.S3.Bucket.Name, Object: record.S3.Object, Err: err}, false, err
+}
+
+// objectWorkers returns the number of workers reading the objects of an event in parallel.
+// It is read from S3_OBJECT_CONCURRENCY, or derived from the memory of the function when not set,
+// and never exceeds the number of records.
+func objectWorkers(recordCount int) int {
+	workers := 0
+	if value := os.Getenv(common.S3ObjectConcurrency); value != "" {
+		concurrency, err := strconv.Atoi(value)
+		if err != nil || concurrency <= 0 {
+			log.Warnf("invalid %s %q, using the default concurrency", common.S3ObjectConcurrency, value)
+		} else {
+			workers = concurrency
+		}
+	}
+	if workers == 0 {
+		memorySize, _ := strconv.Atoi(os.Getenv(common.LambdaMemorySize))
+		workers = min(memorySize/common.ObjectWorkerMemory, common.MaxObjectWorkers)
+	}
+	return max(min(workers, recordCount), 1)
 }
 
-// fetchS3Reader fetches an S3 object from the specified bucket and returns an io.ReadCloser for reading its contents.
-// It returns the io.ReadCloser and any error encountered during the operation.
-func fetchS3Reader(ctx context.Context, bucketName string, objectName string, s3Client ObjectClient) (io.ReadCloser, error) {
-	resp, err := s3Client.GetObject(ctx, &s3.GetObjectInput{
+// fetchS3Reader fetches the version of an S3 object referenced by the event from the specified bucket.
+// The request is conditional on the ETag of the event, so an object overwritten since the event fails instead of being read at a newer revision.
+// It returns the GetObjectOutput, whose Body is used to read the object contents, and any error encountered during the operation.
+func fetchS3Reader(ctx context.Context, bucketName string, object events.S3Object, s3Client ObjectClient) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
-		Key:    aws.String(objectName),
-	})
+		Key:    aws.String(object.URLDecodedKey),
+	}
+	if object.VersionID != "" {
+		input.VersionId = aws.String(object.VersionID)
+	}
+	if object.ETag != "" {
+		input.IfMatch = aws.String(quoteETag(object.ETag))
+	}
+
+	resp, err := s3Client.GetObject(ctx, input)
 	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "PreconditionFailed" {
+			err = fmt.Errorf("object %s in bucket %s no longer matches ETag %s (version %q) from the event: %w", object.URLDecodedKey, bucketName, object.ETag, object.VersionID, err)
+		}
 		log.Errorf("failed to get S3 object reader: %v", err)
-		return nil, err
+		return nil, util.NewStageError(util.StageFetch, err)
+	}
+
+	return resp, nil
+}
+
+// addPositionAttributes adds the line number and byte offset of a log entry to its attributes.
+// Offsets are counted in the decompressed content of the object, so an entry read again keeps the same offset.
+func addPositionAttributes(logAttribute common.LogAttributes, position util.LinePosition) common.LogAttributes {
+	logAttribute["logLineNumber"] = position.LineNumber
+	logAttribute["logByteOffset"] = position.Offset
+	return logAttribute
+}
+
+// splitLineID returns the split.id of the messages of a line split by the line reader.
+// It is derived from the object version and the line number so that a retried object gets the same id.
+func splitLineID(bucketName string, object events.S3Object, position util.LinePosition) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s?versionId=%s#%d", bucketName, object.URLDecodedKey, object.VersionID, position.LineNumber)))
+	return hex.EncodeToString(hash[:8])
+}
+
+// linkLineFragments sets the split.id and split.index attributes of the messages of a fragment of a line split by the
+// line reader, numbering them from nextIndex, and returns the index of the next message of the line.
+// split.total is not set, since the number of messages of the line is only known once all of it has been read.
+func linkLineFragments(fragments []util.LogFragment, splitID string, nextIndex int) int {
+	for i := range fragments {
+		fragments[i].Attributes = common.LogAttributes{
+			"split.id":    splitID,
+			"split.index": nextIndex,
+		}
+		nextIndex++
 	}
+	return nextIndex
+}
 
-	return resp.Body, nil
+// quoteETag wraps the ETag in double quotes as expected by the If-Match header.
+// S3 event notifications contain the ETag without quotes.
+func quoteETag(eTag string) string {
+	if strings.HasPrefix(eTag, "\"") {
+		return eTag
+	}
+	return "\"" + eTag + "\""
 }
 
 // buildMeltLogsFromS3Bucket reads the contents of an S3 object line by line,
-// splits large messages, and produces log data batches to a channel.
-func buildMeltLogsFromS3Bucket(ctx context.Context, bucketName string, objectName string, channel chan common.DetailedLogsBatch, attributes common.LogAttributes, s3Client ObjectClient, readerFactory ReaderFactory) error {
-	if isCloudTrailDigest(objectName) {
-		log.Debugf("Skipping CloudTrail digest file %s in bucket %s", objectName, bucketName)
-		return nil
+// merges multiline entries, resolves their timestamps, splits large messages, and produces log data batches to a channel.
+// The lines read and their batches are recorded in the metrics of the context, with the bucket as dimension.
+func buildMeltLogsFromS3Bucket(ctx context.Context, bucketName string, object events.S3Object, channel chan common.DetailedLogsBatch, attributes common.LogAttributes, s3Client ObjectClient, readerFactory ReaderFactory) error {
+	objectName := object.URLDecodedKey
+	metrics := util.MetricsFromContext(ctx)
+	dimensions := util.SourceDimensions(attributes)
+	start := time.Now()
+	defer func() {
+		metrics.ObserveDuration(util.MetricSourceDuration, time.Since(start), dimensions)
+	}()
+
+	assembler, err := util.NewMultilineAssemblerForObject(os.Getenv(common.MultilineConfig), bucketName, objectName)
+	if err != nil {
+		log.Errorf("failed to load multiline config: %v", err)
+		return util.NewStageError(util.StageParse, err)
 	}
 
-	s3Reader, err := fetchS3Reader(ctx, bucketName, objectName, s3Client)
+	longLinePolicy, err := util.ParseLongLinePolicy(os.Getenv(common.LongLinePolicy))
 	if err != nil {
-		return err
+		log.Errorf("failed to load long line policy: %v", err)
+		return util.NewStageError(util.StageParse, err)
+	}
+
+	timestampExtractor, err := util.NewTimestampExtractorForObject(os.Getenv(common.TimestampConfig), bucketName, objectName)
+	if err != nil {
+		log.Errorf("failed to load timestamp config: %v", err)
+		return util.NewStageError(util.StageParse, err)
 	}
-	defer s3Reader.Close()
 
-	reader, err := readerFactory(s3Reader, objectName)
+	s3Object, err := fetchS3Reader(ctx, bucketName, object, s3Client)
 	if err != nil {
 		return err
 	}
+	defer s3Object.Body.Close()
+
+	if err := addObjectMetadata(ctx, bucketName, objectName, s3Object, attributes, s3Client); err != nil {
+		return util.NewStageError(util.StageFetch, err)
+	}
+
+	reader, err := readerFactory(s3Object.Body, objectName)
+	if err != nil {
+		return util.NewStageError(util.StageParse, err)
+	}
 
-	scanner := bufio.NewScanner(reader)
-	scanner.Buffer(make([]byte, 0, common.MaxBufferSize), common.MaxBufferSize)
+	lineReader := util.NewLineReader(reader, common.MaxBufferSize, longLinePolicy)
 
 	isCloudTrailLog := isCloudTrail(objectName)
 
-	batchSize := 0
-	messageCount := 0
+	batcher := util.NewBatcher(channel, attributes, util.DefaultBatchLimits(), util.MetricsBatchHooks(metrics, dimensions))
+	// The entries already batched are sent, and the age timer stopped, on every return, before the channel is closed.
+	defer batcher.Close()
+
+	splitJSONAware := os.Getenv(common.SplitJSONAware) == "true"
+	orderingAttributes := os.Getenv(common.OrderingAttributes) == "true"
+
+	addMessages := func(fragments []util.LogFragment, timestamp string, logAttribute common.LogAttributes) {
+		for _, fragment := range fragments {
+			message := fragment.Message
+			entry := common.Log{
+				Timestamp:  timestamp,
+				Log:        message,
+				Attributes: logAttribute,
+			}
+			if fragment.Attributes != nil {
+				entry.Attributes = common.LogAttributes{}
+				for name, value := range logAttribute {
+					entry.Attributes[name] = value
+				}
+				for name, value := range fragment.Attributes {
+					entry.Attributes[name] = value
+				}
+			}
+
+			batcher.Add(entry)
+		}
+	}
 
-	var currentBatch common.LogData
+	addAssembled := func(assembled util.AssembledEntry) {
+		timestamp, logAttribute := resolveTimestamp(assembled.Message, timestampExtractor, s3Object)
+		if orderingAttributes {
+			addPositionAttributes(logAttribute, assembled.Position)
+		}
+		addMessages(util.SplitLogMessage(assembled.Message, splitJSONAware), timestamp, logAttribute)
+	}
 
 	log.Debug("Reading file line by line")
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		var messages []string
+	// The messages of a line split by the line reader are linked like the fragments of a split message,
+	// and share the timestamp resolved from its first fragment.
+	lineSplitID, lineSplitIndex := "", 0
+	var lineTimestamp string
+	var lineTimestampAttributes common.LogAttributes
+
+	// unread describes the lines left unread once the context is done.
+	unread := ""
+	linesRead, bytesIn := 0, 0
+	for lineReader.Scan() {
+		if ctx.Err() != nil {
+			position := lineReader.Position()
+			unread = fmt.Sprintf("from line %d (byte offset %d)", position.LineNumber, position.Offset)
+			break
+		}
+		line := lineReader.Text()
+		linesRead++
+		bytesIn += len(line)
 		if isCloudTrailLog {
-			messages, err = util.ParseCloudTrailEvents(line)
+			messages, err := util.ParseCloudTrailEvents(line)
 			if err != nil {
 				log.Errorf("failed to parse CloudTrail events: %v", err)
-				return err
+				return util.NewStageError(util.StageParse, err)
 			}
-		} else {
-			messages = util.SplitLargeMessages(line)
-		}
-
-		for _, message := range messages {
-			entry := common.Log{
-				Log: message,
+			fragments := make([]util.LogFragment, len(messages))
+			for i, message := range messages {
+				fragments[i] = util.LogFragment{Message: message}
 			}
-
-			if batchSize+len(message) > common.MaxPayloadSize || messageCount >= common.MaxPayloadMessages {
-				util.ProduceMessageToChannel(channel, currentBatch, attributes)
-				currentBatch = nil
-				batchSize = 0
-				messageCount = 0
+			var logAttribute common.LogAttributes
+			if orderingAttributes {
+				logAttribute = addPositionAttributes(common.LogAttributes{}, lineReader.Position())
+			}
+			addMessages(fragments, "", logAttribute)
+		} else if index, split := lineReader.Fragment(); split {
+			// Fragments of a split line are kept out of multiline entries, which would join them with a newline
+			// the line does not have. The entry being assembled ends before the line.
+			if assembled, ok := assembler.Flush(); ok {
+				addAssembled(assembled)
 			}
-			currentBatch = append(currentBatch, entry)
-			batchSize = batchSize + len(message)
-			messageCount = messageCount + 1
+			position := lineReader.Position()
+			if index == 0 {
+				lineSplitID, lineSplitIndex = splitLineID(bucketName, object, position), 0
+				lineTimestamp, lineTimestampAttributes = resolveTimestamp(line, timestampExtractor, s3Object)
+			}
+			logAttribute := maps.Clone(lineTimestampAttributes)
+			if orderingAttributes {
+				addPositionAttributes(logAttribute, position)
+			}
+			fragments := util.SplitLogMessage(line, splitJSONAware)
+			lineSplitIndex = linkLineFragments(fragments, lineSplitID, lineSplitIndex)
+			addMessages(fragments, lineTimestamp, logAttribute)
+		} else if assembled, ok := assembler.AddAt(line, lineReader.Position()); ok {
+			addAssembled(assembled)
 		}
 	}
 
+	if assembled, ok := assembler.Flush(); ok {
+		addAssembled(assembled)
+	}
+
 	log.Debug("Finished reading file line by line")
 
-	if len(currentBatch) > 0 {
-		util.ProduceMessageToChannel(channel, currentBatch, attributes)
+	batcher.Close()
+
+	metrics.Count(util.MetricRecordsRead, float64(linesRead), dimensions)
+	metrics.Count(util.MetricBytesIn, float64(bytesIn), dimensions)
+	metrics.Count(util.MetricRecordsDropped, float64(lineReader.SkippedLines), dimensions)
+
+	if lineReader.TruncatedLines > 0 || lineReader.SplitLines > 0 || lineReader.SkippedLines > 0 {
+		log.Warnf("lines longer than %d bytes in object %s in bucket %s: %d truncated, %d split, %d skipped",
+			common.MaxBufferSize, objectName, bucketName, lineReader.TruncatedLines, lineReader.SplitLines, lineReader.SkippedLines)
 	}
 
-	if err := scanner.Err(); err != nil {
+	if unread == "" && lineReader.Err() != nil && ctx.Err() != nil {
+		// Reading the body of the object stopped with the context.
+		unread = fmt.Sprintf("after line %d", lineReader.Position().LineNumber)
+	}
+	if unread != "" {
+		err := unreadObjectError(ctx, bucketName, objectName, unread)
+		log.Errorf("stopped reading object: %v", err)
+		return util.NewStageError(util.StageParse, err)
+	}
+
+	if err := lineReader.Err(); err != nil {
 		log.Errorf("failed to read line by line for object %s in bucket %s: %v", objectName, bucketName, err)
-		return nil
+		return util.NewStageError(util.StageParse, fmt.Errorf("failed to read object %s in bucket %s: %w", objectName, bucketName, err))
 	}
 
+	metrics.Count(util.MetricObjectsRead, 1, dimensions)
 	return nil
 }
 
+// unreadObjectError returns the error of the lines of an object left unread once the context is done,
+// a util.TimeoutError when the deadline of the invocation is approaching.
+func unreadObjectError(ctx context.Context, bucketName string, objectKey string, unread string) error {
+	if !util.IsDeadlineApproaching(ctx) {
+		return fmt.Errorf("object %s in bucket %s not processed (%s): %w", objectKey, bucketName, unread, context.Cause(ctx))
+	}
+	return &util.TimeoutError{Source: fmt.Sprintf("object %s in bucket %s", objectKey, bucketName), Unprocessed: unread}
+}
+
+// resolveTimestamp determines the timestamp of a log message in milliseconds since the Unix epoch.
+// The timestamp is extracted from the message when possible, otherwise the LastModified time of the S3 object is used.
+// It also returns the log attributes recording which source the timestamp came from.
+func resolveTimestamp(message string, timestampExtractor *util.TimestampExtractor, s3Object *s3.GetObjectOutput) (string, common.LogAttributes) {
+	if timestamp, ok := timestampExtractor.Extract(message); ok {
+		return strconv.FormatInt(timestamp.UnixMilli(), 10), common.LogAttributes{"logTimestampSource": util.TimestampSourceMessage}
+	}
+	if s3Object.LastModified != nil {
+		return strconv.FormatInt(s3Object.LastModified.UnixMilli(), 10), common.LogAttributes{"logTimestampSource": util.TimestampSourceLastModified}
+	}
+	return "", common.LogAttributes{"logTimestampSource": util.TimestampSourceIngestTime}
+}
+
 // isCloudTrail checks whether the log file specified by the key is a CloudTrail log based on a regex pattern.
 // If no pattern is provided,
 // it uses the default pattern or one from the environment variable S3_CLOUD_TRAIL_LOG_PATTERN.
@@ -192,6 +476,8 @@ func DefaultReaderFactory(input io.ReadCloser, filename string) (io.Reader, erro
 }
 
 // NewS3Client creates a new S3 client using the provided context and returns the client.
+// Buckets with a role configured in S3_BUCKET_ROLES are accessed with the credentials of that role,
+// and buckets with a read mode configured in S3_BUCKET_ACCESS are read using that mode.
 func NewS3Client(ctx context.Context) (ObjectClient, error) {
 	cfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
@@ -199,6 +485,23 @@ func NewS3Client(ctx context.Context) (ObjectClient, error) {
 		return nil, err
 	}
 
-	s3Client := s3.NewFromConfig(cfg)
-	return s3Client, nil
+	bucketRoles, err := ParseBucketRoles(os.Getenv(common.S3BucketRoles))
+	if err != nil {
+		log.Errorf("unable to load bucket roles: %v", err)
+		return nil, err
+	}
+
+	bucketAccesses, err := ParseBucketAccesses(os.Getenv(common.S3BucketAccess))
+	if err != nil {
+		log.Errorf("unable to load bucket access config: %v", err)
+		return nil, err
+	}
+
+	// The read mode is applied below the role selection, because an access point ARN replaces the bucket name used to select the role.
+	keyProvider := secretsManagerKeyProvider()
+	clientForRole := assumeRoleClientFactory(cfg)
+	s3Client := newBucketAccessClient(s3.NewFromConfig(cfg), bucketAccesses, keyProvider)
+	return newBucketRoleClient(s3Client, bucketRoles, func(bucketRole BucketRole) ObjectClient {
+		return newBucketAccessClient(clientForRole(bucketRole), bucketAccesses, keyProvider)
+	}), nil
 }
@@ -11,12 +11,15 @@ import (
 	"github.com/newrelic/aws-unified-lambda-logging/common"
 	"github.com/newrelic/aws-unified-lambda-logging/util"
 	"io"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -36,6 +39,41 @@ func (m *MockAPI) GetObject(ctx context.Context, params *s3.GetObjectInput, optF
 	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
 }
 
+// HeadObject provides a mock response for the HeadObject function of the S3 API.
+// It returns the mock HeadObjectOutput and an error if any.
+func (m *MockAPI) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.HeadObjectOutput), args.Error(1)
+}
+
+// GetObjectTagging provides a mock response for the GetObjectTagging function of the S3 API.
+// It returns the mock GetObjectTaggingOutput and an error if any.
+func (m *MockAPI) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.GetObjectTaggingOutput), args.Error(1)
+}
+
+// PutObjectTagging provides a mock response for the PutObjectTagging function of the S3 API.
+// It returns the mock PutObjectTaggingOutput and an error if any.
+func (m *MockAPI) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.PutObjectTaggingOutput), args.Error(1)
+}
+
+// CopyObject provides a mock response for the CopyObject function of the S3 API.
+// It returns the mock CopyObjectOutput and an error if any.
+func (m *MockAPI) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.CopyObjectOutput), args.Error(1)
+}
+
+// DeleteObject provides a mock response for the DeleteObject function of the S3 API.
+// It returns the mock DeleteObjectOutput and an error if any.
+func (m *MockAPI) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	args := m.Called(ctx, params)
+	return args.Get(0).(*s3.DeleteObjectOutput), args.Error(1)
+}
+
 // MockReaderFactory is a mock implementation of the ReaderFactory function type
 type MockReaderFactory struct {
 	mock.Mock
@@ -132,7 +170,7 @@ func TestGetLogsFromS3Event(t *testing.T) {
 				m.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{}, errors.New("s3 error"))
 			},
 			setupRFMock:   func(m *MockReaderFactory) {},
-			expectedError: errors.New("s3 error"),
+			expectedError: errors.New("fetch failed: s3 error"),
 			URLDecodedKey: "test-key.gz",
 		},
 		{
@@ -219,7 +257,7 @@ func TestGetLogsFromS3Event(t *testing.T) {
 			tc.setupRFMock(mockReaderFactory)
 
 			// Call the GetLogsFromS3Event function
-			err := GetLogsFromS3Event(ctx, s3Event, awsConfiguration, channel, mockS3Client, mockReaderFactory.Create)
+			_, err := GetLogsFromS3Event(ctx, s3Event, awsConfiguration, channel, mockS3Client, mockReaderFactory.Create)
 			close(channel)
 
 			// Check for expected errors
@@ -331,3 +369,436 @@ func TestDefaultReaderFactory(t *testing.T) {
 		})
 	}
 }
+
+// TestGetLogsFromS3EventMultiline verifies that stack trace lines in an S3 object are merged into the preceding log entry
+// when a multiline rule matches the bucket and key prefix.
+func TestGetLogsFromS3EventMultiline(t *testing.T) {
+	os.Setenv(common.MultilineConfig, `[{"BucketName": "test-bucket", "KeyPrefix": "app/", "StartPattern": "^\\d{4}-"}]`)
+	defer os.Unsetenv(common.MultilineConfig)
+
+	content := "2024-01-01 ERROR failed\nTraceback (most recent call last):\n  File \"main.py\", line 1\n2024-01-01 INFO recovered\n"
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte(content))),
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "app/test.log"},
+				},
+			},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 2)
+	assert.Equal(t, "2024-01-01 ERROR failed\nTraceback (most recent call last):\n  File \"main.py\", line 1", batch[0].Entries[0].Log)
+	assert.Equal(t, "2024-01-01 INFO recovered", batch[0].Entries[1].Log)
+}
+
+// TestGetLogsFromS3EventOrderingAttributes verifies that entries carry the line number and byte offset of their first line.
+func TestGetLogsFromS3EventOrderingAttributes(t *testing.T) {
+	os.Setenv(common.OrderingAttributes, "true")
+	defer os.Unsetenv(common.OrderingAttributes)
+	os.Setenv(common.MultilineConfig, `[{"BucketName": "test-bucket", "StartPattern": "^\\d{4}-"}]`)
+	defer os.Unsetenv(common.MultilineConfig)
+
+	content := "2024-01-01 ERROR failed\n  at main\n2024-01-01 INFO recovered\n"
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(bytes.NewReader([]byte(content))),
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "test.log"},
+				},
+			},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 2)
+	assert.Equal(t, int64(1), batch[0].Entries[0].Attributes["logLineNumber"])
+	assert.Equal(t, int64(0), batch[0].Entries[0].Attributes["logByteOffset"])
+	assert.Equal(t, int64(3), batch[0].Entries[1].Attributes["logLineNumber"])
+	assert.Equal(t, int64(34), batch[0].Entries[1].Attributes["logByteOffset"])
+}
+
+// TestGetLogsFromS3EventSplitLongLine verifies that the messages of a line split by the line reader are linked
+// with split.id and split.index attributes, in the order of the line.
+func TestGetLogsFromS3EventSplitLongLine(t *testing.T) {
+	content := "first\n" + strings.Repeat("a", common.MaxBufferSize+10) + "\nlast\n"
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(content)),
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 100)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "test.log"},
+				},
+			},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	var entries []common.Log
+	for batch := range channel {
+		for _, detailedLog := range batch {
+			entries = append(entries, detailedLog.Entries...)
+		}
+	}
+	// The first fragment of the line is split into messages of the maximum message size, the second one fits in a message.
+	messages := common.MaxBufferSize/common.MaxMessageSize + 1
+	assert.Len(t, entries, messages+2)
+	assert.Equal(t, "first", entries[0].Log)
+	assert.Equal(t, "last", entries[len(entries)-1].Log)
+	assert.NotContains(t, entries[0].Attributes, "split.id")
+
+	splitID := entries[1].Attributes["split.id"]
+	assert.NotEmpty(t, splitID)
+	var line strings.Builder
+	for i, entry := range entries[1 : messages+1] {
+		assert.Equal(t, splitID, entry.Attributes["split.id"])
+		assert.Equal(t, i, entry.Attributes["split.index"])
+		assert.NotContains(t, entry.Attributes, "split.total")
+		line.WriteString(entry.Log)
+	}
+	assert.Equal(t, common.MaxBufferSize+10, line.Len())
+}
+
+// TestGetLogsFromS3EventSplitLongLineMultiline verifies that the fragments of a line split by the line reader are linked
+// and kept out of multiline entries when a multiline rule matches the object.
+func TestGetLogsFromS3EventSplitLongLineMultiline(t *testing.T) {
+	os.Setenv(common.MultilineConfig, `[{"BucketName": "test-bucket", "StartPattern": "^START"}]`)
+	defer os.Unsetenv(common.MultilineConfig)
+
+	longLine := strings.Repeat("a", common.MaxBufferSize+10)
+	content := "START first\n  at frame\n" + longLine + "\n  at other frame\nSTART last\n"
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(content)),
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 100)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "test.log"},
+				},
+			},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	var entries []common.Log
+	for batch := range channel {
+		for _, detailedLog := range batch {
+			entries = append(entries, detailedLog.Entries...)
+		}
+	}
+	messages := common.MaxBufferSize/common.MaxMessageSize + 1
+	assert.Len(t, entries, messages+3)
+	assert.Equal(t, "START first\n  at frame", entries[0].Log)
+	assert.Equal(t, "  at other frame", entries[messages+1].Log)
+	assert.Equal(t, "START last", entries[messages+2].Log)
+
+	splitID := entries[1].Attributes["split.id"]
+	assert.NotEmpty(t, splitID)
+	var line strings.Builder
+	for i, entry := range entries[1 : messages+1] {
+		assert.Equal(t, splitID, entry.Attributes["split.id"])
+		assert.Equal(t, i, entry.Attributes["split.index"])
+		line.WriteString(entry.Log)
+	}
+	assert.Equal(t, longLine, line.String())
+	for _, entry := range []common.Log{entries[0], entries[messages+1], entries[messages+2]} {
+		assert.NotContains(t, entry.Attributes, "split.id")
+	}
+}
+
+// TestGetLogsFromS3EventParseErrorWithMaxAge verifies that the entries batched before a CloudTrail parse error are sent,
+// and that the age timer of the batch does not fire once the channel is closed.
+func TestGetLogsFromS3EventParseErrorWithMaxAge(t *testing.T) {
+	os.Setenv(common.BatchMaxAge, "20")
+	defer os.Unsetenv(common.BatchMaxAge)
+
+	content := generateCloudTrailTestLogs(2) + "\n{not json\n"
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(strings.NewReader(content)),
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 10)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "AWSLogs/123456789012_CloudTrail_us-east-1_20240101T0000Z_abc.json.gz"},
+				},
+			},
+		},
+	}
+	plainReader := func(input io.ReadCloser, filename string) (io.Reader, error) { return input, nil }
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, plainReader)
+	assert.ErrorContains(t, err, "parse failed")
+	close(channel)
+
+	entries := 0
+	for batch := range channel {
+		entries += len(batch[0].Entries)
+	}
+	assert.Equal(t, 2, entries)
+
+	// A timer left running would send on the closed channel and panic.
+	time.Sleep(60 * time.Millisecond)
+}
+
+// TestGetLogsFromS3EventTimestamps verifies that timestamps are extracted from log lines when a rule matches,
+// and that the LastModified time of the object is used otherwise.
+func TestGetLogsFromS3EventTimestamps(t *testing.T) {
+	os.Setenv(common.TimestampConfig, `[{"BucketName": "test-bucket", "JSONField": "time", "Format": "epoch_ms"}]`)
+	defer os.Unsetenv(common.TimestampConfig)
+
+	content := "{\"time\": 1733215127000, \"msg\": \"hello\"}\nplain text line\n"
+	lastModified := time.UnixMilli(1733216000000)
+
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body:         io.NopCloser(bytes.NewReader([]byte(content))),
+		LastModified: &lastModified,
+	}, nil)
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "test.log"},
+				},
+			},
+		},
+	}
+
+	_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	assert.NoError(t, err)
+	close(channel)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 2)
+	assert.Equal(t, "1733215127000", batch[0].Entries[0].Timestamp)
+	assert.Equal(t, util.TimestampSourceMessage, batch[0].Entries[0].Attributes["logTimestampSource"])
+	assert.Equal(t, "1733216000000", batch[0].Entries[1].Timestamp)
+	assert.Equal(t, util.TimestampSourceLastModified, batch[0].Entries[1].Attributes["logTimestampSource"])
+}
+
+// TestGetLogsFromS3EventObjectRevision verifies that the object version and ETag from the event are used to fetch the object,
+// that they are added as attributes, and that a changed object fails with a clear error.
+func TestGetLogsFromS3EventObjectRevision(t *testing.T) {
+	s3Event := events.S3Event{
+		Records: []events.S3EventRecord{
+			{
+				S3: events.S3Entity{
+					Bucket: events.S3Bucket{Name: "test-bucket"},
+					Object: events.S3Object{URLDecodedKey: "test.log", VersionID: "v1", ETag: "abc123", Size: 11},
+				},
+			},
+		},
+	}
+	matchesRevision := mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return aws.ToString(input.VersionId) == "v1" && aws.ToString(input.IfMatch) == "\"abc123\""
+	})
+
+	t.Run("Matching revision", func(t *testing.T) {
+		mockS3Client := new(MockAPI)
+		mockS3Client.On("GetObject", mock.Anything, matchesRevision).Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader([]byte("log content"))),
+		}, nil)
+
+		channel := make(chan common.DetailedLogsBatch, 1)
+		_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+		assert.NoError(t, err)
+		close(channel)
+
+		batch := <-channel
+		assert.Equal(t, "v1", batch[0].CommonData.Attributes["logObjectVersionId"])
+		assert.Equal(t, "abc123", batch[0].CommonData.Attributes["logObjectETag"])
+		assert.Equal(t, int64(11), batch[0].CommonData.Attributes["logObjectSize"])
+		mockS3Client.AssertExpectations(t)
+	})
+
+	t.Run("Changed revision", func(t *testing.T) {
+		mockS3Client := new(MockAPI)
+		mockS3Client.On("GetObject", mock.Anything, matchesRevision).Return(&s3.GetObjectOutput{}, &smithy.GenericAPIError{Code: "PreconditionFailed"})
+
+		channel := make(chan common.DetailedLogsBatch, 1)
+		_, err := GetLogsFromS3Event(context.Background(), s3Event, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+		assert.ErrorContains(t, err, "no longer matches ETag abc123")
+	})
+}
+
+// TestGetLogsFromS3EventMultipleRecords verifies that every object of an event is read in parallel,
+// and that an error reading one object does not stop the others from being read.
+func TestGetLogsFromS3EventMultipleRecords(t *testing.T) {
+	os.Setenv(common.S3ObjectConcurrency, "3")
+	defer os.Unsetenv(common.S3ObjectConcurrency)
+
+	mockS3Client := new(MockAPI)
+	for _, key := range []string{"a.log", "c.log", "d.log"} {
+		mockS3Client.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+			return aws.ToString(input.Key) == key
+		})).Return(&s3.GetObjectOutput{
+			Body: io.NopCloser(bytes.NewReader([]byte("log from " + key + "\n"))),
+		}, nil)
+	}
+	mockS3Client.On("GetObject", mock.Anything, mock.MatchedBy(func(input *s3.GetObjectInput) bool {
+		return aws.ToString(input.Key) == "b.log"
+	})).Return(&s3.GetObjectOutput{}, errors.New("access denied"))
+
+	var records []events.S3EventRecord
+	for _, key := range []string{"a.log", "b.log", "c.log", "d.log"} {
+		records = append(records, events.S3EventRecord{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: "test-bucket"},
+				Object: events.S3Object{URLDecodedKey: key},
+			},
+		})
+	}
+
+	channel := make(chan common.DetailedLogsBatch, len(records))
+	results, err := GetLogsFromS3Event(context.Background(), events.S3Event{Records: records}, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	close(channel)
+	assert.EqualError(t, err, "fetch failed: access denied")
+
+	assert.Len(t, results, 4)
+	for i, result := range results {
+		assert.Equal(t, records[i].S3.Object.URLDecodedKey, result.Object.URLDecodedKey)
+	}
+	assert.Error(t, results[1].Err)
+
+	logs := map[string]string{}
+	for batch := range channel {
+		logs[batch[0].CommonData.Attributes["logObjectKey"].(string)] = batch[0].Entries[0].Log
+	}
+	assert.Equal(t, map[string]string{"a.log": "log from a.log", "c.log": "log from c.log", "d.log": "log from d.log"}, logs)
+}
+
+// cancellingReader is a reader returning its chunks one Read at a time, and calling cancel before returning the second one.
+type cancellingReader struct {
+	chunks []string
+	reads  int
+	cancel func()
+}
+
+// Read returns the next chunk.
+func (r *cancellingReader) Read(p []byte) (int, error) {
+	if r.reads == len(r.chunks) {
+		return 0, io.EOF
+	}
+	if r.reads == 1 {
+		r.cancel()
+	}
+	r.reads++
+	return copy(p, r.chunks[r.reads-1]), nil
+}
+
+// TestGetLogsFromS3EventDeadlineApproaching verifies that the lines read before the deadline of the invocation is approaching are sent,
+// that the line being read and the objects not read yet are reported in a util.TimeoutError.
+func TestGetLogsFromS3EventDeadlineApproaching(t *testing.T) {
+	os.Setenv(common.S3ObjectConcurrency, "1")
+	defer os.Unsetenv(common.S3ObjectConcurrency)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	mockS3Client := new(MockAPI)
+	mockS3Client.On("GetObject", mock.Anything, mock.Anything).Return(&s3.GetObjectOutput{
+		Body: io.NopCloser(&cancellingReader{
+			chunks: []string{"first\n", "second\nthird\n"},
+			cancel: func() { cancel(util.ErrDeadlineApproaching) },
+		}),
+	}, nil).Once()
+
+	var records []events.S3EventRecord
+	for _, key := range []string{"a.log", "b.log"} {
+		records = append(records, events.S3EventRecord{
+			S3: events.S3Entity{
+				Bucket: events.S3Bucket{Name: "test-bucket"},
+				Object: events.S3Object{URLDecodedKey: key},
+			},
+		})
+	}
+
+	channel := make(chan common.DetailedLogsBatch, 1)
+	results, err := GetLogsFromS3Event(ctx, events.S3Event{Records: records}, util.AWSConfiguration{}, channel, mockS3Client, DefaultReaderFactory)
+	close(channel)
+	assert.ErrorIs(t, err, util.ErrDeadlineApproaching)
+	assert.EqualError(t, results[0].Err, "parse failed: invocation deadline approaching: object a.log in bucket test-bucket not processed: from line 2 (byte offset 6)")
+	assert.EqualError(t, results[1].Err, "parse failed: invocation deadline approaching: object b.log in bucket test-bucket not processed: whole object")
+	mockS3Client.AssertExpectations(t)
+
+	batch := <-channel
+	assert.Len(t, batch[0].Entries, 1)
+	assert.Equal(t, "first", batch[0].Entries[0].Log)
+}
+
+// TestObjectWorkers tests the number of workers reading the objects of an event.
+func TestObjectWorkers(t *testing.T) {
+	tests := []struct {
+		name        string // Test case name
+		concurrency string // Value of S3_OBJECT_CONCURRENCY
+		memorySize  string // Value of AWS_LAMBDA_FUNCTION_MEMORY_SIZE
+		recordCount int    // Number of records in the event
+		expected    int    // Expected number of workers
+	}{
+		{name: "Configured concurrency", concurrency: "4", memorySize: "128", recordCount: 10, expected: 4},
+		{name: "Limited by records", concurrency: "4", recordCount: 2, expected: 2},
+		{name: "Derived from memory", memorySize: "512", recordCount: 10, expected: 4},
+		{name: "Memory derived limit", memorySize: "10240", recordCount: 100, expected: common.MaxObjectWorkers},
+		{name: "Invalid concurrency", concurrency: "many", memorySize: "256", recordCount: 10, expected: 2},
+		{name: "At least one worker", recordCount: 0, expected: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(common.S3ObjectConcurrency, tt.concurrency)
+			t.Setenv(common.LambdaMemorySize, tt.memorySize)
+			assert.Equal(t, tt.expected, objectWorkers(tt.recordCount))
+		})
+	}
+}
@@ -12,6 +12,7 @@ import (
 const (
 	CLOUDWATCH = "cloudwatch" // CLOUDWATCH represents the event type for CloudWatch logs.
 	S3         = "s3"         // S3 represents the event type for S3 events.
+	REPLAY     = "replay"     // REPLAY represents the event type for replaying failed log batches.
 )
 
 var log = logger.NewLogrusLogger(logger.WithDebugLevel())
@@ -21,6 +22,14 @@ type Event struct {
 	EventType          string                    // EventType represents the type of the event.
 	CloudwatchLogsData events.CloudwatchLogsData // CloudwatchLogsData represents the CloudWatch logs data.
 	S3Event            events.S3Event            // S3Event represents the S3 event data.
+	Replay             ReplayRequest             // Replay represents the replay request.
+}
+
+// ReplayRequest asks to resubmit the failed log batches stored in a dead letter destination.
+// It is sent to the function as {"replay": {"source": "s3://bucket/prefix", "maxArtifacts": 100}}.
+type ReplayRequest struct {
+	Source       string `json:"source"`       // Source is the dead letter destination to replay, s3://bucket/prefix or an SQS queue URL.
+	MaxArtifacts int    `json:"maxArtifacts"` // MaxArtifacts is the maximum number of failed log batches to replay.
 }
 
 // UnmarshalJSON unmarshals the JSON data into the Event struct.
@@ -50,5 +59,17 @@ func (event *Event) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	// Try to unmarshal the event as a replay request
+	var replayEvent struct {
+		Replay *ReplayRequest `json:"replay"`
+	}
+	err = json.Unmarshal(data, &replayEvent)
+	if err == nil && replayEvent.Replay != nil && replayEvent.Replay.Source != "" {
+		event.EventType = REPLAY
+		event.Replay = *replayEvent.Replay
+
+		return nil
+	}
+
 	return nil
 }
@@ -63,3 +63,15 @@ func TestUnmarshalJSONCloudWatchLogsData(t *testing.T) {
 	assert.NotEqual(t, expected.EventType, event.EventType)
 	assert.NotEqual(t, expected.CloudwatchLogsData, event.CloudwatchLogsData)
 }
+
+// TestUnmarshalJSONReplay is a unit test function that tests the unmarshaling of a replay request.
+func TestUnmarshalJSONReplay(t *testing.T) {
+	input := []byte(`{"replay": {"source": "s3://dead-letter-bucket/failed/", "maxArtifacts": 10}}`)
+
+	var event Event
+	err := json.Unmarshal(input, &event)
+
+	assert.NoError(t, err)
+	assert.Equal(t, REPLAY, event.EventType)
+	assert.Equal(t, ReplayRequest{Source: "s3://dead-letter-bucket/failed/", MaxArtifacts: 10}, event.Replay)
+}
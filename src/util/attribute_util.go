@@ -0,0 +1,193 @@
+package util
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// ExcessAttributesPolicy tells what to do with the attributes of an event over the maximum number of attributes.
+type ExcessAttributesPolicy string
+
+// Policies for the attributes over the maximum number of attributes.
+const (
+	ExcessAttributesDrop    ExcessAttributesPolicy = "drop"    // ExcessAttributesDrop drops the excess attributes.
+	ExcessAttributesFlatten ExcessAttributesPolicy = "flatten" // ExcessAttributesFlatten keeps the excess attributes as a JSON object in a single attribute.
+)
+
+// AttributeLimits are the limits enforced on the attributes of every event before it is sent.
+type AttributeLimits struct {
+	MaxAttributes  int                    // MaxAttributes is the maximum number of attributes of an event, common attributes included.
+	MaxNameLength  int                    // MaxNameLength is the maximum length of an attribute name, in bytes.
+	MaxValueLength int                    // MaxValueLength is the maximum length of a string attribute value, in bytes.
+	Excess         ExcessAttributesPolicy // Excess tells what to do with the attributes over MaxAttributes.
+}
+
+// DefaultAttributeLimits returns the limits of the Log API, lowered by NR_ATTRIBUTE_MAX_COUNT, NR_ATTRIBUTE_MAX_NAME_LENGTH
+// and NR_ATTRIBUTE_MAX_VALUE_LENGTH, with the policy for excess attributes set in NR_EXCESS_ATTRIBUTES_POLICY.
+func DefaultAttributeLimits() AttributeLimits {
+	limits := AttributeLimits{
+		MaxAttributes:  positiveIntFromEnv(common.AttributeMaxCount, common.MaxAttributes),
+		MaxNameLength:  positiveIntFromEnv(common.AttributeMaxNameLength, common.MaxAttributeNameLength),
+		MaxValueLength: positiveIntFromEnv(common.AttributeMaxValueLength, common.MaxAttributeValueLength),
+		Excess:         ExcessAttributesFlatten,
+	}
+	policy := os.Getenv(common.ExcessAttributesPolicy)
+	switch ExcessAttributesPolicy(policy) {
+	case "":
+	case ExcessAttributesDrop, ExcessAttributesFlatten:
+		limits.Excess = ExcessAttributesPolicy(policy)
+	default:
+		log.Warnf("invalid %s %q, using the default value %s", common.ExcessAttributesPolicy, policy, limits.Excess)
+	}
+	return limits
+}
+
+// withDefaults returns the limits with every limit that is not set, or exceeds the limits of the Log API, replaced with that of the Log API.
+func (l AttributeLimits) withDefaults() AttributeLimits {
+	if l.MaxAttributes <= 0 || l.MaxAttributes > common.MaxAttributes {
+		l.MaxAttributes = common.MaxAttributes
+	}
+	if l.MaxNameLength <= 0 || l.MaxNameLength > common.MaxAttributeNameLength {
+		l.MaxNameLength = common.MaxAttributeNameLength
+	}
+	if l.MaxValueLength <= 0 || l.MaxValueLength > common.MaxAttributeValueLength {
+		l.MaxValueLength = common.MaxAttributeValueLength
+	}
+	if l.Excess != ExcessAttributesDrop {
+		l.Excess = ExcessAttributesFlatten
+	}
+	return l
+}
+
+// NormalizeAttributes enforces the limits on a set of attributes allowed at most maxAttributes attributes.
+// Nested objects are flattened into attributes named with the path of their members, as New Relic stores them.
+// Names and string values over the length limits are truncated. When there are more than maxAttributes attributes,
+// those following the first ones in name order are dropped or kept as a JSON object in the nr.excessAttributes attribute.
+// Every name that was truncated, dropped or moved is listed in the nr.truncatedAttributes attribute.
+// The attributes are returned unchanged, and not copied, when they are within the limits;
+// otherwise a normalized copy is returned along with the names of the affected attributes.
+func NormalizeAttributes(attributes common.LogAttributes, limits AttributeLimits, maxAttributes int) (common.LogAttributes, []string) {
+	limits = limits.withDefaults()
+	if withinLimits(attributes, limits, maxAttributes) {
+		return attributes, nil
+	}
+
+	flattened := common.LogAttributes{}
+	flattenAttributes("", attributes, flattened)
+	names := make([]string, 0, len(flattened))
+	for name := range flattened {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	normalized := common.LogAttributes{}
+	var excess []string
+	var truncated []string
+	// Room is kept for nr.truncatedAttributes, and for nr.excessAttributes when the excess attributes are kept.
+	available := maxAttributes - 1
+	if len(names) > available && limits.Excess == ExcessAttributesFlatten {
+		available--
+	}
+	for _, name := range names {
+		normalizedName := truncateString(name, limits.MaxNameLength)
+		if _, duplicate := normalized[normalizedName]; duplicate || len(normalized) >= available {
+			excess = append(excess, name)
+			truncated = append(truncated, name)
+			continue
+		}
+		value := flattened[name]
+		affected := normalizedName != name
+		if text, ok := value.(string); ok && len(text) > limits.MaxValueLength {
+			value = truncateString(text, limits.MaxValueLength)
+			affected = true
+		}
+		if affected {
+			truncated = append(truncated, name)
+		}
+		normalized[normalizedName] = value
+	}
+
+	if len(excess) > 0 && limits.Excess == ExcessAttributesFlatten && available >= 0 {
+		normalized[common.ExcessAttributesAttribute] = encodeExcessAttributes(excess, flattened, limits.MaxValueLength)
+	}
+	if len(truncated) > 0 && maxAttributes > 0 {
+		normalized[common.TruncatedAttributesAttribute] = truncateString(strings.Join(truncated, ","), limits.MaxValueLength)
+	}
+	return normalized, truncated
+}
+
+// encodeExcessAttributes encodes the named attributes as a JSON object of at most maxLength bytes.
+// Attributes are added in order while they fit, so that the object is always valid JSON.
+func encodeExcessAttributes(names []string, attributes common.LogAttributes, maxLength int) string {
+	var encoded strings.Builder
+	encoded.WriteString("{")
+	for _, name := range names {
+		member, err := json.Marshal(common.LogAttributes{name: attributes[name]})
+		if err != nil {
+			continue
+		}
+		// The member is encoded as {"name":value}, without its braces it is preceded by a comma.
+		member = member[1 : len(member)-1]
+		if encoded.Len() > 1 {
+			member = append([]byte(","), member...)
+		}
+		if encoded.Len()+len(member)+1 > maxLength {
+			continue
+		}
+		encoded.Write(member)
+	}
+	encoded.WriteString("}")
+	return encoded.String()
+}
+
+// withinLimits reports whether attributes without nested objects are within the limits.
+func withinLimits(attributes common.LogAttributes, limits AttributeLimits, maxAttributes int) bool {
+	if len(attributes) > maxAttributes {
+		return false
+	}
+	for name, value := range attributes {
+		if len(name) > limits.MaxNameLength {
+			return false
+		}
+		switch typed := value.(type) {
+		case string:
+			if len(typed) > limits.MaxValueLength {
+				return false
+			}
+		case map[string]interface{}, common.LogAttributes:
+			return false
+		}
+	}
+	return true
+}
+
+// flattenAttributes adds the attributes to flattened, replacing nested objects with their members named with their path.
+func flattenAttributes(prefix string, attributes map[string]interface{}, flattened common.LogAttributes) {
+	for name, value := range attributes {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			flattenAttributes(prefix+name+".", typed, flattened)
+		case common.LogAttributes:
+			flattenAttributes(prefix+name+".", typed, flattened)
+		default:
+			flattened[prefix+name] = value
+		}
+	}
+}
+
+// truncateString truncates a string to at most maxLength bytes, on a rune boundary.
+func truncateString(value string, maxLength int) string {
+	if len(value) <= maxLength {
+		return value
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
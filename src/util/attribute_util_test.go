@@ -0,0 +1,101 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNormalizeAttributes tests that attributes are truncated, flattened, dropped and annotated deterministically.
+func TestNormalizeAttributes(t *testing.T) {
+	tests := []struct {
+		name              string               // Test case name
+		attributes        common.LogAttributes // Attributes to normalize
+		limits            AttributeLimits      // Limits to enforce
+		maxAttributes     int                  // Maximum number of attributes
+		expected          common.LogAttributes // Expected attributes
+		expectedTruncated []string             // Expected names of the affected attributes
+	}{
+		{
+			name:          "Attributes within the limits",
+			attributes:    common.LogAttributes{"a": "1", "b": 2},
+			maxAttributes: 2,
+			expected:      common.LogAttributes{"a": "1", "b": 2},
+		},
+		{
+			name:              "Long values truncated on rune boundaries",
+			attributes:        common.LogAttributes{"a": "ééé", "b": 12345678},
+			limits:            AttributeLimits{MaxValueLength: 5},
+			maxAttributes:     10,
+			expected:          common.LogAttributes{"a": "éé", "b": 12345678, common.TruncatedAttributesAttribute: "a"},
+			expectedTruncated: []string{"a"},
+		},
+		{
+			name:              "Long names truncated",
+			attributes:        common.LogAttributes{"abcdef": "1", "abcxyz": "2"},
+			limits:            AttributeLimits{MaxNameLength: 3, Excess: ExcessAttributesDrop},
+			maxAttributes:     10,
+			expected:          common.LogAttributes{"abc": "1", common.TruncatedAttributesAttribute: "abcdef,abcxyz"},
+			expectedTruncated: []string{"abcdef", "abcxyz"},
+		},
+		{
+			name:          "Nested objects flattened",
+			attributes:    common.LogAttributes{"a": map[string]interface{}{"b": "1", "c": map[string]interface{}{"d": true}}},
+			maxAttributes: 10,
+			expected:      common.LogAttributes{"a.b": "1", "a.c.d": true},
+		},
+		{
+			name:              "Excess attributes dropped in name order",
+			attributes:        common.LogAttributes{"d": "4", "c": "3", "b": "2", "a": "1"},
+			limits:            AttributeLimits{Excess: ExcessAttributesDrop},
+			maxAttributes:     3,
+			expected:          common.LogAttributes{"a": "1", "b": "2", common.TruncatedAttributesAttribute: "c,d"},
+			expectedTruncated: []string{"c", "d"},
+		},
+		{
+			name:          "Excess attributes flattened in name order",
+			attributes:    common.LogAttributes{"d": "4", "c": []interface{}{"x"}, "b": "2", "a": "1"},
+			maxAttributes: 3,
+			expected: common.LogAttributes{
+				"a":                                 "1",
+				common.ExcessAttributesAttribute:    `{"b":"2","c":["x"],"d":"4"}`,
+				common.TruncatedAttributesAttribute: "b,c,d",
+			},
+			expectedTruncated: []string{"b", "c", "d"},
+		},
+		{
+			name:          "Flattened excess attributes kept within the value length",
+			attributes:    common.LogAttributes{"a": "1", "b": strings.Repeat("x", 20), "c": "3"},
+			limits:        AttributeLimits{MaxValueLength: 15},
+			maxAttributes: 2,
+			expected: common.LogAttributes{
+				common.ExcessAttributesAttribute:    `{"a":"1"}`,
+				common.TruncatedAttributesAttribute: "a,b,c",
+			},
+			expectedTruncated: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			normalized, truncated := NormalizeAttributes(tc.attributes, tc.limits, tc.maxAttributes)
+			assert.Equal(t, tc.expected, normalized)
+			assert.Equal(t, tc.expectedTruncated, truncated)
+		})
+	}
+}
+
+// TestDefaultAttributeLimits tests the attribute limits configured in the environment.
+func TestDefaultAttributeLimits(t *testing.T) {
+	t.Setenv(common.AttributeMaxCount, "1000")
+	t.Setenv(common.AttributeMaxValueLength, "100")
+	t.Setenv(common.ExcessAttributesPolicy, "drop")
+	limits := DefaultAttributeLimits()
+	assert.Equal(t, AttributeLimits{MaxAttributes: 1000, MaxNameLength: 255, MaxValueLength: 100, Excess: ExcessAttributesDrop}, limits)
+	assert.Equal(t, common.MaxAttributes, limits.withDefaults().MaxAttributes)
+
+	t.Setenv(common.ExcessAttributesPolicy, "invalid")
+	assert.Equal(t, ExcessAttributesFlatten, DefaultAttributeLimits().Excess)
+}
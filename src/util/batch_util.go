@@ -0,0 +1,247 @@
+package util
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// FlushReason tells why a Batcher sent a batch.
+type FlushReason string
+
+// Reasons for sending a batch.
+const (
+	FlushSize     FlushReason = "size"     // FlushSize is used when the next entry would take the batch over the maximum size.
+	FlushMessages FlushReason = "messages" // FlushMessages is used when the batch holds the maximum number of entries.
+	FlushAge      FlushReason = "age"      // FlushAge is used when the first entry of the batch reached the maximum age.
+	FlushExplicit FlushReason = "flush"    // FlushExplicit is used when Flush is called.
+	FlushClose    FlushReason = "close"    // FlushClose is used when Close is called.
+)
+
+// BatchLimits are the limits at which a Batcher sends its batch.
+type BatchLimits struct {
+	MaxSize     int             // MaxSize is the maximum size of the JSON encoding of a batch, capped at common.MaxPayloadSize.
+	MaxMessages int             // MaxMessages is the maximum number of entries of a batch, capped at common.MaxPayloadMessages.
+	MaxAge      time.Duration   // MaxAge is the maximum time an entry waits in a batch, zero for no limit.
+	Attributes  AttributeLimits // Attributes are the limits enforced on the common attributes and the attributes of every entry.
+}
+
+// DefaultBatchLimits returns the limits of the Log API, with the number of entries and the maximum age
+// configured in NR_BATCH_MAX_MESSAGES and NR_BATCH_MAX_AGE_MS, and the attribute limits of DefaultAttributeLimits.
+func DefaultBatchLimits() BatchLimits {
+	return BatchLimits{
+		MaxSize:     common.MaxPayloadSize,
+		MaxMessages: positiveIntFromEnv(common.BatchMaxMessages, common.MaxPayloadMessages),
+		MaxAge:      time.Duration(positiveIntFromEnv(common.BatchMaxAge, 0)) * time.Millisecond,
+		Attributes:  DefaultAttributeLimits(),
+	}
+}
+
+// BatchStats describes a batch sent by a Batcher.
+type BatchStats struct {
+	Entries int           // Entries is the number of entries of the batch.
+	Size    int           // Size is the size of the JSON encoding of the batch.
+	Age     time.Duration // Age is the time since the first entry was added to the batch.
+	Reason  FlushReason   // Reason tells why the batch was sent.
+}
+
+// BatchHooks are called by a Batcher to report metrics. Every hook is optional.
+// Hooks are called while the Batcher is locked and must not call the Batcher.
+type BatchHooks struct {
+	OnAdd       func(entrySize int)    // OnAdd is called for every entry added, with the size of its JSON encoding.
+	OnFlush     func(stats BatchStats) // OnFlush is called for every batch sent.
+	OnOversized func(entrySize int)    // OnOversized is called for every entry too large to fit in a batch, which is sent alone.
+	OnTruncated func(names []string)   // OnTruncated is called for every entry with attributes truncated, moved or dropped to fit the attribute limits.
+}
+
+// Batcher groups log entries sharing common attributes into batches, and sends every batch to a channel
+// once it reaches the size, message count or age limit.
+// The size of a batch is the size of its JSON encoding, including the attributes of every entry, escaping
+// and the common attributes, so that the payload sent to New Relic never exceeds the size limit.
+// A Batcher is safe for concurrent use; batches reaching the maximum age are sent even when no entry is added.
+type Batcher struct {
+	mu                 sync.Mutex
+	channel            chan common.DetailedLogsBatch
+	attributes         common.LogAttributes
+	limits             BatchLimits
+	hooks              BatchHooks
+	maxEntryAttributes int            // maxEntryAttributes is the number of attributes left to every entry by the common attributes.
+	baseSize           int            // baseSize is the encoded size of a batch without entries.
+	entries            common.LogData // entries is the batch being built.
+	size               int            // size is the encoded size of the batch being built.
+	started            time.Time      // started is the time the first entry of the batch was added.
+	timer              *time.Timer    // timer sends the batch once it reaches the maximum age.
+	closed             bool
+}
+
+// NewBatcher creates a Batcher sending batches with the given common attributes to the channel.
+// Limits that are not set, or exceed those of the Log API, are replaced with those of the Log API.
+// The common attributes are normalized with NormalizeAttributes, and must not change once the Batcher is created.
+func NewBatcher(channel chan common.DetailedLogsBatch, attributes common.LogAttributes, limits BatchLimits, hooks BatchHooks) *Batcher {
+	if limits.MaxSize <= 0 || limits.MaxSize > common.MaxPayloadSize {
+		limits.MaxSize = common.MaxPayloadSize
+	}
+	if limits.MaxMessages <= 0 || limits.MaxMessages > common.MaxPayloadMessages {
+		limits.MaxMessages = common.MaxPayloadMessages
+	}
+	limits.Attributes = limits.Attributes.withDefaults()
+
+	attributes, truncated := NormalizeAttributes(attributes, limits.Attributes, limits.Attributes.MaxAttributes)
+	if len(truncated) > 0 {
+		log.Warnf("common attributes over the attribute limits: %s", strings.Join(truncated, ","))
+	}
+
+	b := &Batcher{
+		channel:            channel,
+		attributes:         attributes,
+		limits:             limits,
+		hooks:              hooks,
+		maxEntryAttributes: max(limits.Attributes.MaxAttributes-len(attributes), 1),
+	}
+	b.baseSize = EncodedSize(common.DetailedLogsBatch{{
+		CommonData: common.Common{Attributes: attributes},
+		Entries:    common.LogData{},
+	}})
+	b.size = b.baseSize
+	return b
+}
+
+// Add adds an entry to the current batch, sending the batch first if the entry would take it over
+// a limit. An entry too large to fit in a batch on its own is sent alone.
+// The attributes of the entry are normalized with NormalizeAttributes, within the room left by the common attributes.
+// The entry and its attributes must not be modified once added. Entries added after Close are dropped.
+func (b *Batcher) Add(entry common.Log) {
+	var truncated []string
+	entry.Attributes, truncated = NormalizeAttributes(entry.Attributes, b.limits.Attributes, b.maxEntryAttributes)
+	entrySize := EncodedSize(entry)
+	if entrySize < 0 {
+		// The entry cannot be encoded, the client will reject it when the batch is sent.
+		entrySize = len(entry.Log)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		log.Errorf("dropping log entry added to a closed batcher")
+		return
+	}
+	if len(truncated) > 0 && b.hooks.OnTruncated != nil {
+		b.hooks.OnTruncated(truncated)
+	}
+
+	if len(b.entries) > 0 {
+		switch {
+		case b.limits.MaxAge > 0 && time.Since(b.started) >= b.limits.MaxAge:
+			b.flush(FlushAge)
+		case len(b.entries) >= b.limits.MaxMessages:
+			b.flush(FlushMessages)
+		case b.size+entrySize+1 > b.limits.MaxSize:
+			b.flush(FlushSize)
+		}
+	}
+	if len(b.entries) > 0 {
+		// Entries after the first are preceded by a comma.
+		entrySize++
+	} else if b.baseSize+entrySize > b.limits.MaxSize {
+		log.Warnf("log entry of %d bytes exceeds the maximum payload size of %d bytes", entrySize, b.limits.MaxSize)
+		if b.hooks.OnOversized != nil {
+			b.hooks.OnOversized(entrySize)
+		}
+	}
+
+	if len(b.entries) == 0 {
+		b.started = time.Now()
+		if b.limits.MaxAge > 0 {
+			b.startTimer()
+		}
+	}
+	b.entries = append(b.entries, entry)
+	b.size += entrySize
+	if b.hooks.OnAdd != nil {
+		b.hooks.OnAdd(entrySize)
+	}
+}
+
+// Flush sends the current batch to the channel, if it holds any entry, and starts a new one.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flush(FlushExplicit)
+}
+
+// Close sends the current batch and stops the Batcher, and its age timer.
+// Close must be called before the channel is closed, on every path, including errors. Calling it again does nothing.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.flush(FlushClose)
+	b.closed = true
+}
+
+// Size returns the encoded size of the current batch, as it would be sent to New Relic.
+func (b *Batcher) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Len returns the number of entries in the current batch.
+func (b *Batcher) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// flush sends the current batch. The Batcher must be locked.
+func (b *Batcher) flush(reason FlushReason) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.entries) == 0 {
+		return
+	}
+	stats := BatchStats{
+		Entries: len(b.entries),
+		Size:    b.size,
+		Age:     time.Since(b.started),
+		Reason:  reason,
+	}
+	ProduceMessageToChannel(b.channel, b.entries, b.attributes)
+	b.entries = nil
+	b.size = b.baseSize
+	if b.hooks.OnFlush != nil {
+		b.hooks.OnFlush(stats)
+	}
+}
+
+// startTimer sends the current batch once it reaches the maximum age. The Batcher must be locked.
+func (b *Batcher) startTimer() {
+	var timer *time.Timer
+	timer = time.AfterFunc(b.limits.MaxAge, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// The batch may have been sent, and another one started, while the timer fired.
+		// Once the Batcher is closed the channel may be closed too, so nothing is sent.
+		if b.closed || b.timer != timer {
+			return
+		}
+		b.flush(FlushAge)
+	})
+	b.timer = timer
+}
+
+// EncodedSize returns the size of the JSON encoding of a value, or -1 if it cannot be encoded.
+func EncodedSize(value interface{}) int {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return -1
+	}
+	return len(encoded)
+}
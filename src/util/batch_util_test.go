@@ -0,0 +1,229 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBatcher tests that batches are split on the encoded size of their entries and on the number of entries.
+func TestBatcher(t *testing.T) {
+	tests := []struct {
+		name            string               // Test case name
+		entries         func() []common.Log  // Entries to add
+		attributes      common.LogAttributes // Common attributes of the batches
+		expectedBatches int                  // Expected number of batches
+	}{
+		{
+			name: "Entries fitting in a single batch",
+			entries: func() []common.Log {
+				return []common.Log{{Log: "first"}, {Log: "second"}}
+			},
+			attributes:      common.LogAttributes{"logGroup": "test"},
+			expectedBatches: 1,
+		},
+		{
+			name: "Entries over the maximum number of messages",
+			entries: func() []common.Log {
+				entries := make([]common.Log, common.MaxPayloadMessages+1)
+				for i := range entries {
+					entries[i] = common.Log{Log: "message"}
+				}
+				return entries
+			},
+			expectedBatches: 2,
+		},
+		{
+			name: "Escaped messages over the maximum payload size",
+			entries: func() []common.Log {
+				// Every character is encoded as \u003c, so the messages are six times larger once encoded.
+				message := strings.Repeat("<", common.MaxPayloadSize/20)
+				entries := make([]common.Log, 8)
+				for i := range entries {
+					entries[i] = common.Log{Log: message}
+				}
+				return entries
+			},
+			expectedBatches: 3,
+		},
+		{
+			name: "Attributes over the maximum payload size",
+			entries: func() []common.Log {
+				entries := make([]common.Log, 3)
+				for i := range entries {
+					entries[i] = common.Log{
+						Log:        "message",
+						Attributes: largeAttributes(130),
+					}
+				}
+				return entries
+			},
+			expectedBatches: 3,
+		},
+		{
+			name: "Common attributes counted in every batch",
+			entries: func() []common.Log {
+				message := strings.Repeat("a", common.MaxPayloadSize/4)
+				return []common.Log{{Log: message}, {Log: message}, {Log: message}}
+			},
+			attributes:      largeAttributes(100),
+			expectedBatches: 2,
+		},
+		{
+			name: "Entry larger than the maximum payload size sent alone",
+			entries: func() []common.Log {
+				return []common.Log{
+					{Log: "before"},
+					{Log: strings.Repeat("\"", common.MaxMessageSize)},
+					{Log: "after"},
+				}
+			},
+			expectedBatches: 3,
+		},
+		{
+			name: "No entries",
+			entries: func() []common.Log {
+				return nil
+			},
+			expectedBatches: 0,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := tc.entries()
+			channel := make(chan common.DetailedLogsBatch, len(entries)+1)
+			builder := NewBatcher(channel, tc.attributes, BatchLimits{}, BatchHooks{})
+
+			for _, entry := range entries {
+				builder.Add(entry)
+				// The tracked size is the exact size of the payload of the current batch.
+				payload, err := json.Marshal(common.DetailedLogsBatch{{
+					CommonData: common.Common{Attributes: tc.attributes},
+					Entries:    builder.entries,
+				}})
+				assert.NoError(t, err)
+				assert.Equal(t, len(payload), builder.Size())
+			}
+			builder.Close()
+			close(channel)
+
+			batches := 0
+			sent := 0
+			for batch := range channel {
+				batches++
+				sent += len(batch[0].Entries)
+				assert.Equal(t, tc.attributes, batch[0].CommonData.Attributes)
+				assert.LessOrEqual(t, len(batch[0].Entries), common.MaxPayloadMessages)
+				if len(batch[0].Entries) > 1 {
+					payload, err := json.Marshal(batch)
+					assert.NoError(t, err)
+					assert.LessOrEqual(t, len(payload), common.MaxPayloadSize)
+				}
+			}
+			assert.Equal(t, tc.expectedBatches, batches)
+			assert.Equal(t, len(entries), sent)
+			assert.Equal(t, 0, builder.Len())
+		})
+	}
+}
+
+// largeAttributes returns attributes with values of the maximum length, about 4KB each.
+func largeAttributes(count int) common.LogAttributes {
+	attributes := common.LogAttributes{}
+	for i := 0; i < count; i++ {
+		attributes[fmt.Sprintf("attribute%d", i)] = strings.Repeat("a", common.MaxAttributeValueLength)
+	}
+	return attributes
+}
+
+// TestBatcherLimits tests the configurable limits of a Batcher and the reasons reported to its hooks.
+func TestBatcherLimits(t *testing.T) {
+	channel := make(chan common.DetailedLogsBatch, 10)
+	var reasons []FlushReason
+	added := 0
+	batcher := NewBatcher(channel, nil, BatchLimits{MaxMessages: 2, MaxSize: 200}, BatchHooks{
+		OnAdd:   func(int) { added++ },
+		OnFlush: func(stats BatchStats) { reasons = append(reasons, stats.Reason) },
+	})
+
+	batcher.Add(common.Log{Log: "first"})
+	batcher.Add(common.Log{Log: "second"})
+	batcher.Add(common.Log{Log: "third"})
+	batcher.Add(common.Log{Log: strings.Repeat("a", 150)})
+	batcher.Flush()
+	batcher.Add(common.Log{Log: "fourth"})
+	batcher.Close()
+	batcher.Add(common.Log{Log: "dropped"})
+	close(channel)
+
+	assert.Equal(t, []FlushReason{FlushMessages, FlushSize, FlushExplicit, FlushClose}, reasons)
+	assert.Equal(t, 5, added)
+	assert.Len(t, channel, 4)
+}
+
+// TestBatcherMaxAge tests that a batch is sent once its first entry reaches the maximum age, without further entries.
+func TestBatcherMaxAge(t *testing.T) {
+	channel := make(chan common.DetailedLogsBatch, 10)
+	flushed := make(chan BatchStats, 10)
+	batcher := NewBatcher(channel, nil, BatchLimits{MaxAge: 20 * time.Millisecond}, BatchHooks{
+		OnFlush: func(stats BatchStats) { flushed <- stats },
+	})
+
+	batcher.Add(common.Log{Log: "first"})
+	batcher.Add(common.Log{Log: "second"})
+
+	select {
+	case batch := <-channel:
+		assert.Len(t, batch[0].Entries, 2)
+	case <-time.After(time.Second):
+		t.Fatal("batch not sent after the maximum age")
+	}
+	stats := <-flushed
+	assert.Equal(t, FlushAge, stats.Reason)
+	assert.GreaterOrEqual(t, stats.Age, 20*time.Millisecond)
+
+	batcher.Close()
+	assert.Empty(t, channel)
+}
+
+// TestDefaultBatchLimits tests the limits configured in the environment.
+func TestDefaultBatchLimits(t *testing.T) {
+	attributeLimits := AttributeLimits{}.withDefaults()
+	assert.Equal(t, BatchLimits{MaxSize: common.MaxPayloadSize, MaxMessages: common.MaxPayloadMessages, Attributes: attributeLimits}, DefaultBatchLimits())
+
+	t.Setenv(common.BatchMaxMessages, "100")
+	t.Setenv(common.BatchMaxAge, "1500")
+	assert.Equal(t, BatchLimits{MaxSize: common.MaxPayloadSize, MaxMessages: 100, MaxAge: 1500 * time.Millisecond, Attributes: attributeLimits}, DefaultBatchLimits())
+}
+
+// TestBatcherAttributeLimits tests that the common attributes and the attributes of entries share the attribute limits.
+func TestBatcherAttributeLimits(t *testing.T) {
+	channel := make(chan common.DetailedLogsBatch, 1)
+	var truncated []string
+	limits := BatchLimits{Attributes: AttributeLimits{MaxAttributes: 4, MaxValueLength: 5, Excess: ExcessAttributesDrop}}
+	batcher := NewBatcher(channel, common.LogAttributes{"logGroup": "group"}, limits, BatchHooks{
+		OnTruncated: func(names []string) { truncated = append(truncated, names...) },
+	})
+
+	batcher.Add(common.Log{Log: "message", Attributes: common.LogAttributes{"a": "1", "b": "123456", "c": "3", "d": "4"}})
+	batcher.Close()
+
+	batch := <-channel
+	assert.Equal(t, common.LogAttributes{"logGroup": "group"}, batch[0].CommonData.Attributes)
+	assert.Equal(t, common.LogAttributes{"a": "1", "b": "12345", common.TruncatedAttributesAttribute: "b,c,d"}, batch[0].Entries[0].Attributes)
+	assert.Equal(t, []string{"b", "c", "d"}, truncated)
+	assert.Equal(t, EncodedSize(batch), batcher.baseSize+EncodedSize(batch[0].Entries[0]))
+}
+
+// TestEncodedSize tests the size of the JSON encoding of values.
+func TestEncodedSize(t *testing.T) {
+	assert.Equal(t, len(`{"timestamp":"","attributes":{"a":"b"},"log":"\"x\"\n"}`),
+		EncodedSize(common.Log{Attributes: common.LogAttributes{"a": "b"}, Log: "\"x\"\n"}))
+	assert.Equal(t, -1, EncodedSize(common.LogAttributes{"channel": make(chan int)}))
+}
@@ -0,0 +1,56 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// ErrDeadlineApproaching is the cause of the contexts done at the safety margin before the deadline of the invocation.
+var ErrDeadlineApproaching = errors.New("invocation deadline approaching")
+
+// TimeoutError is the error of a source whose logs were not all read because the deadline of the invocation was approaching.
+// The logs read before the deadline were flushed and sent.
+type TimeoutError struct {
+	Source      string // Source is the log group, or the bucket and key of the object, whose logs were not all read.
+	Unprocessed string // Unprocessed describes the logs left unread, from where a retry can resume.
+}
+
+// Error returns the source and the unprocessed logs.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%v: %s not processed: %s", ErrDeadlineApproaching, e.Source, e.Unprocessed)
+}
+
+// Unwrap returns ErrDeadlineApproaching.
+func (e *TimeoutError) Unwrap() error {
+	return ErrDeadlineApproaching
+}
+
+// DeadlineMargin returns the safety margin kept before the deadline of the context, read from NR_DEADLINE_MARGIN_MS.
+// It is at most half the time left, so that short invocations still read their logs, and 0 when the context has no deadline.
+func DeadlineMargin(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	margin := time.Duration(positiveIntFromEnv(common.DeadlineMargin, int(common.DefaultDeadlineMargin/time.Millisecond))) * time.Millisecond
+	return max(min(margin, time.Until(deadline)/2), 0)
+}
+
+// WithDeadlineMargin returns a context done the margin before the deadline of ctx, with ErrDeadlineApproaching as its cause.
+// Without deadline or margin, the context is only done with ctx.
+func WithDeadlineMargin(ctx context.Context, margin time.Duration) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || margin <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadlineCause(ctx, deadline.Add(-margin), ErrDeadlineApproaching)
+}
+
+// IsDeadlineApproaching reports whether the context is done because the deadline of the invocation is approaching.
+func IsDeadlineApproaching(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrDeadlineApproaching)
+}
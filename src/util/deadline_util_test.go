@@ -0,0 +1,80 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestDeadlineMargin tests the safety margin kept before the deadline of an invocation.
+func TestDeadlineMargin(t *testing.T) {
+	tests := []struct {
+		name     string        // Test case name
+		envValue string        // Value of NR_DEADLINE_MARGIN_MS
+		timeLeft time.Duration // Time left before the deadline, no deadline when 0
+		expected time.Duration // Expected margin, rounded to the second
+	}{
+		{
+			name:     "No deadline",
+			expected: 0,
+		},
+		{
+			name:     "Default margin",
+			timeLeft: time.Minute,
+			expected: common.DefaultDeadlineMargin,
+		},
+		{
+			name:     "Configured margin",
+			envValue: "3000",
+			timeLeft: time.Minute,
+			expected: 3 * time.Second,
+		},
+		{
+			name:     "Margin capped at half the time left",
+			timeLeft: 4 * time.Second,
+			expected: 2 * time.Second,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(common.DeadlineMargin, tc.envValue)
+			ctx := context.Background()
+			if tc.timeLeft > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeLeft)
+				defer cancel()
+			}
+			assert.Equal(t, tc.expected, DeadlineMargin(ctx).Round(time.Second))
+		})
+	}
+}
+
+// TestWithDeadlineMargin tests that the context is done the margin before the deadline, with ErrDeadlineApproaching as its cause.
+func TestWithDeadlineMargin(t *testing.T) {
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelParent()
+	ctx, cancel := WithDeadlineMargin(parent, time.Hour-10*time.Millisecond)
+	defer cancel()
+
+	<-ctx.Done()
+	assert.NoError(t, parent.Err())
+	assert.True(t, IsDeadlineApproaching(ctx))
+	assert.ErrorIs(t, notSentError(ctx), ErrDeadlineApproaching)
+
+	ctx, cancel = WithDeadlineMargin(context.Background(), time.Second)
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+	assert.False(t, IsDeadlineApproaching(ctx))
+}
+
+// TestTimeoutError tests the message of a TimeoutError.
+func TestTimeoutError(t *testing.T) {
+	err := &TimeoutError{Source: "log group /aws/lambda/api", Unprocessed: "3 of 10 log events"}
+	assert.EqualError(t, err, "invocation deadline approaching: log group /aws/lambda/api not processed: 3 of 10 log events")
+	assert.ErrorIs(t, NewStageError(StageParse, err), ErrDeadlineApproaching)
+}
@@ -0,0 +1,55 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Stage identifies the stage of the forwarding pipeline in which an error occurred.
+type Stage string
+
+// Stages of the forwarding pipeline.
+const (
+	StageDecode Stage = "decode" // StageDecode covers recognising the event and its payload.
+	StageFetch  Stage = "fetch"  // StageFetch covers reading from AWS: the configuration of the function, S3 objects, their metadata and tags.
+	StageParse  Stage = "parse"  // StageParse covers the configuration of the forwarder, decompressing and parsing logs into batches, and logs left unparsed at the deadline.
+	StageSend   Stage = "send"   // StageSend covers sending the batches to New Relic.
+)
+
+// StageError is an error annotated with the stage of the forwarding pipeline in which it occurred.
+type StageError struct {
+	Stage Stage // Stage is the stage in which the error occurred.
+	Err   error // Err is the underlying error.
+}
+
+// Error returns the stage and the message of the underlying error.
+func (e *StageError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// NewStageError annotates an error with the stage in which it occurred.
+// It returns nil for a nil error, and the error itself when it is already annotated with a stage.
+func NewStageError(stage Stage, err error) error {
+	if err == nil {
+		return nil
+	}
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return err
+	}
+	return &StageError{Stage: stage, Err: err}
+}
+
+// ErrorStage returns the stage of the first error annotated with a stage in the tree of the error.
+func ErrorStage(err error) (Stage, bool) {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.Stage, true
+	}
+	return "", false
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewStageError tests annotating errors with the stage in which they occurred.
+func TestNewStageError(t *testing.T) {
+	assert.NoError(t, NewStageError(StageFetch, nil))
+
+	cause := errors.New("access denied")
+	err := NewStageError(StageFetch, cause)
+	assert.EqualError(t, err, "fetch failed: access denied")
+	assert.ErrorIs(t, err, cause)
+
+	// An error already annotated keeps the stage in which it occurred.
+	wrapped := NewStageError(StageSend, fmt.Errorf("object failed: %w", err))
+	stage, ok := ErrorStage(wrapped)
+	assert.True(t, ok)
+	assert.Equal(t, StageFetch, stage)
+
+	_, ok = ErrorStage(cause)
+	assert.False(t, ok)
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// newHTTPTransport creates the transport of the clients sending logs. Requests go through the proxy of the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables, connections are established within
+// NR_HTTP_CONNECT_TIMEOUT_SECONDS, and the certificate authorities of NR_CA_BUNDLE are trusted along with the system ones.
+func newHTTPTransport() (*http.Transport, error) {
+	connectTimeout := time.Duration(positiveIntFromEnv(common.HTTPConnectTimeoutSeconds, int(common.HTTPConnectTimeout/time.Second))) * time.Second
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = connectTimeout
+
+	if path := os.Getenv(common.CABundle); path != "" {
+		rootCAs, err := loadCABundle(path)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	}
+	return transport, nil
+}
+
+// loadCABundle returns the system certificate pool with the certificates of a PEM bundle added.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+	rootCAs, err := x509.SystemCertPool()
+	if err != nil {
+		rootCAs = x509.NewCertPool()
+	}
+	if !rootCAs.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no PEM certificate found in CA bundle %s", path)
+	}
+	return rootCAs, nil
+}
+
+// httpTimeout returns the timeout of a request sending logs, NR_HTTP_TIMEOUT_SECONDS or 30 seconds.
+func httpTimeout() time.Duration {
+	return time.Duration(positiveIntFromEnv(common.HTTPTimeoutSeconds, int(common.HTTPTimeout/time.Second))) * time.Second
+}
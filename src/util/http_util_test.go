@@ -0,0 +1,91 @@
+package util
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestNewHTTPTransportCABundle tests that the certificate authorities of NR_CA_BUNDLE are trusted, and the errors of invalid bundles.
+func TestNewHTTPTransportCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// The certificate of the test server is not trusted by default.
+	transport, err := newHTTPTransport()
+	assert.NoError(t, err)
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	assert.ErrorContains(t, err, "certificate")
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+	t.Setenv(common.CABundle, bundle)
+	transport, err = newHTTPTransport()
+	assert.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	assert.NoError(t, os.WriteFile(invalid, []byte("not a certificate"), 0o600))
+	t.Setenv(common.CABundle, invalid)
+	_, err = newHTTPTransport()
+	assert.EqualError(t, err, "no PEM certificate found in CA bundle "+invalid)
+
+	t.Setenv(common.CABundle, filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = newHTTPTransport()
+	assert.ErrorContains(t, err, "failed to read CA bundle")
+}
+
+// TestNewHTTPTransportProxy tests that requests go through the proxy of the environment.
+func TestNewHTTPTransportProxy(t *testing.T) {
+	transport, err := newHTTPTransport()
+	assert.NoError(t, err)
+	assert.NotNil(t, transport.Proxy)
+	assert.Equal(t, common.HTTPConnectTimeout, transport.TLSHandshakeTimeout)
+
+	t.Setenv(common.HTTPConnectTimeoutSeconds, "3")
+	transport, err = newHTTPTransport()
+	assert.NoError(t, err)
+	assert.Equal(t, 3*time.Second, transport.TLSHandshakeTimeout)
+}
+
+// TestHTTPTimeout tests the timeout of the requests sending logs.
+func TestHTTPTimeout(t *testing.T) {
+	tests := []struct {
+		name     string        // Test case name
+		envValue string        // Value of NR_HTTP_TIMEOUT_SECONDS
+		expected time.Duration // Expected timeout
+	}{
+		{
+			name:     "Default",
+			expected: common.HTTPTimeout,
+		},
+		{
+			name:     "Configured",
+			envValue: "5",
+			expected: 5 * time.Second,
+		},
+		{
+			name:     "Invalid",
+			envValue: "-1",
+			expected: common.HTTPTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(common.HTTPTimeoutSeconds, tc.envValue)
+			assert.Equal(t, tc.expected, httpTimeout())
+		})
+	}
+}
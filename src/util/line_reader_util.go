@@ -0,0 +1,190 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// LongLinePolicy defines how a LineReader handles lines longer than its maximum line length.
+type LongLinePolicy string
+
+// Supported long line policies.
+const (
+	LongLineTruncate LongLinePolicy = "truncate" // LongLineTruncate keeps the start of the line followed by common.TruncatedMarker.
+	LongLineSplit    LongLinePolicy = "split"    // LongLineSplit returns the line as consecutive fragments of the maximum line length.
+	LongLineSkip     LongLinePolicy = "skip"     // LongLineSkip drops the line.
+)
+
+// ParseLongLinePolicy parses the long line policy, defaulting to LongLineSplit when the value is empty.
+func ParseLongLinePolicy(value string) (LongLinePolicy, error) {
+	switch policy := LongLinePolicy(value); policy {
+	case "":
+		return LongLineSplit, nil
+	case LongLineTruncate, LongLineSplit, LongLineSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid long line policy %q, supported policies are truncate, split and skip", value)
+	}
+}
+
+// LineReader reads lines like bufio.Scanner, but keeps reading after a line longer than the maximum line length
+// instead of stopping with bufio.ErrTooLong. Such lines are handled according to the LongLinePolicy.
+type LineReader struct {
+	reader    *bufio.Reader
+	maxLength int
+	policy    LongLinePolicy
+
+	buffer     []byte
+	line       string
+	endOfLine  bool
+	discarding bool
+	splitting  bool
+	fragment   int // index of the fragment returned by Text in its split line, -1 when the line was not split
+	readErr    error
+
+	position       LinePosition // position of the line returned by Text
+	bufferPosition LinePosition // position of the first buffered byte
+	consumed       int64        // number of bytes consumed from the reader
+	lineNumber     int64        // number of the line being read
+
+	TruncatedLines int // TruncatedLines is the number of lines truncated so far.
+	SplitLines     int // SplitLines is the number of lines split into fragments so far.
+	SkippedLines   int // SkippedLines is the number of lines skipped so far.
+}
+
+// NewLineReader creates a LineReader reading lines of at most maxLength bytes from the reader.
+func NewLineReader(reader io.Reader, maxLength int, policy LongLinePolicy) *LineReader {
+	return &LineReader{
+		reader:    bufio.NewReader(reader),
+		maxLength: maxLength,
+		policy:    policy,
+		fragment:  -1,
+	}
+}
+
+// Scan advances to the next line, which is then available through Text.
+// It returns false when the input is exhausted or a read error occurs.
+func (l *LineReader) Scan() bool {
+	for {
+		if len(l.buffer) > l.maxLength {
+			cut := runeBoundary(l.buffer, l.maxLength)
+			switch l.policy {
+			case LongLineSplit:
+				if !l.splitting {
+					l.splitting = true
+					l.SplitLines++
+					l.fragment = 0
+				} else {
+					l.fragment++
+				}
+				l.line = string(l.buffer[:cut])
+				l.position = l.bufferPosition
+				l.bufferPosition.Offset += int64(cut)
+				l.buffer = append(l.buffer[:0], l.buffer[cut:]...)
+				return true
+			case LongLineTruncate:
+				l.TruncatedLines++
+				l.line = string(l.buffer[:cut]) + common.TruncatedMarker
+				l.position = l.bufferPosition
+				l.fragment = -1
+				l.resetLongLine()
+				return true
+			default:
+				l.SkippedLines++
+				l.resetLongLine()
+				continue
+			}
+		}
+
+		if l.endOfLine || (l.readErr != nil && len(l.buffer) > 0) {
+			l.line = string(l.buffer)
+			l.position = l.bufferPosition
+			l.buffer = l.buffer[:0]
+			l.endOfLine = false
+			if l.splitting {
+				l.fragment++
+			} else {
+				l.fragment = -1
+			}
+			l.splitting = false
+			return true
+		}
+		if l.readErr != nil {
+			return false
+		}
+
+		chunkOffset := l.consumed
+		chunk, err := l.reader.ReadSlice('\n')
+		l.consumed += int64(len(chunk))
+		complete := false
+		switch err {
+		case nil:
+			complete = true
+			chunk = bytes.TrimSuffix(chunk[:len(chunk)-1], []byte{'\r'})
+		case bufio.ErrBufferFull:
+		default:
+			l.readErr = err
+			chunk = bytes.TrimSuffix(chunk, []byte{'\r'})
+		}
+
+		if l.discarding {
+			l.discarding = !complete
+			continue
+		}
+		if len(l.buffer) == 0 && !l.splitting {
+			l.lineNumber++
+			l.bufferPosition = LinePosition{LineNumber: l.lineNumber, Offset: chunkOffset}
+		}
+		l.buffer = append(l.buffer, chunk...)
+		l.endOfLine = complete
+	}
+}
+
+// Text returns the line read by the last call to Scan.
+func (l *LineReader) Text() string {
+	return l.line
+}
+
+// Position returns the line number and byte offset of the line read by the last call to Scan.
+// Fragments of a split line share the line number and have the byte offset of their first byte.
+func (l *LineReader) Position() LinePosition {
+	return l.position
+}
+
+// Fragment returns the index of the line read by the last call to Scan among the fragments of its split line,
+// and false when the line was not split.
+func (l *LineReader) Fragment() (int, bool) {
+	return l.fragment, l.fragment >= 0
+}
+
+// Err returns the first non-EOF error encountered while reading.
+func (l *LineReader) Err() error {
+	if l.readErr == io.EOF {
+		return nil
+	}
+	return l.readErr
+}
+
+// resetLongLine drops the buffered content of a long line and discards the rest of it.
+func (l *LineReader) resetLongLine() {
+	l.buffer = l.buffer[:0]
+	l.discarding = !l.endOfLine && l.readErr == nil
+	l.endOfLine = false
+}
+
+// runeBoundary returns the largest index not greater than limit that is the start of a UTF-8 rune in data.
+func runeBoundary(data []byte, limit int) int {
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		return limit
+	}
+	return cut
+}
@@ -0,0 +1,136 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLineReader tests reading lines with the different long line policies.
+func TestLineReader(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 25) + "\nnext\n" + strings.Repeat("y", 12)
+
+	tests := []struct {
+		name      string         // Test case name
+		policy    LongLinePolicy // Long line policy
+		expected  []string       // Expected lines
+		truncated int            // Expected number of truncated lines
+		split     int            // Expected number of split lines
+		skipped   int            // Expected number of skipped lines
+	}{
+		{
+			name:      "Truncate",
+			policy:    LongLineTruncate,
+			expected:  []string{"short", strings.Repeat("x", 10) + common.TruncatedMarker, "next", strings.Repeat("y", 10) + common.TruncatedMarker},
+			truncated: 2,
+		},
+		{
+			name:     "Split",
+			policy:   LongLineSplit,
+			expected: []string{"short", strings.Repeat("x", 10), strings.Repeat("x", 10), strings.Repeat("x", 5), "next", strings.Repeat("y", 10), "yy"},
+			split:    2,
+		},
+		{
+			name:     "Skip",
+			policy:   LongLineSkip,
+			expected: []string{"short", "next"},
+			skipped:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The small buffer of the underlying reader is exceeded by the long lines.
+			lineReader := NewLineReader(strings.NewReader(input), 10, tt.policy)
+			var lines []string
+			for lineReader.Scan() {
+				lines = append(lines, lineReader.Text())
+			}
+			assert.NoError(t, lineReader.Err())
+			assert.Equal(t, tt.expected, lines)
+			assert.Equal(t, tt.truncated, lineReader.TruncatedLines)
+			assert.Equal(t, tt.split, lineReader.SplitLines)
+			assert.Equal(t, tt.skipped, lineReader.SkippedLines)
+		})
+	}
+}
+
+// TestLineReaderLongerThanReadBuffer verifies that lines longer than the internal read buffer are read completely.
+func TestLineReaderLongerThanReadBuffer(t *testing.T) {
+	long := strings.Repeat("é", 10000)
+	lineReader := NewLineReader(strings.NewReader("a\n"+long+"\nb"), 3*len(long), LongLineSkip)
+
+	var lines []string
+	for lineReader.Scan() {
+		lines = append(lines, lineReader.Text())
+	}
+	assert.Equal(t, []string{"a", long, "b"}, lines)
+}
+
+// TestLineReaderPosition tests the line numbers and byte offsets reported for lines and fragments of split lines.
+func TestLineReaderPosition(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 25) + "\nnext\n" + strings.Repeat("y", 12)
+
+	tests := []struct {
+		name     string         // Test case name
+		policy   LongLinePolicy // Long line policy
+		expected []LinePosition // Expected positions
+	}{
+		{
+			name:   "Split",
+			policy: LongLineSplit,
+			expected: []LinePosition{
+				{LineNumber: 1, Offset: 0},
+				{LineNumber: 2, Offset: 7}, {LineNumber: 2, Offset: 17}, {LineNumber: 2, Offset: 27},
+				{LineNumber: 3, Offset: 33},
+				{LineNumber: 4, Offset: 38}, {LineNumber: 4, Offset: 48},
+			},
+		},
+		{
+			name:     "Skip",
+			policy:   LongLineSkip,
+			expected: []LinePosition{{LineNumber: 1, Offset: 0}, {LineNumber: 3, Offset: 33}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lineReader := NewLineReader(strings.NewReader(input), 10, tt.policy)
+			var positions []LinePosition
+			for lineReader.Scan() {
+				positions = append(positions, lineReader.Position())
+			}
+			assert.Equal(t, tt.expected, positions)
+		})
+	}
+}
+
+// TestLineReaderFragment tests the fragment indexes reported for the fragments of split lines.
+func TestLineReaderFragment(t *testing.T) {
+	input := "short\r\n" + strings.Repeat("x", 25) + "\nnext\n" + strings.Repeat("y", 12)
+
+	lineReader := NewLineReader(strings.NewReader(input), 10, LongLineSplit)
+	var fragments []int
+	for lineReader.Scan() {
+		index, ok := lineReader.Fragment()
+		assert.Equal(t, index >= 0, ok)
+		fragments = append(fragments, index)
+	}
+	assert.Equal(t, []int{-1, 0, 1, 2, -1, 0, 1}, fragments)
+}
+
+// TestParseLongLinePolicy tests parsing of the long line policy.
+func TestParseLongLinePolicy(t *testing.T) {
+	policy, err := ParseLongLinePolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, LongLineSplit, policy)
+
+	policy, err = ParseLongLinePolicy("skip")
+	assert.NoError(t, err)
+	assert.Equal(t, LongLineSkip, policy)
+
+	_, err = ParseLongLinePolicy("drop")
+	assert.Error(t, err)
+}
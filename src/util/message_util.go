@@ -2,26 +2,150 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/newrelic/aws-unified-lambda-logging/common"
 )
 
 // SplitLargeMessages splits a large message into smaller messages if its length exceeds the maximum message size.
+// Messages are split on UTF-8 rune boundaries so that every fragment is a valid string.
 func SplitLargeMessages(message string) []string {
 	var result []string
 	if len(message) > common.MaxMessageSize {
+		middle := len(message) / 2
+		// Move the split point back to the start of the rune it falls into.
+		for middle > 0 && !utf8.RuneStart(message[middle]) {
+			middle--
+		}
+		// Invalid UTF-8 may hold no rune start before the midpoint, it is then split at the midpoint.
+		if middle == 0 {
+			middle = len(message) / 2
+		}
 		// recursive call to split the messages.
-		result = append(result, SplitLargeMessages(message[:len(message)/2])...)
-		result = append(result, SplitLargeMessages(message[len(message)/2:])...)
+		result = append(result, SplitLargeMessages(message[:middle])...)
+		result = append(result, SplitLargeMessages(message[middle:])...)
 	} else {
 		result = append(result, message)
 	}
 	return result
 }
 
+// LogFragment is a fragment of a log message produced by SplitLogMessage.
+type LogFragment struct {
+	Message    string               // Message is the content of the fragment.
+	Attributes common.LogAttributes // Attributes link the fragments of a split message, nil if the message was not split.
+}
+
+// SplitLogMessage splits a message larger than the maximum message size into fragments.
+// When jsonAware is true, a JSON object or array is split between its members so that every fragment is a valid JSON document;
+// messages that are not JSON or have a single member larger than the maximum message size are split on rune boundaries.
+// Every fragment of a split message carries the split.id, split.index and split.total attributes used to reassemble it.
+func SplitLogMessage(message string, jsonAware bool) []LogFragment {
+	if len(message) <= common.MaxMessageSize {
+		return []LogFragment{{Message: message}}
+	}
+
+	var messages []string
+	if jsonAware {
+		messages = splitJSONMessage(message)
+	}
+	if messages == nil {
+		messages = SplitLargeMessages(message)
+	}
+
+	// The split id is derived from the content so that a retried message gets the same id.
+	hash := sha256.Sum256([]byte(message))
+	splitID := hex.EncodeToString(hash[:8])
+
+	fragments := make([]LogFragment, len(messages))
+	for i, fragment := range messages {
+		fragments[i] = LogFragment{
+			Message: fragment,
+			Attributes: common.LogAttributes{
+				"split.id":    splitID,
+				"split.index": i,
+				"split.total": len(messages),
+			},
+		}
+	}
+	return fragments
+}
+
+// splitJSONMessage splits a JSON object or array into JSON documents of the same type holding a subset of its members.
+// It returns nil if the message is not a JSON object or array, or if a single member exceeds the maximum message size.
+func splitJSONMessage(message string) []string {
+	decoder := json.NewDecoder(strings.NewReader(message))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil
+	}
+	delimiter, ok := token.(json.Delim)
+	if !ok || (delimiter != '{' && delimiter != '[') {
+		return nil
+	}
+	closing := "}"
+	if delimiter == '[' {
+		closing = "]"
+	}
+
+	var members []string
+	for decoder.More() {
+		var member string
+		if delimiter == '{' {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return nil
+			}
+			key, _ := json.Marshal(keyToken)
+			member = string(key) + ":"
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil
+		}
+		member += string(value)
+		if len(member)+2 > common.MaxMessageSize {
+			return nil
+		}
+		members = append(members, member)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		// Trailing content after the document.
+		return nil
+	}
+
+	var result []string
+	var current strings.Builder
+	for _, member := range members {
+		if current.Len() > 0 && current.Len()+1+len(member)+1 > common.MaxMessageSize {
+			current.WriteString(closing)
+			result = append(result, current.String())
+			current.Reset()
+		}
+		if current.Len() == 0 {
+			current.WriteString(delimiter.String())
+		} else {
+			current.WriteByte(',')
+		}
+		current.WriteString(member)
+	}
+	if current.Len() > 0 {
+		current.WriteString(closing)
+		result = append(result, current.String())
+	}
+	return result
+}
+
 // CustomAttribute represents a custom attribute with a name and value.
 type CustomAttribute struct {
 	AttributeName  string `json:"AttributeName"`  // Name of the custom attribute
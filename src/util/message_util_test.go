@@ -2,9 +2,12 @@ package util
 
 import (
 	"encoding/json"
+	"fmt"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/newrelic/aws-unified-lambda-logging/common"
 	"github.com/stretchr/testify/assert"
@@ -118,6 +121,77 @@ func TestSplitLargeMessages(t *testing.T) {
 	}
 }
 
+// TestSplitLargeMessagesUTF8 verifies that messages are never split inside a multi-byte UTF-8 rune.
+func TestSplitLargeMessagesUTF8(t *testing.T) {
+	// "é" is two bytes long, so the middle of the message falls inside a rune.
+	message := "a" + strings.Repeat("é", common.MaxMessageSize/2)
+
+	got := SplitLargeMessages(message)
+	assert.Len(t, got, 2)
+	for _, fragment := range got {
+		assert.True(t, utf8.ValidString(fragment), "fragment is not valid UTF-8")
+	}
+	assert.Equal(t, message, strings.Join(got, ""))
+}
+
+// TestSplitLargeMessagesInvalidUTF8 tests that a message without any rune start is split at the midpoint.
+func TestSplitLargeMessagesInvalidUTF8(t *testing.T) {
+	message := strings.Repeat("\x80", 2*common.MaxMessageSize+1)
+
+	got := SplitLargeMessages(message)
+	assert.Len(t, got, 3)
+	for _, fragment := range got {
+		assert.LessOrEqual(t, len(fragment), common.MaxMessageSize)
+	}
+	assert.Equal(t, message, strings.Join(got, ""))
+}
+
+// TestSplitLogMessage tests splitting messages into fragments with reassembly attributes.
+func TestSplitLogMessage(t *testing.T) {
+	t.Run("Small message is not split", func(t *testing.T) {
+		got := SplitLogMessage("small", false)
+		assert.Equal(t, []LogFragment{{Message: "small"}}, got)
+	})
+
+	t.Run("Large message carries split attributes", func(t *testing.T) {
+		message := strings.Repeat("a", common.MaxMessageSize+1)
+		got := SplitLogMessage(message, false)
+		assert.Len(t, got, 2)
+		for i, fragment := range got {
+			assert.Equal(t, got[0].Attributes["split.id"], fragment.Attributes["split.id"])
+			assert.Equal(t, i, fragment.Attributes["split.index"])
+			assert.Equal(t, 2, fragment.Attributes["split.total"])
+		}
+		assert.Equal(t, got, SplitLogMessage(message, false), "split id should be deterministic")
+	})
+
+	t.Run("JSON-aware split keeps valid JSON documents", func(t *testing.T) {
+		value := strings.Repeat("v", common.MaxMessageSize/3)
+		message := fmt.Sprintf(`{"a": %q, "b": %q, "c": %q, "d": 1}`, value, value, value)
+		got := SplitLogMessage(message, true)
+		assert.Len(t, got, 2)
+
+		merged := map[string]interface{}{}
+		for _, fragment := range got {
+			var document map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(fragment.Message), &document))
+			for key, value := range document {
+				merged[key] = value
+			}
+		}
+		var original map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(message), &original))
+		assert.Equal(t, original, merged)
+	})
+
+	t.Run("JSON-aware split falls back for oversized members", func(t *testing.T) {
+		message := fmt.Sprintf(`{"a": %q}`, strings.Repeat("v", common.MaxMessageSize))
+		got := SplitLogMessage(message, true)
+		assert.Len(t, got, 2)
+		assert.Equal(t, message, got[0].Message+got[1].Message)
+	})
+}
+
 // TestProduceMessageToChannel tests the ProduceMessageToChannel function
 func TestProduceMessageToChannel(t *testing.T) {
 	// Create a channel for DetailedLogsBatch
@@ -0,0 +1,538 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/newrelic-client-go/v2/pkg/region"
+)
+
+// Exporters of the metrics of the forwarder, selected with NR_METRICS_EXPORTER.
+const (
+	MetricsExporterNone      = "none"       // MetricsExporterNone does not record metrics.
+	MetricsExporterMetricAPI = "metric_api" // MetricsExporterMetricAPI sends the metrics to the New Relic Metric API.
+	MetricsExporterEMF       = "emf"        // MetricsExporterEMF writes the metrics to the standard output in the CloudWatch embedded metric format.
+)
+
+// Metrics of the forwarder.
+const (
+	MetricRecordsRead        = "logForwarder.records.read"        // MetricRecordsRead counts the log events and lines read.
+	MetricRecordsDropped     = "logForwarder.records.dropped"     // MetricRecordsDropped counts the lines dropped by the skip long line policy.
+	MetricRecordsUnprocessed = "logForwarder.records.unprocessed" // MetricRecordsUnprocessed counts the log events left unread at the deadline of the invocation.
+	MetricObjectsRead        = "logForwarder.objects.read"        // MetricObjectsRead counts the S3 objects read.
+	MetricBytesIn            = "logForwarder.bytes.in"            // MetricBytesIn counts the bytes of the logs read.
+	MetricBytesOut           = "logForwarder.bytes.out"           // MetricBytesOut counts the bytes of the JSON encoding of the batches.
+	MetricBytesSent          = "logForwarder.bytes.sent"          // MetricBytesSent counts the compressed bytes of the requests accepted by the logs endpoint.
+	MetricCompressionRatio   = "logForwarder.compression.ratio"   // MetricCompressionRatio is the ratio of the bytes of the batches to the bytes sent.
+	MetricEntriesBatched     = "logForwarder.entries.batched"     // MetricEntriesBatched counts the log entries added to batches.
+	MetricEntriesOversized   = "logForwarder.entries.oversized"   // MetricEntriesOversized counts the log entries too large to fit in a batch.
+	MetricEntriesTruncated   = "logForwarder.entries.truncated"   // MetricEntriesTruncated counts the log entries with attributes truncated to the attribute limits.
+	MetricBatchEntries       = "logForwarder.batch.entries"       // MetricBatchEntries is the distribution of the number of entries of the batches.
+	MetricBatchBytes         = "logForwarder.batch.bytes"         // MetricBatchBytes is the distribution of the size of the batches.
+	MetricBatchesSent        = "logForwarder.batches.sent"        // MetricBatchesSent counts the batches accepted by the logs endpoint.
+	MetricBatchesFailed      = "logForwarder.batches.failed"      // MetricBatchesFailed counts the batches that could not be sent.
+	MetricSendRetries        = "logForwarder.send.retries"        // MetricSendRetries counts the retries of batches.
+	MetricSendLatency        = "logForwarder.send.latency"        // MetricSendLatency is the distribution of the time to send a batch, retries included, in milliseconds.
+	MetricSourceDuration     = "logForwarder.source.duration"     // MetricSourceDuration is the distribution of the time to read a log group event or an S3 object, in milliseconds.
+)
+
+// metricUnits are the EMF units of the metrics, Count when not listed.
+var metricUnits = map[string]string{
+	MetricBytesIn:          "Bytes",
+	MetricBytesOut:         "Bytes",
+	MetricBytesSent:        "Bytes",
+	MetricBatchBytes:       "Bytes",
+	MetricCompressionRatio: "None",
+	MetricSendLatency:      "Milliseconds",
+	MetricSourceDuration:   "Milliseconds",
+}
+
+// Types of the metrics, as named by the Metric API.
+const (
+	metricCount   = "count"
+	metricGauge   = "gauge"
+	metricSummary = "summary"
+)
+
+// maxSummaryValues is the number of values of a summary kept for the EMF exporter.
+const maxSummaryValues = 10000
+
+// sentBytes is the number of compressed bytes of the requests accepted by the logs endpoint since the last export,
+// recorded by retryAfterTransport. Invocations of a function instance do not overlap, so it is that of the current invocation.
+var sentBytes atomic.Int64
+
+// MetricDimensions are the dimensions of a metric.
+type MetricDimensions map[string]string
+
+// SourceDimensions returns the dimensions of the metrics of the logs with the common attributes:
+// their source type and their log group or bucket.
+func SourceDimensions(attributes common.LogAttributes) MetricDimensions {
+	if logGroup, ok := attributes["logGroup"]; ok {
+		return MetricDimensions{"sourceType": "cloudwatch", "logGroup": fmt.Sprint(logGroup)}
+	}
+	if bucketName, ok := attributes["logBucketName"]; ok {
+		return MetricDimensions{"sourceType": "s3", "logBucketName": fmt.Sprint(bucketName)}
+	}
+	return MetricDimensions{"sourceType": "unknown"}
+}
+
+// batchDimensions returns the dimensions of the metrics of a log batch, those of the source of its first log.
+func batchDimensions(batch common.DetailedLogsBatch) MetricDimensions {
+	if len(batch) == 0 {
+		return SourceDimensions(nil)
+	}
+	return SourceDimensions(batch[0].CommonData.Attributes)
+}
+
+// metric is a count, a gauge or a summary of the observed values.
+type metric struct {
+	name       string
+	kind       string
+	dimensions MetricDimensions
+	value      float64   // value of a count or a gauge
+	count      int       // number of values of a summary
+	sum        float64   // sum of the values of a summary
+	min        float64   // minimum value of a summary
+	max        float64   // maximum value of a summary
+	values     []float64 // first values of a summary
+}
+
+// Metrics records the metrics of the forwarder during an invocation.
+// All its methods can be called on a nil *Metrics, which records nothing.
+type Metrics struct {
+	mu         sync.Mutex
+	dimensions MetricDimensions
+	start      time.Time
+	metrics    map[string]*metric
+}
+
+// NewMetrics creates the metrics of an invocation, with the name of the function and the instrumentation version as common dimensions.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		dimensions: MetricDimensions{
+			"functionName":            os.Getenv(common.LambdaFunctionName),
+			"instrumentation.version": common.InstrumentationVersion,
+		},
+		start:   time.Now(),
+		metrics: map[string]*metric{},
+	}
+}
+
+// Count adds the value to a count.
+func (m *Metrics) Count(name string, value float64, dimensions MetricDimensions) {
+	m.record(name, metricCount, dimensions, func(metric *metric) {
+		metric.value += value
+	})
+}
+
+// Gauge sets the value of a gauge.
+func (m *Metrics) Gauge(name string, value float64, dimensions MetricDimensions) {
+	m.record(name, metricGauge, dimensions, func(metric *metric) {
+		metric.value = value
+	})
+}
+
+// Observe adds a value to a summary.
+func (m *Metrics) Observe(name string, value float64, dimensions MetricDimensions) {
+	m.record(name, metricSummary, dimensions, func(metric *metric) {
+		if metric.count == 0 || value < metric.min {
+			metric.min = value
+		}
+		if metric.count == 0 || value > metric.max {
+			metric.max = value
+		}
+		metric.count++
+		metric.sum += value
+		if len(metric.values) < maxSummaryValues {
+			metric.values = append(metric.values, value)
+		}
+	})
+}
+
+// ObserveDuration adds a duration in milliseconds to a summary.
+func (m *Metrics) ObserveDuration(name string, duration time.Duration, dimensions MetricDimensions) {
+	m.Observe(name, float64(duration)/float64(time.Millisecond), dimensions)
+}
+
+// record updates the metric of the name and dimensions.
+func (m *Metrics) record(name string, kind string, dimensions MetricDimensions, update func(*metric)) {
+	if m == nil {
+		return
+	}
+	key := metricKey(name, dimensions)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	recorded, ok := m.metrics[key]
+	if !ok {
+		recorded = &metric{name: name, kind: kind, dimensions: dimensions}
+		m.metrics[key] = recorded
+	}
+	update(recorded)
+}
+
+// sorted returns the metrics sorted by name and dimensions.
+func (m *Metrics) sorted() []*metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.metrics))
+	for key := range m.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	metrics := make([]*metric, len(keys))
+	for i, key := range keys {
+		metrics[i] = m.metrics[key]
+	}
+	return metrics
+}
+
+// total returns the sum of the counts of the name over all dimensions.
+func (m *Metrics) total(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := 0.0
+	for _, metric := range m.metrics {
+		if metric.name == name {
+			total += metric.value
+		}
+	}
+	return total
+}
+
+// metricKey identifies a metric by its name and dimensions.
+func metricKey(name string, dimensions MetricDimensions) string {
+	return name + "\x00" + dimensionsKey(dimensions)
+}
+
+// dimensionsKey encodes dimensions sorted by name.
+func dimensionsKey(dimensions MetricDimensions) string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name + "=" + dimensions[name] + "\x00")
+	}
+	return key.String()
+}
+
+// metricsContextKey is the key of the Metrics of a context.
+type metricsContextKey struct{}
+
+// ContextWithMetrics returns a context carrying the metrics of the invocation.
+func ContextWithMetrics(ctx context.Context, metrics *Metrics) context.Context {
+	return context.WithValue(ctx, metricsContextKey{}, metrics)
+}
+
+// MetricsFromContext returns the metrics of the invocation carried by the context, nil when there are none.
+func MetricsFromContext(ctx context.Context) *Metrics {
+	metrics, _ := ctx.Value(metricsContextKey{}).(*Metrics)
+	return metrics
+}
+
+// MetricsBatchHooks returns the BatchHooks recording the metrics of the batches of logs with the dimensions.
+func MetricsBatchHooks(metrics *Metrics, dimensions MetricDimensions) BatchHooks {
+	if metrics == nil {
+		return BatchHooks{}
+	}
+	return BatchHooks{
+		OnAdd: func(int) {
+			metrics.Count(MetricEntriesBatched, 1, dimensions)
+		},
+		OnFlush: func(stats BatchStats) {
+			metrics.Observe(MetricBatchEntries, float64(stats.Entries), dimensions)
+			metrics.Observe(MetricBatchBytes, float64(stats.Size), dimensions)
+			metrics.Count(MetricBytesOut, float64(stats.Size), dimensions)
+		},
+		OnOversized: func(int) {
+			metrics.Count(MetricEntriesOversized, 1, dimensions)
+		},
+		OnTruncated: func([]string) {
+			metrics.Count(MetricEntriesTruncated, 1, dimensions)
+		},
+	}
+}
+
+// MetricsExporter sends the metrics of an invocation.
+type MetricsExporter interface {
+	Export(ctx context.Context, metrics *Metrics) error
+}
+
+// NewMetricsExporter creates the exporter selected in NR_METRICS_EXPORTER. It returns nil when metrics are not recorded.
+func NewMetricsExporter() (MetricsExporter, error) {
+	switch exporter := os.Getenv(common.MetricsExporter); exporter {
+	case "", MetricsExporterNone:
+		return nil, nil
+	case MetricsExporterEMF:
+		return NewEMFExporter(os.Stdout), nil
+	case MetricsExporterMetricAPI:
+		licenseKey, err := GetLicenseKey()
+		if err != nil {
+			return nil, err
+		}
+		return newMetricAPIExporter(os.Getenv(common.NewRelicRegion), licenseKey)
+	default:
+		return nil, fmt.Errorf("unknown metrics exporter %q, expected %s, %s or %s", exporter, MetricsExporterNone, MetricsExporterMetricAPI, MetricsExporterEMF)
+	}
+}
+
+// ExportMetrics records the bytes sent during the invocation and their compression ratio, and exports the metrics.
+// Nothing is exported without exporter or metrics.
+func ExportMetrics(ctx context.Context, exporter MetricsExporter, metrics *Metrics) error {
+	sent := float64(sentBytes.Swap(0))
+	if exporter == nil || metrics == nil || len(metrics.sorted()) == 0 {
+		return nil
+	}
+	if sent > 0 {
+		metrics.Count(MetricBytesSent, sent, nil)
+		if batched := metrics.total(MetricBytesOut); batched > 0 {
+			metrics.Gauge(MetricCompressionRatio, batched/sent, nil)
+		}
+	}
+	return exporter.Export(ctx, metrics)
+}
+
+// MetricAPIExporter is a MetricsExporter sending the metrics to the New Relic Metric API.
+type MetricAPIExporter struct {
+	endpoint   string
+	licenseKey string
+	httpClient *http.Client
+}
+
+// newMetricAPIExporter creates a MetricAPIExporter sending the metrics to NR_METRICS_ENDPOINT,
+// or to the Metric API of the region, with the license key.
+func newMetricAPIExporter(regionName string, licenseKey string) (*MetricAPIExporter, error) {
+	nrRegion, fedRAMP, err := parseRegion(regionName)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := os.Getenv(common.MetricsEndpoint)
+	if endpoint == "" {
+		switch {
+		case fedRAMP:
+			endpoint = common.MetricAPIEndpointFedRAMP
+		case nrRegion == region.EU:
+			endpoint = common.MetricAPIEndpointEU
+		default:
+			endpoint = common.MetricAPIEndpointUS
+		}
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %w", common.MetricsEndpoint, endpoint, err)
+	}
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &MetricAPIExporter{
+		endpoint:   endpoint,
+		licenseKey: licenseKey,
+		httpClient: &http.Client{Transport: transport, Timeout: httpTimeout()},
+	}, nil
+}
+
+// metricAPIPayload is a request of the Metric API.
+type metricAPIPayload struct {
+	Common  metricAPICommon   `json:"common"`
+	Metrics []metricAPIMetric `json:"metrics"`
+}
+
+// metricAPICommon holds the values shared by the metrics of a request of the Metric API.
+type metricAPICommon struct {
+	Timestamp  int64            `json:"timestamp"`
+	IntervalMs int64            `json:"interval.ms"`
+	Attributes MetricDimensions `json:"attributes"`
+}
+
+// metricAPIMetric is a metric of a request of the Metric API.
+type metricAPIMetric struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	Value      interface{}      `json:"value"`
+	Attributes MetricDimensions `json:"attributes,omitempty"`
+}
+
+// metricAPISummary is the value of a summary metric of the Metric API.
+type metricAPISummary struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// buildMetricAPIRequest returns the request of the Metric API reporting the metrics over the interval ending at now.
+func buildMetricAPIRequest(metrics *Metrics, now time.Time) []metricAPIPayload {
+	payload := metricAPIPayload{
+		Common: metricAPICommon{
+			Timestamp:  metrics.start.UnixMilli(),
+			IntervalMs: max(now.Sub(metrics.start).Milliseconds(), 1),
+			Attributes: metrics.dimensions,
+		},
+	}
+	for _, metric := range metrics.sorted() {
+		var value interface{} = metric.value
+		if metric.kind == metricSummary {
+			value = metricAPISummary{Count: metric.count, Sum: metric.sum, Min: metric.min, Max: metric.max}
+		}
+		payload.Metrics = append(payload.Metrics, metricAPIMetric{Name: metric.name, Type: metric.kind, Value: value, Attributes: metric.dimensions})
+	}
+	return []metricAPIPayload{payload}
+}
+
+// Export sends the metrics to the Metric API.
+func (e *MetricAPIExporter) Export(ctx context.Context, metrics *Metrics) error {
+	body, err := json.Marshal(buildMetricAPIRequest(metrics, time.Now()))
+	if err != nil {
+		return err
+	}
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, &compressed)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Api-Key", e.licenseKey)
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(responseBody)}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// EMFExporter is a MetricsExporter writing the metrics as lines in the CloudWatch embedded metric format,
+// one line per set of dimensions. Summaries are written as their values, MaxEMFValues per line.
+type EMFExporter struct {
+	writer io.Writer
+}
+
+// NewEMFExporter creates an EMFExporter writing to the writer.
+func NewEMFExporter(writer io.Writer) *EMFExporter {
+	return &EMFExporter{writer: writer}
+}
+
+// Export writes the metrics.
+func (e *EMFExporter) Export(_ context.Context, metrics *Metrics) error {
+	lines, err := buildEMFLines(metrics, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := e.writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildEMFLines returns the EMF lines of the metrics.
+func buildEMFLines(metrics *Metrics, now time.Time) ([][]byte, error) {
+	// Metrics are grouped by dimensions, in the order of their first metric.
+	var groups [][]*metric
+	groupIndexes := map[string]int{}
+	for _, metric := range metrics.sorted() {
+		key := dimensionsKey(metric.dimensions)
+		index, ok := groupIndexes[key]
+		if !ok {
+			index = len(groups)
+			groupIndexes[key] = index
+			groups = append(groups, nil)
+		}
+		groups[index] = append(groups[index], metric)
+	}
+
+	var lines [][]byte
+	for _, group := range groups {
+		dimensions := MetricDimensions{}
+		for name, value := range metrics.dimensions {
+			dimensions[name] = value
+		}
+		for name, value := range group[0].dimensions {
+			dimensions[name] = value
+		}
+		dimensionNames := make([]string, 0, len(dimensions))
+		for name := range dimensions {
+			dimensionNames = append(dimensionNames, name)
+		}
+		sort.Strings(dimensionNames)
+
+		valueCount := 0
+		for _, metric := range group {
+			valueCount = max(valueCount, len(metric.values))
+		}
+		for part := 0; part == 0 || part*common.MaxEMFValues < valueCount; part++ {
+			line, err := buildEMFLine(group, part, dimensions, dimensionNames, now)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// buildEMFLine returns the part of the EMF line of metrics sharing dimensions. The first part holds the counts and the gauges,
+// and every part holds up to MaxEMFValues values of every summary.
+func buildEMFLine(group []*metric, part int, dimensions MetricDimensions, dimensionNames []string, now time.Time) ([]byte, error) {
+	document := map[string]interface{}{}
+	for name, value := range dimensions {
+		document[name] = value
+	}
+	var definitions []map[string]string
+	for _, metric := range group {
+		var value interface{}
+		switch {
+		case metric.kind != metricSummary && part == 0:
+			value = metric.value
+		case metric.kind == metricSummary && part*common.MaxEMFValues < len(metric.values):
+			value = metric.values[part*common.MaxEMFValues : min((part+1)*common.MaxEMFValues, len(metric.values))]
+		default:
+			continue
+		}
+		unit, ok := metricUnits[metric.name]
+		if !ok {
+			unit = "Count"
+		}
+		document[metric.name] = value
+		definitions = append(definitions, map[string]string{"Name": metric.name, "Unit": unit})
+	}
+	document["_aws"] = map[string]interface{}{
+		"Timestamp": now.UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  common.EMFNamespace,
+			"Dimensions": [][]string{dimensionNames},
+			"Metrics":    definitions,
+		}},
+	}
+	return json.Marshal(document)
+}
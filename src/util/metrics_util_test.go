@@ -0,0 +1,226 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testMetrics returns metrics started at a fixed time, with a count, a gauge and a summary.
+func testMetrics(t *testing.T) *Metrics {
+	t.Setenv(common.LambdaFunctionName, "forwarder")
+	metrics := NewMetrics()
+	metrics.start = time.UnixMilli(1700000000000)
+	dimensions := MetricDimensions{"sourceType": "cloudwatch", "logGroup": "/aws/lambda/api"}
+	metrics.Count(MetricRecordsRead, 2, dimensions)
+	metrics.Count(MetricRecordsRead, 3, MetricDimensions{"logGroup": "/aws/lambda/api", "sourceType": "cloudwatch"})
+	metrics.Gauge(MetricCompressionRatio, 4, nil)
+	metrics.Observe(MetricBatchEntries, 10, dimensions)
+	metrics.Observe(MetricBatchEntries, 2, dimensions)
+	metrics.ObserveDuration(MetricSendLatency, 1500*time.Microsecond, dimensions)
+	return metrics
+}
+
+// TestMetrics tests the aggregation of counts, gauges and summaries, and that a nil *Metrics records nothing.
+func TestMetrics(t *testing.T) {
+	metrics := testMetrics(t).sorted()
+	assert.Len(t, metrics, 4)
+	assert.Equal(t, MetricBatchEntries, metrics[0].name)
+	assert.Equal(t, 2, metrics[0].count)
+	assert.Equal(t, 12.0, metrics[0].sum)
+	assert.Equal(t, 2.0, metrics[0].min)
+	assert.Equal(t, 10.0, metrics[0].max)
+	assert.Equal(t, []float64{10, 2}, metrics[0].values)
+	assert.Equal(t, MetricCompressionRatio, metrics[1].name)
+	assert.Equal(t, MetricRecordsRead, metrics[2].name)
+	assert.Equal(t, 5.0, metrics[2].value)
+	assert.Equal(t, 1.5, metrics[3].sum)
+
+	var nilMetrics *Metrics
+	nilMetrics.Count(MetricRecordsRead, 1, nil)
+	nilMetrics.Observe(MetricBatchEntries, 1, nil)
+	assert.Nil(t, MetricsFromContext(context.Background()))
+	assert.Equal(t, BatchHooks{}, MetricsBatchHooks(nil, nil))
+}
+
+// TestMetricsBatchHooks tests the metrics recorded for the batches of a Batcher.
+func TestMetricsBatchHooks(t *testing.T) {
+	metrics := NewMetrics()
+	dimensions := SourceDimensions(common.LogAttributes{"logBucketName": "logs"})
+	assert.Equal(t, MetricDimensions{"sourceType": "s3", "logBucketName": "logs"}, dimensions)
+
+	channel := make(chan common.DetailedLogsBatch, 2)
+	batcher := NewBatcher(channel, common.LogAttributes{}, BatchLimits{MaxSize: common.MaxPayloadSize, MaxMessages: 2}, MetricsBatchHooks(metrics, dimensions))
+	for range 3 {
+		batcher.Add(common.Log{Log: "message"})
+	}
+	batcher.Close()
+
+	assert.Equal(t, 3.0, metrics.total(MetricEntriesBatched))
+	batchEntries := metrics.metrics[metricKey(MetricBatchEntries, dimensions)]
+	assert.Equal(t, 2, batchEntries.count)
+	assert.Equal(t, 3.0, batchEntries.sum)
+	assert.Greater(t, metrics.total(MetricBytesOut), 0.0)
+}
+
+// TestConsumeLogBatchesMetrics tests the metrics of the batches sent and failed by the consumers.
+func TestConsumeLogBatchesMetrics(t *testing.T) {
+	t.Setenv(common.RetryMaxAttempts, "1")
+	sent := common.DetailedLogsBatch{{CommonData: common.Common{Attributes: common.LogAttributes{"logGroup": "/aws/lambda/api"}}}}
+	failed := common.DetailedLogsBatch{{CommonData: common.Common{Attributes: common.LogAttributes{"logBucketName": "logs"}}}}
+	nrClient := new(MockNRClient)
+	nrClient.On("CreateLogEntry", sent).Return(nil)
+	nrClient.On("CreateLogEntry", failed).Return(errors.New("unavailable"))
+
+	metrics := NewMetrics()
+	channel := make(chan common.DetailedLogsBatch, 2)
+	channel <- sent
+	channel <- failed
+	close(channel)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ConsumeLogBatches(ContextWithMetrics(context.Background(), metrics), channel, &wg, nrClient, &SendOutcome{})
+
+	assert.Equal(t, 1.0, metrics.metrics[metricKey(MetricBatchesSent, batchDimensions(sent))].value)
+	assert.Equal(t, 1.0, metrics.metrics[metricKey(MetricBatchesFailed, batchDimensions(failed))].value)
+	assert.Equal(t, 1, metrics.metrics[metricKey(MetricSendLatency, batchDimensions(sent))].count)
+	mock.AssertExpectationsForObjects(t, nrClient)
+}
+
+// TestBuildMetricAPIRequest tests the request of the Metric API.
+func TestBuildMetricAPIRequest(t *testing.T) {
+	request, err := json.Marshal(buildMetricAPIRequest(testMetrics(t), time.UnixMilli(1700000002000)))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{
+		"common": {"timestamp": 1700000000000, "interval.ms": 2000, "attributes": {"functionName": "forwarder", "instrumentation.version": "`+common.InstrumentationVersion+`"}},
+		"metrics": [
+			{"name": "logForwarder.batch.entries", "type": "summary", "value": {"count": 2, "sum": 12, "min": 2, "max": 10}, "attributes": {"logGroup": "/aws/lambda/api", "sourceType": "cloudwatch"}},
+			{"name": "logForwarder.compression.ratio", "type": "gauge", "value": 4},
+			{"name": "logForwarder.records.read", "type": "count", "value": 5, "attributes": {"logGroup": "/aws/lambda/api", "sourceType": "cloudwatch"}},
+			{"name": "logForwarder.send.latency", "type": "summary", "value": {"count": 1, "sum": 1.5, "min": 1.5, "max": 1.5}, "attributes": {"logGroup": "/aws/lambda/api", "sourceType": "cloudwatch"}}
+		]
+	}]`, string(request))
+}
+
+// TestMetricAPIExporter tests the requests sent to the Metric API and the errors of unsuccessful responses.
+func TestMetricAPIExporter(t *testing.T) {
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "license", r.Header.Get("Api-Key"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		reader, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		var payload []metricAPIPayload
+		assert.NoError(t, json.NewDecoder(reader).Decode(&payload))
+		assert.Len(t, payload[0].Metrics, 4)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	t.Setenv(common.MetricsEndpoint, server.URL)
+	exporter, err := newMetricAPIExporter("EU", "license")
+	assert.NoError(t, err)
+	assert.NoError(t, exporter.Export(context.Background(), testMetrics(t)))
+
+	status = http.StatusForbidden
+	assert.EqualError(t, exporter.Export(context.Background(), testMetrics(t)), "403 response returned: ")
+
+	t.Setenv(common.MetricsEndpoint, "")
+	exporter, err = newMetricAPIExporter("FedRAMP", "license")
+	assert.NoError(t, err)
+	assert.Equal(t, common.MetricAPIEndpointFedRAMP, exporter.endpoint)
+}
+
+// TestEMFExporter tests the EMF lines of the metrics, one per set of dimensions.
+func TestEMFExporter(t *testing.T) {
+	var output bytes.Buffer
+	assert.NoError(t, NewEMFExporter(&output).Export(context.Background(), testMetrics(t)))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	assert.Len(t, lines, 2)
+	var document map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &document))
+	assert.Equal(t, "forwarder", document["functionName"])
+	assert.Equal(t, "/aws/lambda/api", document["logGroup"])
+	assert.Equal(t, []interface{}{10.0, 2.0}, document[MetricBatchEntries])
+	assert.Equal(t, 5.0, document[MetricRecordsRead])
+	definition := document["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, common.EMFNamespace, definition["Namespace"])
+	assert.Equal(t, []interface{}{[]interface{}{"functionName", "instrumentation.version", "logGroup", "sourceType"}}, definition["Dimensions"])
+	assert.Contains(t, definition["Metrics"], map[string]interface{}{"Name": MetricSendLatency, "Unit": "Milliseconds"})
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &document))
+	assert.Equal(t, 4.0, document[MetricCompressionRatio])
+}
+
+// TestBuildEMFLinesValues tests that summaries with more values than an EMF line holds are split over several lines.
+func TestBuildEMFLinesValues(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Count(MetricBatchesSent, 250, nil)
+	for i := range 250 {
+		metrics.Observe(MetricSendLatency, float64(i), nil)
+	}
+
+	lines, err := buildEMFLines(metrics, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, lines, 3)
+	for i, expected := range []int{100, 100, 50} {
+		var document map[string]interface{}
+		assert.NoError(t, json.Unmarshal(lines[i], &document))
+		assert.Len(t, document[MetricSendLatency], expected)
+		_, hasCount := document[MetricBatchesSent]
+		assert.Equal(t, i == 0, hasCount)
+	}
+}
+
+// TestExportMetrics tests that the bytes sent and the compression ratio are recorded before the metrics are exported.
+func TestExportMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sentBytes.Store(0)
+	client := &http.Client{Transport: &retryAfterTransport{next: http.DefaultTransport, countSentBytes: true}}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader("0123456789"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	metrics := NewMetrics()
+	metrics.Count(MetricBytesOut, 40, MetricDimensions{"sourceType": "s3"})
+	var output bytes.Buffer
+	assert.NoError(t, ExportMetrics(context.Background(), NewEMFExporter(&output), metrics))
+	assert.Equal(t, 10.0, metrics.total(MetricBytesSent))
+	assert.Equal(t, 4.0, metrics.total(MetricCompressionRatio))
+	assert.Equal(t, int64(0), sentBytes.Load())
+
+	assert.NoError(t, ExportMetrics(context.Background(), nil, nil))
+}
+
+// TestNewMetricsExporter tests the selection of the metrics exporter.
+func TestNewMetricsExporter(t *testing.T) {
+	exporter, err := NewMetricsExporter()
+	assert.NoError(t, err)
+	assert.Nil(t, exporter)
+
+	t.Setenv(common.MetricsExporter, MetricsExporterEMF)
+	exporter, err = NewMetricsExporter()
+	assert.NoError(t, err)
+	assert.IsType(t, &EMFExporter{}, exporter)
+
+	t.Setenv(common.MetricsExporter, "statsd")
+	_, err = NewMetricsExporter()
+	assert.EqualError(t, err, `unknown metrics exporter "statsd", expected none, metric_api or emf`)
+}
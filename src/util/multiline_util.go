@@ -0,0 +1,198 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// MultilineRule describes how consecutive lines of a log source are merged into a single log entry.
+// A line matching StartPattern begins a new entry. When ContinuationPattern is set, only lines matching it
+// are appended to the previous entry; otherwise every line not matching StartPattern is a continuation.
+type MultilineRule struct {
+	SourceScope
+	StartPattern        string `json:"StartPattern"`        // Regex matching the first line of an entry
+	ContinuationPattern string `json:"ContinuationPattern"` // Regex matching lines to append to the previous entry
+	MaxLines            int    `json:"MaxLines"`            // Maximum number of lines merged into one entry
+	MaxBytes            int    `json:"MaxBytes"`            // Maximum size in bytes of a merged entry
+}
+
+// LinePosition locates a line in the source it was read from.
+type LinePosition struct {
+	LineNumber int64 // LineNumber is the one based number of the line.
+	Offset     int64 // Offset is the byte offset of the start of the line.
+}
+
+// AssembledEntry is a log entry produced by a MultilineAssembler.
+type AssembledEntry struct {
+	Message   string       // Message is the merged content of all lines of the entry.
+	FirstLine int          // FirstLine is the zero based index of the first line of the entry, counted across all lines added.
+	LineCount int          // LineCount is the number of lines merged into the entry.
+	Position  LinePosition // Position is the position of the first line of the entry, as passed to AddAt.
+}
+
+// MultilineAssembler merges continuation lines into the preceding entry according to a MultilineRule.
+// An assembler without any pattern passes every line through unchanged.
+type MultilineAssembler struct {
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+	maxLines     int
+	maxBytes     int
+
+	current   strings.Builder
+	firstLine int
+	position  LinePosition
+	lineCount int
+	nextLine  int
+}
+
+// ParseMultilineRules parses the multiline configuration and validates the patterns of every rule.
+func ParseMultilineRules(jsonString string) ([]MultilineRule, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var rules []MultilineRule
+	if err := json.Unmarshal([]byte(jsonString), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal multiline config: %w", err)
+	}
+	for i := range rules {
+		if rules[i].StartPattern == "" && rules[i].ContinuationPattern == "" {
+			return nil, fmt.Errorf("multiline rule %+v has neither a start nor a continuation pattern", rules[i].SourceScope)
+		}
+		if _, _, err := compileMultilinePatterns(&rules[i]); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// compileMultilinePatterns compiles the start and continuation patterns of a rule, returning nil for the patterns not set.
+func compileMultilinePatterns(rule *MultilineRule) (*regexp.Regexp, *regexp.Regexp, error) {
+	var start, continuation *regexp.Regexp
+	var err error
+	if rule.StartPattern != "" {
+		if start, err = regexp.Compile(rule.StartPattern); err != nil {
+			return nil, nil, fmt.Errorf("invalid multiline start pattern %q: %w", rule.StartPattern, err)
+		}
+	}
+	if rule.ContinuationPattern != "" {
+		if continuation, err = regexp.Compile(rule.ContinuationPattern); err != nil {
+			return nil, nil, fmt.Errorf("invalid multiline continuation pattern %q: %w", rule.ContinuationPattern, err)
+		}
+	}
+	return start, continuation, nil
+}
+
+// NewMultilineAssembler creates a MultilineAssembler for the given rule.
+// A nil rule creates an assembler that passes every line through unchanged.
+func NewMultilineAssembler(rule *MultilineRule) (*MultilineAssembler, error) {
+	assembler := &MultilineAssembler{}
+	if rule == nil {
+		return assembler, nil
+	}
+
+	var err error
+	if assembler.start, assembler.continuation, err = compileMultilinePatterns(rule); err != nil {
+		return nil, err
+	}
+
+	assembler.maxLines = rule.MaxLines
+	if assembler.maxLines <= 0 {
+		assembler.maxLines = common.DefaultMultilineMaxLines
+	}
+	assembler.maxBytes = rule.MaxBytes
+	if assembler.maxBytes <= 0 {
+		assembler.maxBytes = common.MaxMessageSize
+	}
+	return assembler, nil
+}
+
+// NewMultilineAssemblerForLogGroup creates a MultilineAssembler using the first rule of the configuration that matches the log group.
+func NewMultilineAssemblerForLogGroup(jsonString string, logGroup string) (*MultilineAssembler, error) {
+	rules, err := ParseMultilineRules(jsonString)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].MatchesLogGroup(logGroup) {
+			return NewMultilineAssembler(&rules[i])
+		}
+	}
+	return NewMultilineAssembler(nil)
+}
+
+// NewMultilineAssemblerForObject creates a MultilineAssembler using the first rule of the configuration that matches the S3 object.
+func NewMultilineAssemblerForObject(jsonString string, bucketName string, objectKey string) (*MultilineAssembler, error) {
+	rules, err := ParseMultilineRules(jsonString)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].MatchesObject(bucketName, objectKey) {
+			return NewMultilineAssembler(&rules[i])
+		}
+	}
+	return NewMultilineAssembler(nil)
+}
+
+// Add adds a line to the assembler.
+// It returns the previous entry and true once the line completes it, otherwise it returns false.
+func (a *MultilineAssembler) Add(line string) (AssembledEntry, bool) {
+	return a.AddAt(line, LinePosition{})
+}
+
+// AddAt adds a line read at the given position to the assembler.
+// It returns the previous entry and true once the line completes it, otherwise it returns false.
+func (a *MultilineAssembler) AddAt(line string, position LinePosition) (AssembledEntry, bool) {
+	index := a.nextLine
+	a.nextLine++
+
+	if a.start == nil && a.continuation == nil {
+		return AssembledEntry{Message: line, FirstLine: index, LineCount: 1, Position: position}, true
+	}
+
+	if a.lineCount > 0 && a.isContinuation(line) &&
+		a.lineCount < a.maxLines && a.current.Len()+1+len(line) <= a.maxBytes {
+		a.current.WriteByte('\n')
+		a.current.WriteString(line)
+		a.lineCount++
+		return AssembledEntry{}, false
+	}
+
+	entry, ok := a.Flush()
+	a.current.WriteString(line)
+	a.firstLine = index
+	a.position = position
+	a.lineCount = 1
+	return entry, ok
+}
+
+// Flush returns the entry being assembled, if any, and resets the assembler.
+func (a *MultilineAssembler) Flush() (AssembledEntry, bool) {
+	if a.lineCount == 0 {
+		return AssembledEntry{}, false
+	}
+	entry := AssembledEntry{
+		Message:   a.current.String(),
+		FirstLine: a.firstLine,
+		LineCount: a.lineCount,
+		Position:  a.position,
+	}
+	a.current.Reset()
+	a.lineCount = 0
+	return entry, true
+}
+
+// isContinuation checks whether the line belongs to the entry being assembled.
+func (a *MultilineAssembler) isContinuation(line string) bool {
+	if a.start != nil && a.start.MatchString(line) {
+		return false
+	}
+	if a.continuation != nil {
+		return a.continuation.MatchString(line)
+	}
+	return true
+}
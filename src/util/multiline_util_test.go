@@ -0,0 +1,166 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assembleLines runs all lines through the assembler and returns the assembled entries.
+func assembleLines(assembler *MultilineAssembler, lines []string) []AssembledEntry {
+	var entries []AssembledEntry
+	for _, line := range lines {
+		if entry, ok := assembler.Add(line); ok {
+			entries = append(entries, entry)
+		}
+	}
+	if entry, ok := assembler.Flush(); ok {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// TestMultilineAssembler tests merging of continuation lines with different rules.
+func TestMultilineAssembler(t *testing.T) {
+	javaTrace := []string{
+		"2024-01-01 10:00:00 ERROR failed",
+		"java.lang.RuntimeException: boom",
+		"\tat com.example.Foo.bar(Foo.java:10)",
+		"\tat com.example.Foo.main(Foo.java:5)",
+		"2024-01-01 10:00:01 INFO recovered",
+	}
+
+	tests := []struct {
+		name     string         // Test case name
+		rule     *MultilineRule // Rule used to build the assembler
+		lines    []string       // Lines added to the assembler
+		expected []AssembledEntry
+	}{
+		{
+			name:  "No rule passes lines through",
+			rule:  nil,
+			lines: []string{"a", "b"},
+			expected: []AssembledEntry{
+				{Message: "a", FirstLine: 0, LineCount: 1},
+				{Message: "b", FirstLine: 1, LineCount: 1},
+			},
+		},
+		{
+			name:  "Start pattern",
+			rule:  &MultilineRule{StartPattern: `^\d{4}-\d{2}-\d{2}`},
+			lines: javaTrace,
+			expected: []AssembledEntry{
+				{Message: strings.Join(javaTrace[:4], "\n"), FirstLine: 0, LineCount: 4},
+				{Message: javaTrace[4], FirstLine: 4, LineCount: 1},
+			},
+		},
+		{
+			name:  "Continuation pattern",
+			rule:  &MultilineRule{ContinuationPattern: `^\s+at `},
+			lines: javaTrace,
+			expected: []AssembledEntry{
+				{Message: javaTrace[0], FirstLine: 0, LineCount: 1},
+				{Message: strings.Join(javaTrace[1:4], "\n"), FirstLine: 1, LineCount: 3},
+				{Message: javaTrace[4], FirstLine: 4, LineCount: 1},
+			},
+		},
+		{
+			name:  "Max lines",
+			rule:  &MultilineRule{StartPattern: `^\d{4}-\d{2}-\d{2}`, MaxLines: 2},
+			lines: javaTrace,
+			expected: []AssembledEntry{
+				{Message: strings.Join(javaTrace[:2], "\n"), FirstLine: 0, LineCount: 2},
+				{Message: strings.Join(javaTrace[2:4], "\n"), FirstLine: 2, LineCount: 2},
+				{Message: javaTrace[4], FirstLine: 4, LineCount: 1},
+			},
+		},
+		{
+			name:  "Max bytes",
+			rule:  &MultilineRule{StartPattern: `^START`, MaxBytes: 10},
+			lines: []string{"START", "abcd", "efgh"},
+			expected: []AssembledEntry{
+				{Message: "START\nabcd", FirstLine: 0, LineCount: 2},
+				{Message: "efgh", FirstLine: 2, LineCount: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assembler, err := NewMultilineAssembler(tt.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, assembleLines(assembler, tt.lines))
+		})
+	}
+}
+
+// TestNewMultilineAssemblerForScope tests selecting multiline rules by log group and S3 object.
+func TestNewMultilineAssemblerForScope(t *testing.T) {
+	config := `[
+		{"LogGroupPrefix": "/aws/lambda/java-", "StartPattern": "^START"},
+		{"BucketName": "logs", "KeyPrefix": "app/", "ContinuationPattern": "^\\s"}
+	]`
+
+	assembler, err := NewMultilineAssemblerForLogGroup(config, "/aws/lambda/java-service")
+	assert.NoError(t, err)
+	assert.Len(t, assembleLines(assembler, []string{"START", "line"}), 1)
+
+	assembler, err = NewMultilineAssemblerForLogGroup(config, "/aws/lambda/python-service")
+	assert.NoError(t, err)
+	assert.Len(t, assembleLines(assembler, []string{"START", "line"}), 2)
+
+	assembler, err = NewMultilineAssemblerForObject(config, "logs", "app/2024/01/01.log")
+	assert.NoError(t, err)
+	assert.Len(t, assembleLines(assembler, []string{"line", " continued"}), 1)
+
+	assembler, err = NewMultilineAssemblerForObject(config, "logs", "other/2024/01/01.log")
+	assert.NoError(t, err)
+	assert.Len(t, assembleLines(assembler, []string{"line", " continued"}), 2)
+
+	_, err = NewMultilineAssemblerForObject(`[{"BucketName": "logs", "StartPattern": "("}]`, "logs", "key")
+	assert.Error(t, err)
+
+	_, err = NewMultilineAssemblerForObject(`[{"BucketName": "logs"}]`, "logs", "key")
+	assert.Error(t, err)
+}
+
+// TestParseMultilineRules tests that every rule is validated when the configuration is parsed, whether or not a source matches it.
+func TestParseMultilineRules(t *testing.T) {
+	testCases := []struct {
+		name        string // name of the test case
+		config      string // multiline configuration
+		expectedErr string // expected error, empty when the configuration is valid
+	}{
+		{
+			name:   "Valid rules",
+			config: `[{"LogGroupPrefix": "/aws/lambda/", "StartPattern": "^START"}, {"BucketName": "logs", "ContinuationPattern": "^\\s"}]`,
+		},
+		{
+			name:        "Invalid start pattern in a later rule",
+			config:      `[{"LogGroupPrefix": "/aws/lambda/", "StartPattern": "^START"}, {"BucketName": "logs", "StartPattern": "("}]`,
+			expectedErr: "invalid multiline start pattern",
+		},
+		{
+			name:        "Invalid continuation pattern",
+			config:      `[{"BucketName": "logs", "ContinuationPattern": "[a-"}]`,
+			expectedErr: "invalid multiline continuation pattern",
+		},
+		{
+			name:        "Rule without patterns",
+			config:      `[{"BucketName": "logs"}]`,
+			expectedErr: "neither a start nor a continuation pattern",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseMultilineRules(tc.config)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			}
+		})
+	}
+}
@@ -2,12 +2,17 @@ package util
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/newrelic/aws-unified-lambda-logging/common"
-	"github.com/newrelic/newrelic-client-go/v2/pkg/config"
-	logging "github.com/newrelic/newrelic-client-go/v2/pkg/logs"
 	"github.com/newrelic/newrelic-client-go/v2/pkg/region"
+	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // NewRelicClientAPI is an interface that defines the methods for interacting with the New Relic Logs API.
@@ -15,49 +20,248 @@ type NewRelicClientAPI interface {
 	CreateLogEntry(logEntry interface{}) error
 }
 
+// contextClient is implemented by the clients whose requests are cancelled with the context they are sent with.
+type contextClient interface {
+	CreateLogEntryWithContext(ctx context.Context, logEntry interface{}) error
+}
+
+// createLogEntry sends a log entry with the client, cancelling its requests with the context when the client supports it.
+func createLogEntry(ctx context.Context, client NewRelicClientAPI, logEntry interface{}) error {
+	if client, ok := client.(contextClient); ok {
+		return client.CreateLogEntryWithContext(ctx, logEntry)
+	}
+	return client.CreateLogEntry(logEntry)
+}
+
+// FailedBatch is a log batch that could not be sent to New Relic.
+type FailedBatch struct {
+	Batch common.DetailedLogsBatch // Batch is the log batch.
+	Err   error                    // Err is the error of the last attempt to send the batch.
+}
+
+// SendOutcome collects the results of the log batches sent by the consumers of an invocation.
+type SendOutcome struct {
+	mu            sync.Mutex
+	sent          int
+	failedBatches []FailedBatch
+}
+
+// record records the result of sending a log batch.
+func (o *SendOutcome) record(batch common.DetailedLogsBatch, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err != nil {
+		o.failedBatches = append(o.failedBatches, FailedBatch{Batch: batch, Err: err})
+		return
+	}
+	o.sent++
+}
+
+// Sent returns the number of log batches accepted by New Relic.
+func (o *SendOutcome) Sent() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.sent
+}
+
+// Failed returns the number of log batches that could not be sent.
+func (o *SendOutcome) Failed() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.failedBatches)
+}
+
+// FailedBatches returns the log batches that could not be sent.
+func (o *SendOutcome) FailedBatches() []FailedBatch {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.failedBatches
+}
+
+// Err returns the errors of all log batches that could not be sent joined together, or nil if every batch was sent.
+func (o *SendOutcome) Err() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	errs := make([]error, len(o.failedBatches))
+	for i, failedBatch := range o.failedBatches {
+		errs[i] = failedBatch.Err
+	}
+	return errors.Join(errs...)
+}
+
 // ConsumeLogBatches consumes log batches from a channel and creates log entries using the provided NewRelicClientAPI.
-// The function returns when the channel is closed or the context is cancelled.
-func ConsumeLogBatches(ctx context.Context, channel <-chan common.DetailedLogsBatch, wg *sync.WaitGroup, nrClientAPI NewRelicClientAPI) {
+// Failed batches are retried according to the RetryPolicy of the function and their final result is recorded in the outcome.
+// The function returns when the channel is closed. Once the context is cancelled, the remaining batches are recorded as failed without being sent.
+func ConsumeLogBatches(ctx context.Context, channel <-chan common.DetailedLogsBatch, wg *sync.WaitGroup, nrClientAPI NewRelicClientAPI, outcome *SendOutcome) {
 	// Defer the Done() method of the WaitGroup to indicate that the goroutine has finished processing
 	defer wg.Done()
 
+	policy := NewRetryPolicy()
 	for {
 		select {
 		case batch, ok := <-channel:
 			if !ok {
 				return
 			}
-			if err := nrClientAPI.CreateLogEntry(batch); err != nil {
-				log.Fatalf("error posting Log entry: %v", err)
+			if ctx.Err() != nil {
+				recordBatchMetrics(ctx, batch, notSentError(ctx), 0)
+				outcome.record(batch, notSentError(ctx))
+				continue
+			}
+			start := time.Now()
+			err := SendWithRetry(ctx, nrClientAPI, batch, policy)
+			if err != nil {
+				log.Errorf("error posting Log entry: %v", err)
 			}
+			recordBatchMetrics(ctx, batch, err, time.Since(start))
+			outcome.record(unsentLogs(batch, err), err)
 		case <-ctx.Done():
-			// Context has been cancelled, exit the goroutine
+			// Context has been cancelled, record the remaining batches as failed so producers are not blocked.
+			for batch := range channel {
+				recordBatchMetrics(ctx, batch, notSentError(ctx), 0)
+				outcome.record(batch, notSentError(ctx))
+			}
 			return
 		}
 	}
 }
 
+// unsentLogs returns the logs of a batch that were not sent, which are fewer than the batch when it was sent in part.
+func unsentLogs(batch common.DetailedLogsBatch, err error) common.DetailedLogsBatch {
+	var sendErr *SendError
+	if errors.As(err, &sendErr) && sendErr.Batch != nil {
+		return sendErr.Batch
+	}
+	return batch
+}
+
+// recordBatchMetrics records the result of sending a log batch, and the time spent sending it when it was sent, in the metrics of the context.
+func recordBatchMetrics(ctx context.Context, batch common.DetailedLogsBatch, err error, latency time.Duration) {
+	metrics := MetricsFromContext(ctx)
+	if metrics == nil {
+		return
+	}
+	dimensions := batchDimensions(batch)
+	if err != nil {
+		metrics.Count(MetricBatchesFailed, 1, dimensions)
+	} else {
+		metrics.Count(MetricBatchesSent, 1, dimensions)
+	}
+	if latency > 0 {
+		metrics.ObserveDuration(MetricSendLatency, latency, dimensions)
+	}
+}
+
+// notSentError returns the error of a batch that is not sent because the context is done.
+func notSentError(ctx context.Context) error {
+	return fmt.Errorf("log batch not sent before the invocation ended: %w", context.Cause(ctx))
+}
+
+// StartLogBatchConsumers starts the given number of ConsumeLogBatches workers reading from the channel.
+// Every worker is added to the WaitGroup, so waiting on it waits for all in-flight sends once the channel is closed.
+// The returned SendOutcome holds the results of the sent batches once the WaitGroup is done.
+func StartLogBatchConsumers(ctx context.Context, channel <-chan common.DetailedLogsBatch, wg *sync.WaitGroup, nrClientAPI NewRelicClientAPI, workers int) *SendOutcome {
+	outcome := &SendOutcome{}
+	for range workers {
+		wg.Add(1)
+		go ConsumeLogBatches(ctx, channel, wg, nrClientAPI, outcome)
+	}
+	return outcome
+}
+
+// SenderWorkerCount returns the number of batches sent to New Relic concurrently, read from NR_SENDER_WORKERS.
+func SenderWorkerCount() int {
+	return positiveIntFromEnv(common.SenderWorkers, common.DefaultSenderWorkers)
+}
+
+// SenderQueueCapacity returns the capacity of the channel of batches waiting to be sent, read from NR_SENDER_QUEUE_SIZE.
+// It defaults to the number of sender workers.
+func SenderQueueCapacity(workers int) int {
+	return positiveIntFromEnv(common.SenderQueueSize, workers)
+}
+
+// positiveIntFromEnv reads a positive integer from the environment variable, returning the default value when it is not set or invalid.
+func positiveIntFromEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		log.Warnf("invalid %s %q, using the default value %d", name, value, defaultValue)
+		return defaultValue
+	}
+	return number
+}
+
 // NewNRClient Initializes a new NRClient with debug level and region
 // It returns a NewRelicClientAPI interface and an error if there is a problem setting the region.
 func NewNRClient() (NewRelicClientAPI, error) {
-	nrRegion, _ := region.Get(region.Name(os.Getenv(common.NewRelicRegion)))
-	var nrClient logging.Logs
-	cfg := config.Config{
-		Compression: config.Compression.Gzip,
+	licenseKey, err := GetLicenseKey()
+	nrClient, regionErr := newNRClient(os.Getenv(common.NewRelicRegion), licenseKey)
+	if regionErr != nil {
+		return nrClient, regionErr
 	}
+	return nrClient, err
+}
 
-	if os.Getenv(common.DebugEnabled) == "true" {
-		cfg.LogLevel = "debug"
-	} else {
-		cfg.LogLevel = "info"
+// newNRClient creates a client of the Log API of the region with the license key.
+// Every log batch is sent in a single gzip-compressed request, failed requests being retried by SendWithRetry only,
+// so that the retry policy of the function, the Retry-After time and the invocation deadline apply to every request.
+func newNRClient(regionName string, licenseKey string) (NewRelicClientAPI, error) {
+	nrRegion, err := logsRegion(regionName)
+	if err != nil {
+		return nil, err
 	}
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	// The transport records the Retry-After header of throttled responses, reported to SendWithRetry in HTTPStatusError.
+	retryAfter := &retryAfterTransport{next: transport, countSentBytes: true}
+	return &HTTPSink{
+		url:        nrRegion.LogsURL(),
+		headers:    map[string]string{"X-License-Key": licenseKey},
+		gzip:       true,
+		httpClient: &http.Client{Transport: retryAfter, Timeout: httpTimeout()},
+		retryAfter: retryAfter,
+	}, nil
+}
 
-	if err := cfg.SetRegion(nrRegion); err != nil {
-		return &nrClient, err
+// parseRegion parses a region name: US, the default, EU or FedRAMP, regardless of case.
+// FedRAMP accounts are in the US region and it is reported with fedRAMP set.
+func parseRegion(regionName string) (name region.Name, fedRAMP bool, err error) {
+	switch {
+	case regionName == "":
+		return region.US, false, nil
+	case strings.EqualFold(regionName, common.RegionFedRAMP):
+		return region.US, true, nil
+	}
+	name, err = region.Parse(regionName)
+	if err != nil {
+		return "", false, fmt.Errorf("unknown New Relic region %q, expected US, EU or %s", regionName, common.RegionFedRAMP)
 	}
+	return name, false, nil
+}
 
-	licenseKey, err := GetLicenseKey()
-	cfg.LicenseKey = licenseKey
-	nrClient = logging.New(cfg)
-	return &nrClient, err
+// logsRegion returns the region of a region name, its Log API endpoint being replaced by NR_LOGS_ENDPOINT when set.
+func logsRegion(regionName string) (*region.Region, error) {
+	name, fedRAMP, err := parseRegion(regionName)
+	if err != nil {
+		return nil, err
+	}
+	nrRegion, err := region.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if fedRAMP {
+		nrRegion.SetLogsBaseURL(common.FedRAMPLogsEndpoint)
+	}
+	if endpoint := os.Getenv(common.LogsEndpoint); endpoint != "" {
+		if _, err := url.ParseRequestURI(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", common.LogsEndpoint, endpoint, err)
+		}
+		nrRegion.SetLogsBaseURL(endpoint)
+	}
+	return nrRegion, nil
 }
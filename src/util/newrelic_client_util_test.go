@@ -5,8 +5,11 @@ package util
 import (
 	"context"
 	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -52,11 +55,18 @@ func TestNewNRClient(t *testing.T) {
 			expectedLogLevel: "info",
 			expectError:      false,
 		},
+		{
+			name:             "FedRAMP region",
+			envRegion:        "FedRAMP",
+			envLicenseKey:    "valid_license_key",
+			expectedLogLevel: "info",
+			expectError:      false,
+		},
 		{
 			name:          "Invalid region",
 			envRegion:     "invalid",
 			envLicenseKey: "valid_license_key",
-			expectError:   false,
+			expectError:   true,
 		},
 	}
 
@@ -88,6 +98,28 @@ func TestNewNRClient(t *testing.T) {
 	}
 }
 
+// TestNewNRClientEndpoint tests that logs are sent to the endpoint of NR_LOGS_ENDPOINT, and the validation of the endpoint.
+func TestNewNRClientEndpoint(t *testing.T) {
+	received := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		assert.Equal(t, "/log/v1", r.URL.Path)
+		assert.Equal(t, "license", r.Header.Get("X-License-Key"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	t.Setenv(common.LogsEndpoint, server.URL+"/log/v1")
+	nrClient, err := newNRClient("EU", "license")
+	assert.NoError(t, err)
+	assert.NoError(t, nrClient.CreateLogEntry(common.DetailedLogsBatch{{Entries: common.LogData{{Log: "message"}}}}))
+	assert.Equal(t, 1, received)
+
+	t.Setenv(common.LogsEndpoint, "vpce-logs.internal")
+	_, err = newNRClient("US", "license")
+	assert.ErrorContains(t, err, `invalid NR_LOGS_ENDPOINT "vpce-logs.internal"`)
+}
+
 // TestConsumeLogBatches tests the ConsumeLogBatches function.
 func TestConsumeLogBatches(t *testing.T) {
 	mockNRClient := new(MockNRClient)
@@ -112,8 +144,92 @@ func TestConsumeLogBatches(t *testing.T) {
 
 	ctx := context.TODO()
 	wg.Add(1)
-	go ConsumeLogBatches(ctx, channel, wg, mockNRClient)
+	go ConsumeLogBatches(ctx, channel, wg, mockNRClient, &SendOutcome{})
 	close(channel)
 	wg.Wait()
 	mockNRClient.AssertNumberOfCalls(t, "CreateLogEntry", 1)
 }
+
+// blockingNRClient is a NewRelicClientAPI whose calls block until the expected number of calls are in flight.
+type blockingNRClient struct {
+	inFlight atomic.Int32
+	expected int32
+	release  chan struct{}
+	once     sync.Once
+}
+
+// CreateLogEntry blocks until the expected number of calls are in flight.
+func (c *blockingNRClient) CreateLogEntry(batch interface{}) error {
+	if c.inFlight.Add(1) == c.expected {
+		c.once.Do(func() { close(c.release) })
+	}
+	<-c.release
+	return nil
+}
+
+// TestStartLogBatchConsumers verifies that the consumers send batches concurrently and that waiting on
+// the WaitGroup waits for every in-flight send.
+func TestStartLogBatchConsumers(t *testing.T) {
+	const workers = 3
+	nrClient := &blockingNRClient{expected: workers, release: make(chan struct{})}
+
+	channel := make(chan common.DetailedLogsBatch, workers)
+	wg := new(sync.WaitGroup)
+	StartLogBatchConsumers(context.TODO(), channel, wg, nrClient, workers)
+
+	// The sends only complete once all workers are sending at the same time.
+	for range workers {
+		channel <- common.DetailedLogsBatch{}
+	}
+	close(channel)
+	wg.Wait()
+	assert.Equal(t, int32(workers), nrClient.inFlight.Load())
+}
+
+// TestSenderWorkerCount tests reading the number of sender workers and the queue capacity from the environment.
+func TestSenderWorkerCount(t *testing.T) {
+	tests := []struct {
+		name          string // Test case name
+		workers       string // Value of NR_SENDER_WORKERS
+		queueSize     string // Value of NR_SENDER_QUEUE_SIZE
+		expected      int    // Expected number of workers
+		expectedQueue int    // Expected queue capacity
+	}{
+		{name: "Defaults", expected: common.DefaultSenderWorkers, expectedQueue: common.DefaultSenderWorkers},
+		{name: "Configured", workers: "8", queueSize: "32", expected: 8, expectedQueue: 32},
+		{name: "Invalid values", workers: "0", queueSize: "-1", expected: common.DefaultSenderWorkers, expectedQueue: common.DefaultSenderWorkers},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(common.SenderWorkers, tt.workers)
+			t.Setenv(common.SenderQueueSize, tt.queueSize)
+			workers := SenderWorkerCount()
+			assert.Equal(t, tt.expected, workers)
+			assert.Equal(t, tt.expectedQueue, SenderQueueCapacity(workers))
+		})
+	}
+}
+
+// TestConsumeLogBatchesCancelled verifies that batches are recorded as failed instead of blocking producers
+// once the context is cancelled.
+func TestConsumeLogBatchesCancelled(t *testing.T) {
+	mockNRClient := new(MockNRClient)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	channel := make(chan common.DetailedLogsBatch)
+	wg := new(sync.WaitGroup)
+	outcome := StartLogBatchConsumers(ctx, channel, wg, mockNRClient, 1)
+
+	for range 3 {
+		channel <- common.DetailedLogsBatch{}
+	}
+	close(channel)
+	wg.Wait()
+
+	mockNRClient.AssertNotCalled(t, "CreateLogEntry", mock.Anything)
+	assert.Equal(t, 3, outcome.Failed())
+	assert.ErrorIs(t, outcome.Err(), context.Canceled)
+}
@@ -0,0 +1,342 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/newrelic/newrelic-client-go/v2/pkg/region"
+	otlpcommon "go.opentelemetry.io/proto/otlp/common/v1"
+	otlplogs "go.opentelemetry.io/proto/otlp/logs/v1"
+	otlpresource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Exporters that send the logs, selected with NR_LOGS_EXPORTER.
+const (
+	ExporterLogsAPI = "logs_api" // ExporterLogsAPI sends the logs to the New Relic Log API.
+	ExporterOTLP    = "otlp"     // ExporterOTLP sends the logs to an OTLP/HTTP endpoint.
+)
+
+// Protocols of the OTLP exporter, selected with OTEL_EXPORTER_OTLP_LOGS_PROTOCOL.
+const (
+	OTLPProtocolProtobuf = "http/protobuf" // OTLPProtocolProtobuf encodes the logs as binary protobuf.
+	OTLPProtocolJSON     = "http/json"     // OTLPProtocolJSON encodes the logs as JSON.
+)
+
+// maxErrorBodySize is the number of bytes of an unsuccessful response kept in the error.
+const maxErrorBodySize = 512
+
+// OTLPExporter is a NewRelicClientAPI sending log batches to an OTLP/HTTP logs endpoint,
+// New Relic's OTLP endpoint by default.
+// The common attributes of a batch become the attributes of its resource and the attributes of every entry
+// those of its log record.
+type OTLPExporter struct {
+	endpoint   string
+	protocol   string
+	headers    map[string]string
+	httpClient *http.Client
+	retryAfter *retryAfterTransport
+}
+
+// NewLogsClient creates the client of the exporter selected in NR_LOGS_EXPORTER: a client of the
+// Log API created with NewNRClient, or an OTLPExporter created with NewOTLPExporter.
+func NewLogsClient() (NewRelicClientAPI, error) {
+	switch exporter := logsExporter(); exporter {
+	case ExporterLogsAPI:
+		return NewNRClient()
+	case ExporterOTLP:
+		return NewOTLPExporter()
+	default:
+		return nil, fmt.Errorf("unknown logs exporter %q, expected %s or %s", exporter, ExporterLogsAPI, ExporterOTLP)
+	}
+}
+
+// logsExporter returns the exporter selected in NR_LOGS_EXPORTER.
+func logsExporter() string {
+	if exporter := os.Getenv(common.LogsExporter); exporter != "" {
+		return exporter
+	}
+	return ExporterLogsAPI
+}
+
+// newExporterClient creates the client of the selected exporter sending logs to the account of the license key in the region.
+func newExporterClient(regionName string, licenseKey string) (NewRelicClientAPI, error) {
+	if logsExporter() == ExporterOTLP {
+		return newOTLPExporter(regionName, licenseKey)
+	}
+	return newNRClient(regionName, licenseKey)
+}
+
+// NewOTLPExporter creates an OTLPExporter configured with OTEL_EXPORTER_OTLP_LOGS_ENDPOINT, OTEL_EXPORTER_OTLP_LOGS_PROTOCOL
+// and OTEL_EXPORTER_OTLP_LOGS_HEADERS. When the endpoint is New Relic's and the headers have no api-key,
+// the license key of the function is sent in the api-key header.
+func NewOTLPExporter() (NewRelicClientAPI, error) {
+	exporter, err := newOTLPExporter(os.Getenv(common.NewRelicRegion), "")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := exporter.headers["api-key"]; !ok && isNewRelicEndpoint(exporter.endpoint) {
+		licenseKey, err := GetLicenseKey()
+		if err != nil {
+			return exporter, err
+		}
+		exporter.headers["api-key"] = licenseKey
+	}
+	return exporter, nil
+}
+
+// newOTLPExporter creates an OTLPExporter sending logs to the configured endpoint, or to the OTLP endpoint of the region.
+// A license key, when given, is sent in the api-key header to New Relic endpoints.
+func newOTLPExporter(regionName string, licenseKey string) (*OTLPExporter, error) {
+	nrRegion, fedRAMP, err := parseRegion(regionName)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := os.Getenv(common.OTLPLogsEndpoint)
+	if endpoint == "" {
+		switch {
+		case fedRAMP:
+			endpoint = common.OTLPEndpointFedRAMP
+		case nrRegion == region.EU:
+			endpoint = common.OTLPEndpointEU
+		default:
+			endpoint = common.OTLPEndpointUS
+		}
+	}
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: %w", endpoint, err)
+	}
+
+	protocol := os.Getenv(common.OTLPLogsProtocol)
+	switch protocol {
+	case "":
+		protocol = OTLPProtocolProtobuf
+	case OTLPProtocolProtobuf, OTLPProtocolJSON:
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, expected %s or %s", protocol, OTLPProtocolProtobuf, OTLPProtocolJSON)
+	}
+
+	headers, err := ParseOTLPHeaders(os.Getenv(common.OTLPLogsHeaders))
+	if err != nil {
+		return nil, err
+	}
+	if licenseKey != "" && isNewRelicEndpoint(endpoint) {
+		headers["api-key"] = licenseKey
+	}
+
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	retryAfter := &retryAfterTransport{next: transport, countSentBytes: true}
+	return &OTLPExporter{
+		endpoint: endpoint,
+		protocol: protocol,
+		headers:  headers,
+		httpClient: &http.Client{
+			Transport: retryAfter,
+			Timeout:   httpTimeout(),
+		},
+		retryAfter: retryAfter,
+	}, nil
+}
+
+// ParseOTLPHeaders parses headers in the format of OTEL_EXPORTER_OTLP_HEADERS, comma separated key=value pairs with URL encoded values.
+func ParseOTLPHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	if strings.TrimSpace(value) == "" {
+		return headers, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, headerValue, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected key=value", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(headerValue))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of OTLP header %q: %w", key, err)
+		}
+		headers[strings.ToLower(key)] = decoded
+	}
+	return headers, nil
+}
+
+// isNewRelicEndpoint checks whether an endpoint is one of New Relic's, the only ones the license key is sent to.
+func isNewRelicEndpoint(endpoint string) bool {
+	parsed, err := url.Parse(endpoint)
+	return err == nil && strings.HasSuffix(parsed.Hostname(), ".nr-data.net")
+}
+
+// CreateLogEntry sends a log batch as an OTLP export request.
+func (e *OTLPExporter) CreateLogEntry(logEntry interface{}) error {
+	return e.CreateLogEntryWithContext(context.Background(), logEntry)
+}
+
+// CreateLogEntryWithContext sends a log batch as an OTLP export request, cancelled once the context is done.
+func (e *OTLPExporter) CreateLogEntryWithContext(ctx context.Context, logEntry interface{}) error {
+	batch, ok := logEntry.(common.DetailedLogsBatch)
+	if !ok {
+		return fmt.Errorf("%w: unsupported log entry type %T", ErrInvalidLogEntry, logEntry)
+	}
+	request := BuildOTLPRequest(batch, time.Now())
+
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if e.protocol == OTLPProtocolJSON {
+		contentType = "application/json"
+		body, err = protojson.Marshal(request)
+	} else {
+		body, err = proto.Marshal(request)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLogEntry, err)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, &compressed)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(responseBody), NotBefore: e.retryAfter.retryNotBefore()}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// BuildOTLPRequest maps a log batch to the body of an OTLP export request.
+// LogsData has the same encoding as ExportLogsServiceRequest, which avoids depending on the gRPC collector packages.
+// Every detailed log becomes a resource with the common attributes, and every entry a log record
+// with the entry attributes, the message as body and the timestamp, in milliseconds, as time_unix_nano.
+// Entries without a timestamp have none, New Relic then uses the observed time.
+func BuildOTLPRequest(batch common.DetailedLogsBatch, observed time.Time) *otlplogs.LogsData {
+	request := &otlplogs.LogsData{}
+	for _, detailedLog := range batch {
+		records := make([]*otlplogs.LogRecord, 0, len(detailedLog.Entries))
+		for _, entry := range detailedLog.Entries {
+			records = append(records, &otlplogs.LogRecord{
+				TimeUnixNano:         timestampUnixNano(entry.Timestamp, detailedLog.CommonData.Timestamp),
+				ObservedTimeUnixNano: uint64(observed.UnixNano()),
+				Body:                 &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: entry.Log}},
+				Attributes:           otlpAttributes(entry.Attributes),
+			})
+		}
+		request.ResourceLogs = append(request.ResourceLogs, &otlplogs.ResourceLogs{
+			Resource: &otlpresource.Resource{Attributes: otlpAttributes(detailedLog.CommonData.Attributes)},
+			ScopeLogs: []*otlplogs.ScopeLogs{{
+				Scope: &otlpcommon.InstrumentationScope{
+					Name:    common.InstrumentationName,
+					Version: common.InstrumentationVersion,
+				},
+				LogRecords: records,
+			}},
+		})
+	}
+	return request
+}
+
+// timestampUnixNano converts the timestamp of an entry, or else the common timestamp, in milliseconds since the epoch to nanoseconds.
+// It returns zero when there is no valid timestamp.
+func timestampUnixNano(timestamps ...string) uint64 {
+	for _, timestamp := range timestamps {
+		if millis, err := strconv.ParseInt(timestamp, 10, 64); err == nil && millis > 0 && millis < math.MaxInt64/int64(time.Millisecond) {
+			return uint64(millis) * uint64(time.Millisecond)
+		}
+	}
+	return 0
+}
+
+// otlpAttributes maps attributes to OTLP key values, sorted by key.
+func otlpAttributes(attributes map[string]interface{}) []*otlpcommon.KeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keyValues := make([]*otlpcommon.KeyValue, 0, len(keys))
+	for _, key := range keys {
+		keyValues = append(keyValues, &otlpcommon.KeyValue{Key: key, Value: otlpValue(attributes[key])})
+	}
+	return keyValues
+}
+
+// otlpValue maps an attribute value to an OTLP value. Values of other types are sent as their JSON encoding.
+func otlpValue(value interface{}) *otlpcommon.AnyValue {
+	switch typed := value.(type) {
+	case nil:
+		return &otlpcommon.AnyValue{}
+	case string:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: typed}}
+	case bool:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_BoolValue{BoolValue: typed}}
+	case int:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_IntValue{IntValue: int64(typed)}}
+	case int32:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_IntValue{IntValue: int64(typed)}}
+	case int64:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_IntValue{IntValue: typed}}
+	case float64:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_DoubleValue{DoubleValue: typed}}
+	case json.Number:
+		if number, err := typed.Int64(); err == nil {
+			return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_IntValue{IntValue: number}}
+		}
+		number, _ := typed.Float64()
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_DoubleValue{DoubleValue: number}}
+	case []interface{}:
+		values := make([]*otlpcommon.AnyValue, len(typed))
+		for i, item := range typed {
+			values[i] = otlpValue(item)
+		}
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_ArrayValue{ArrayValue: &otlpcommon.ArrayValue{Values: values}}}
+	case map[string]interface{}:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_KvlistValue{KvlistValue: &otlpcommon.KeyValueList{Values: otlpAttributes(typed)}}}
+	case common.LogAttributes:
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_KvlistValue{KvlistValue: &otlpcommon.KeyValueList{Values: otlpAttributes(typed)}}}
+	default:
+		encoded, err := json.Marshal(typed)
+		if err != nil {
+			return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: fmt.Sprint(typed)}}
+		}
+		return &otlpcommon.AnyValue{Value: &otlpcommon.AnyValue_StringValue{StringValue: string(encoded)}}
+	}
+}
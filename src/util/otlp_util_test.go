@@ -0,0 +1,207 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+	otlpcommon "go.opentelemetry.io/proto/otlp/common/v1"
+	otlplogs "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpTestBatch returns a log batch with one entry with attributes of every type and one entry without timestamp.
+func otlpTestBatch() common.DetailedLogsBatch {
+	return common.DetailedLogsBatch{{
+		CommonData: common.Common{Attributes: common.LogAttributes{"logGroup": "/aws/lambda/api", "aws.accountId": "123"}},
+		Entries: common.LogData{
+			{
+				Timestamp: "1700000000123",
+				Log:       "first",
+				Attributes: common.LogAttributes{
+					"requestId": "abc",
+					"count":     3,
+					"ratio":     0.5,
+					"ok":        true,
+					"tags":      []interface{}{"a", int64(1)},
+					"nested":    map[string]interface{}{"key": "value"},
+				},
+			},
+			{Log: "second"},
+		},
+	}}
+}
+
+// TestBuildOTLPRequest tests the mapping of a log batch to OTLP resources and log records.
+func TestBuildOTLPRequest(t *testing.T) {
+	observed := time.Unix(1700000001, 0)
+	request := BuildOTLPRequest(otlpTestBatch(), observed)
+
+	assert.Len(t, request.ResourceLogs, 1)
+	resourceLogs := request.ResourceLogs[0]
+	assert.Equal(t, `[{"key":"aws.accountId","value":{"stringValue":"123"}},{"key":"logGroup","value":{"stringValue":"/aws/lambda/api"}}]`,
+		marshalKeyValues(t, resourceLogs.Resource.Attributes))
+	assert.Equal(t, common.InstrumentationName, resourceLogs.ScopeLogs[0].Scope.Name)
+
+	records := resourceLogs.ScopeLogs[0].LogRecords
+	assert.Len(t, records, 2)
+	assert.Equal(t, uint64(1700000000123000000), records[0].TimeUnixNano)
+	assert.Equal(t, uint64(observed.UnixNano()), records[0].ObservedTimeUnixNano)
+	assert.Equal(t, "first", records[0].Body.GetStringValue())
+	assert.Equal(t, `[{"key":"count","value":{"intValue":"3"}},{"key":"nested","value":{"kvlistValue":{"values":[{"key":"key","value":{"stringValue":"value"}}]}}},`+
+		`{"key":"ok","value":{"boolValue":true}},{"key":"ratio","value":{"doubleValue":0.5}},{"key":"requestId","value":{"stringValue":"abc"}},`+
+		`{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":"1"}]}}}]`,
+		marshalKeyValues(t, records[0].Attributes))
+	assert.Equal(t, uint64(0), records[1].TimeUnixNano)
+	assert.Empty(t, records[1].Attributes)
+}
+
+// marshalKeyValues encodes attributes as compact OTLP JSON.
+func marshalKeyValues(t *testing.T, attributes []*otlpcommon.KeyValue) string {
+	encoded, err := protojson.Marshal(&otlplogs.LogRecord{Attributes: attributes})
+	assert.NoError(t, err)
+	var record struct {
+		Attributes json.RawMessage `json:"attributes"`
+	}
+	assert.NoError(t, json.Unmarshal(encoded, &record))
+	var compact bytes.Buffer
+	assert.NoError(t, json.Compact(&compact, record.Attributes))
+	return compact.String()
+}
+
+// TestOTLPExporterCreateLogEntry tests the requests sent with both protocols, and the errors of unsuccessful responses.
+func TestOTLPExporterCreateLogEntry(t *testing.T) {
+	tests := []struct {
+		name          string // Test case name
+		protocol      string // Protocol of the exporter
+		status        int    // Status code of the response
+		wantErr       string // Expected error, empty if none
+		wantRetryable bool   // Whether the error is expected to be retryable
+	}{
+		{
+			name:     "Protobuf",
+			protocol: OTLPProtocolProtobuf,
+			status:   http.StatusOK,
+		},
+		{
+			name:     "JSON",
+			protocol: OTLPProtocolJSON,
+			status:   http.StatusOK,
+		},
+		{
+			name:          "Throttled",
+			protocol:      OTLPProtocolProtobuf,
+			status:        http.StatusTooManyRequests,
+			wantErr:       "429 response returned: rejected",
+			wantRetryable: true,
+		},
+		{
+			name:     "Bad request",
+			protocol: OTLPProtocolJSON,
+			status:   http.StatusBadRequest,
+			wantErr:  "400 response returned: rejected",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var received *otlplogs.LogsData
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/v1/logs", r.URL.Path)
+				assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+				assert.Equal(t, "secret", r.Header.Get("X-Token"))
+				reader, err := gzip.NewReader(r.Body)
+				assert.NoError(t, err)
+				body, err := io.ReadAll(reader)
+				assert.NoError(t, err)
+
+				received = &otlplogs.LogsData{}
+				if tc.protocol == OTLPProtocolJSON {
+					assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+					assert.NoError(t, protojson.Unmarshal(body, received))
+				} else {
+					assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+					assert.NoError(t, proto.Unmarshal(body, received))
+				}
+				w.WriteHeader(tc.status)
+				if tc.status != http.StatusOK {
+					_, _ = w.Write([]byte("rejected"))
+				}
+			}))
+			defer server.Close()
+
+			t.Setenv(common.OTLPLogsEndpoint, server.URL+"/v1/logs")
+			t.Setenv(common.OTLPLogsProtocol, tc.protocol)
+			t.Setenv(common.OTLPLogsHeaders, "X-Token=secret")
+			exporter, err := NewOTLPExporter()
+			assert.NoError(t, err)
+
+			err = exporter.CreateLogEntry(otlpTestBatch())
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				assert.Equal(t, tc.wantRetryable, IsRetryableSendError(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, received.ResourceLogs[0].ScopeLogs[0].LogRecords, 2)
+		})
+	}
+}
+
+// TestNewOTLPExporter tests the endpoint and headers of the exporter, and the validation of its configuration.
+func TestNewOTLPExporter(t *testing.T) {
+	exporter, err := newOTLPExporter("EU", "license")
+	assert.NoError(t, err)
+	assert.Equal(t, common.OTLPEndpointEU, exporter.endpoint)
+	assert.Equal(t, OTLPProtocolProtobuf, exporter.protocol)
+	assert.Equal(t, map[string]string{"api-key": "license"}, exporter.headers)
+
+	// The license key is not sent to other endpoints.
+	t.Setenv(common.OTLPLogsEndpoint, "https://collector.example.com:4318/v1/logs")
+	exporter, err = newOTLPExporter("US", "license")
+	assert.NoError(t, err)
+	assert.Empty(t, exporter.headers)
+
+	_, err = newOTLPExporter("Mars", "")
+	assert.EqualError(t, err, `unknown New Relic region "Mars", expected US, EU or FedRAMP`, "the region is validated with a configured endpoint")
+
+	t.Setenv(common.OTLPLogsEndpoint, "")
+	exporter, err = newOTLPExporter("fedramp", "license")
+	assert.NoError(t, err)
+	assert.Equal(t, common.OTLPEndpointFedRAMP, exporter.endpoint)
+
+	t.Setenv(common.OTLPLogsProtocol, "grpc")
+	_, err = newOTLPExporter("US", "")
+	assert.EqualError(t, err, "unsupported OTLP protocol \"grpc\", expected http/protobuf or http/json")
+}
+
+// TestParseOTLPHeaders tests the parsing of headers in the OTEL_EXPORTER_OTLP_HEADERS format.
+func TestParseOTLPHeaders(t *testing.T) {
+	headers, err := ParseOTLPHeaders("api-key=abc, Authorization=Basic%20dXNlcg%3D%3D")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"api-key": "abc", "authorization": "Basic dXNlcg=="}, headers)
+
+	_, err = ParseOTLPHeaders("invalid")
+	assert.EqualError(t, err, "invalid OTLP header \"invalid\", expected key=value")
+}
+
+// TestNewLogsClient tests the selection of the exporter.
+func TestNewLogsClient(t *testing.T) {
+	t.Setenv(common.LogsExporter, "kafka")
+	_, err := NewLogsClient()
+	assert.EqualError(t, err, "unknown logs exporter \"kafka\", expected logs_api or otlp")
+
+	t.Setenv(common.LogsExporter, ExporterOTLP)
+	t.Setenv(common.OTLPLogsEndpoint, "http://localhost:4318/v1/logs")
+	client, err := NewLogsClient()
+	assert.NoError(t, err)
+	assert.IsType(t, &OTLPExporter{}, client)
+}
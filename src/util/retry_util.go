@@ -0,0 +1,279 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	nrErrors "github.com/newrelic/newrelic-client-go/v2/pkg/errors"
+)
+
+// statusCodeRegex matches the status code in the errors returned by the New Relic client for unexpected responses.
+var statusCodeRegex = regexp.MustCompile(`^(\d{3}) response returned`)
+
+// ErrInvalidLogEntry is returned by clients given a log entry they cannot send. It is not retryable.
+var ErrInvalidLogEntry = errors.New("invalid log entry")
+
+// HTTPStatusError is the error of a request answered with an unsuccessful status code by an endpoint other than the Log API.
+type HTTPStatusError struct {
+	StatusCode int       // StatusCode is the status code of the response.
+	Body       string    // Body is the beginning of the body of the response.
+	NotBefore  time.Time // NotBefore is the time before which the endpoint asked the client not to retry, zero when it did not.
+}
+
+// Error returns the status code and the body of the response.
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%d response returned: %s", e.StatusCode, e.Body)
+}
+
+// RetryPolicy defines how often and how long to wait before a failed batch is sent again.
+type RetryPolicy struct {
+	MaxAttempts    int           // MaxAttempts is the maximum number of attempts, including the first one.
+	BaseDelay      time.Duration // BaseDelay is the delay before the first retry, doubled for every following retry.
+	MaxDelay       time.Duration // MaxDelay is the maximum delay between two attempts.
+	AttemptTimeout time.Duration // AttemptTimeout is the longest an attempt may take, a retry is only made if it can end before the deadline.
+}
+
+// SendError is the error of a batch that could not be sent to New Relic.
+type SendError struct {
+	Err       error                    // Err is the error of the last attempt.
+	Attempts  int                      // Attempts is the number of attempts made.
+	Permanent bool                     // Permanent is true when the error is not retryable.
+	Batch     common.DetailedLogsBatch // Batch holds the logs that were not sent, fewer than the batch when it was sent in part.
+}
+
+// Error returns the error message of the last attempt along with the number of attempts.
+func (e *SendError) Error() string {
+	if e.Permanent {
+		return fmt.Sprintf("permanent error sending log batch after %d attempt(s): %v", e.Attempts, e.Err)
+	}
+	return fmt.Sprintf("error sending log batch after %d attempt(s): %v", e.Attempts, e.Err)
+}
+
+// Unwrap returns the error of the last attempt.
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// PartialSendError is returned by clients sending a batch to several destinations when only some of them failed.
+// Sending the batch again would duplicate the logs in the destinations that accepted them, so SendWithRetry retries
+// with Resend, which sends Unsent to the destinations that failed only.
+type PartialSendError struct {
+	Err    error                           // Err joins the errors of the destinations that failed.
+	Unsent common.DetailedLogsBatch        // Unsent holds the logs of the destinations that failed.
+	Resend func(ctx context.Context) error // Resend sends Unsent again to the destinations that failed.
+}
+
+// Error returns the errors of the destinations that failed.
+func (e *PartialSendError) Error() string {
+	return fmt.Sprintf("log batch sent in part: %v", e.Err)
+}
+
+// Unwrap returns the errors of the destinations that failed.
+func (e *PartialSendError) Unwrap() error {
+	return e.Err
+}
+
+// NewRetryPolicy creates the RetryPolicy of the function, reading the maximum number of attempts from NR_RETRY_MAX_ATTEMPTS.
+// An attempt sends a single request, so it takes at most the HTTP timeout.
+func NewRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    positiveIntFromEnv(common.RetryMaxAttempts, common.DefaultRetryMaxAttempts),
+		BaseDelay:      common.RetryBaseDelay,
+		MaxDelay:       common.RetryMaxDelay,
+		AttemptTimeout: httpTimeout(),
+	}
+}
+
+// SendWithRetry sends a log batch to New Relic, retrying retryable errors with jittered exponential backoff.
+// The delay before a retry is at least the Retry-After time the endpoints of the failed attempt asked for, see HTTPStatusError.
+// It gives up without waiting when the next attempt, delay and attempt timeout included, would not end before the deadline of the context,
+// and as soon as the context is done, which also cancels the request of the attempt in progress.
+// Once an attempt is sent in part, see PartialSendError, only the logs that were not sent are retried and reported in the SendError.
+func SendWithRetry(ctx context.Context, nrClientAPI NewRelicClientAPI, batch common.DetailedLogsBatch, policy RetryPolicy) error {
+	send := func(ctx context.Context) error { return createLogEntry(ctx, nrClientAPI, batch) }
+	for attempt := 1; ; attempt++ {
+		err := send(ctx)
+		if err == nil {
+			return nil
+		}
+		// Only the PartialSendError of the client itself is looked at, the one of a nested client covers part of the attempt only.
+		if partial, ok := err.(*PartialSendError); ok {
+			send, batch = partial.Resend, partial.Unsent
+		}
+		// An attempt ended by the deadline of the caller is not retried, nor is it a permanent error of the batch.
+		if ctx.Err() != nil {
+			return &SendError{Err: errors.Join(err, ctx.Err()), Attempts: attempt, Batch: batch}
+		}
+		if !IsRetryableSendError(err) {
+			return &SendError{Err: err, Attempts: attempt, Permanent: true, Batch: batch}
+		}
+		if attempt >= policy.MaxAttempts {
+			return &SendError{Err: err, Attempts: attempt, Batch: batch}
+		}
+
+		delay := policy.delay(attempt, retryNotBefore(err))
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay+policy.AttemptTimeout).After(deadline) {
+			return &SendError{Err: fmt.Errorf("no time left to retry before the deadline: %w", err), Attempts: attempt, Batch: batch}
+		}
+		log.Warnf("error sending log batch, retrying in %v (attempt %d of %d): %v", delay, attempt, policy.MaxAttempts, err)
+		MetricsFromContext(ctx).Count(MetricSendRetries, 1, batchDimensions(batch))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return &SendError{Err: errors.Join(err, ctx.Err()), Attempts: attempt, Batch: batch}
+		}
+	}
+}
+
+// delay returns the jittered exponential backoff before the given retry, or the time left until notBefore if it is longer.
+func (p RetryPolicy) delay(attempt int, notBefore time.Time) time.Duration {
+	backoff := p.MaxDelay
+	if shift := attempt - 1; shift < 32 {
+		backoff = min(p.BaseDelay<<shift, p.MaxDelay)
+	}
+	// Full jitter spreads the retries of concurrent workers.
+	delay := time.Duration(rand.Int64N(int64(backoff) + 1))
+
+	if time.Until(notBefore) > delay {
+		delay = time.Until(notBefore)
+	}
+	return delay
+}
+
+// retryNotBefore returns the latest time before which the endpoints that answered the requests of a failed attempt
+// asked not to be retried. Errors joined by clients sending to several endpoints are all looked at.
+func retryNotBefore(err error) time.Time {
+	switch e := err.(type) {
+	case *HTTPStatusError:
+		return e.NotBefore
+	case interface{ Unwrap() []error }:
+		var notBefore time.Time
+		for _, joined := range e.Unwrap() {
+			if joinedNotBefore := retryNotBefore(joined); joinedNotBefore.After(notBefore) {
+				notBefore = joinedNotBefore
+			}
+		}
+		return notBefore
+	case interface{ Unwrap() error }:
+		return retryNotBefore(e.Unwrap())
+	}
+	return time.Time{}
+}
+
+// IsRetryableSendError checks whether an error returned by NewRelicClientAPI.CreateLogEntry is worth retrying.
+// Throttling (429), server errors (5xx) and network errors, timeouts included, are retryable. Other client errors, such as
+// an invalid payload (400), invalid credentials (401, 403) or a payload too large (413), are permanent.
+// Whether the deadline of the caller has passed is not told by the error, since the timeout of an HTTP client is also
+// reported as context.DeadlineExceeded; SendWithRetry checks its context instead.
+func IsRetryableSendError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrInvalidLogEntry) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var invalidInput *nrErrors.InvalidInput
+	var notFound *nrErrors.NotFound
+	if errors.As(err, &invalidInput) || errors.As(err, &notFound) || IsCredentialError(err) {
+		return false
+	}
+
+	if statusCode, ok := sendStatusCode(err); ok {
+		return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+	}
+
+	// Network errors are transient.
+	return true
+}
+
+// IsCredentialError checks whether an error returned by NewRelicClientAPI.CreateLogEntry is caused by the credentials or
+// the account (401, 402, 403) rather than by the log entry, so that the entry may be accepted once they are fixed.
+func IsCredentialError(err error) bool {
+	var unauthorized *nrErrors.UnauthorizedError
+	var paymentRequired *nrErrors.PaymentRequiredError
+	if errors.As(err, &unauthorized) || errors.As(err, &paymentRequired) {
+		return true
+	}
+	statusCode, ok := sendStatusCode(err)
+	return ok && (statusCode == http.StatusUnauthorized || statusCode == http.StatusPaymentRequired || statusCode == http.StatusForbidden)
+}
+
+// sendStatusCode returns the status code of the response an error returned by NewRelicClientAPI.CreateLogEntry was built from.
+func sendStatusCode(err error) (int, bool) {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode, true
+	}
+
+	var unexpectedStatus *nrErrors.UnexpectedStatusCode
+	if errors.As(err, &unexpectedStatus) {
+		match := statusCodeRegex.FindStringSubmatch(unexpectedStatus.Error())
+		if match == nil {
+			return 0, false
+		}
+		statusCode, _ := strconv.Atoi(match[1])
+		return statusCode, true
+	}
+	return 0, false
+}
+
+// retryAfterTransport is an http.RoundTripper recording the Retry-After header of throttled and unavailable responses,
+// and the bytes of the requests accepted by New Relic for the metrics of the forwarder.
+// Every client has its own transport, so that the Retry-After time of an endpoint, shared by the sender workers
+// using the client, does not delay the retries to other endpoints or accounts.
+type retryAfterTransport struct {
+	next           http.RoundTripper
+	countSentBytes bool         // countSentBytes is true for the clients sending logs to New Relic.
+	notBefore      atomic.Int64 // notBefore is the Unix time in nanoseconds before which the endpoint asked not to be retried.
+}
+
+// RoundTrip sends the request and records the Retry-After header of the response.
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && t.countSentBytes && resp.StatusCode >= 200 && resp.StatusCode <= 299 && req.ContentLength > 0 {
+		sentBytes.Add(req.ContentLength)
+	}
+	if err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			t.notBefore.Store(time.Now().Add(retryAfter).UnixNano())
+		}
+	}
+	return resp, err
+}
+
+// retryNotBefore returns the time before which the endpoint asked not to be retried, zero when it did not.
+func (t *retryAfterTransport) retryNotBefore() time.Time {
+	if t == nil || t.notBefore.Load() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, t.notBefore.Load())
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
@@ -0,0 +1,198 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	nrErrors "github.com/newrelic/newrelic-client-go/v2/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// testRetryPolicy is a RetryPolicy with short delays for tests.
+var testRetryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+// TestIsRetryableSendError tests the classification of the errors returned by the New Relic client.
+func TestIsRetryableSendError(t *testing.T) {
+	tests := []struct {
+		name     string // Test case name
+		err      error  // Error returned by the client
+		expected bool   // Whether the error is expected to be retryable
+	}{
+		{name: "Too many requests", err: nrErrors.NewUnexpectedStatusCode(429, ""), expected: true},
+		{name: "Service unavailable", err: nrErrors.NewUnexpectedStatusCode(503, "unavailable"), expected: true},
+		{name: "Bad request", err: nrErrors.NewUnexpectedStatusCode(400, "invalid payload"), expected: false},
+		{name: "Forbidden", err: nrErrors.NewUnexpectedStatusCode(403, ""), expected: false},
+		{name: "Payload too large", err: nrErrors.NewUnexpectedStatusCode(413, ""), expected: false},
+		{name: "Unauthorized", err: nrErrors.NewUnauthorizedError(), expected: false},
+		{name: "Retries exhausted in the client", err: nrErrors.NewMaxRetriesReached("too many requests"), expected: true},
+		{name: "Network error", err: errors.New("dial tcp: connection refused"), expected: true},
+		{name: "HTTP client timeout", err: &url.Error{Op: "Post", URL: "https://log-api.newrelic.com/log/v1", Err: context.DeadlineExceeded}, expected: true},
+		{name: "Canceled", err: context.Canceled, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, IsRetryableSendError(tt.err))
+		})
+	}
+}
+
+// TestSendWithRetry tests retrying failed batches until they are sent, a permanent error occurs or the attempts are exhausted.
+func TestSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name             string  // Test case name
+		errs             []error // Errors returned by the successive attempts
+		expectedAttempts int     // Expected number of attempts
+		expectPermanent  bool    // Whether a permanent error is expected
+		expectError      bool    // Whether an error is expected
+	}{
+		{
+			name:             "Sent after retries",
+			errs:             []error{nrErrors.NewUnexpectedStatusCode(503, ""), nrErrors.NewUnexpectedStatusCode(429, ""), nil},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "Permanent error",
+			errs:             []error{nrErrors.NewUnexpectedStatusCode(413, "")},
+			expectedAttempts: 1,
+			expectPermanent:  true,
+			expectError:      true,
+		},
+		{
+			name:             "Attempts exhausted",
+			errs:             []error{errors.New("network error"), errors.New("network error"), errors.New("network error")},
+			expectedAttempts: 3,
+			expectError:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockNRClient := new(MockNRClient)
+			for _, err := range tt.errs {
+				mockNRClient.On("CreateLogEntry", mock.Anything).Return(err).Once()
+			}
+
+			err := SendWithRetry(context.Background(), mockNRClient, common.DetailedLogsBatch{}, testRetryPolicy)
+
+			mockNRClient.AssertNumberOfCalls(t, "CreateLogEntry", tt.expectedAttempts)
+			if !tt.expectError {
+				assert.NoError(t, err)
+				return
+			}
+			var sendErr *SendError
+			assert.ErrorAs(t, err, &sendErr)
+			assert.Equal(t, tt.expectedAttempts, sendErr.Attempts)
+			assert.Equal(t, tt.expectPermanent, sendErr.Permanent)
+		})
+	}
+}
+
+// TestSendWithRetryDeadline verifies that no retry is attempted when it would start after the deadline.
+func TestSendWithRetryDeadline(t *testing.T) {
+	mockNRClient := new(MockNRClient)
+	mockNRClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnexpectedStatusCode(503, ""))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Minute, MaxDelay: time.Minute}
+
+	// The full jitter may pick a short delay, so give up on the first attempt whose delay passes the deadline.
+	start := time.Now()
+	err := SendWithRetry(ctx, mockNRClient, common.DetailedLogsBatch{}, policy)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+// TestSendWithRetryAttemptTimeout verifies that no retry is attempted when it could not end before the deadline.
+func TestSendWithRetryAttemptTimeout(t *testing.T) {
+	mockNRClient := new(MockNRClient)
+	mockNRClient.On("CreateLogEntry", mock.Anything).Return(nrErrors.NewUnexpectedStatusCode(503, ""))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	policy := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, AttemptTimeout: time.Minute}
+
+	err := SendWithRetry(ctx, mockNRClient, common.DetailedLogsBatch{}, policy)
+	assert.ErrorContains(t, err, "no time left to retry before the deadline")
+	mockNRClient.AssertNumberOfCalls(t, "CreateLogEntry", 1)
+}
+
+// TestSendWithRetryContextDone verifies that an attempt ended by the deadline of the caller is neither retried nor permanent.
+func TestSendWithRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mockNRClient := new(MockNRClient)
+	mockNRClient.On("CreateLogEntry", mock.Anything).Run(func(mock.Arguments) { cancel() }).
+		Return(&url.Error{Op: "Post", URL: "https://log-api.newrelic.com/log/v1", Err: context.DeadlineExceeded})
+
+	err := SendWithRetry(ctx, mockNRClient, common.DetailedLogsBatch{}, testRetryPolicy)
+	var sendErr *SendError
+	assert.ErrorAs(t, err, &sendErr)
+	assert.False(t, sendErr.Permanent)
+	assert.ErrorIs(t, err, context.Canceled)
+	mockNRClient.AssertNumberOfCalls(t, "CreateLogEntry", 1)
+}
+
+// TestRetryAfterTransport verifies that the Retry-After header of a throttled response delays the retries of the client
+// that received it only.
+func TestRetryAfterTransport(t *testing.T) {
+	throttled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer throttled.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	throttledSink, err := NewHTTPSink(throttled.URL, nil, false)
+	assert.NoError(t, err)
+	unavailableSink, err := NewHTTPSink(unavailable.URL, nil, false)
+	assert.NoError(t, err)
+
+	throttledErr := throttledSink.CreateLogEntry(common.DetailedLogsBatch{})
+	unavailableErr := unavailableSink.CreateLogEntry(common.DetailedLogsBatch{})
+
+	delay := testRetryPolicy.delay(1, retryNotBefore(throttledErr))
+	assert.Greater(t, delay, time.Second)
+	assert.LessOrEqual(t, delay, 2*time.Second)
+	assert.LessOrEqual(t, testRetryPolicy.delay(1, retryNotBefore(unavailableErr)), testRetryPolicy.MaxDelay)
+
+	// The Retry-After time is found in the errors joined by clients sending to several endpoints.
+	assert.Equal(t, retryNotBefore(throttledErr), retryNotBefore(errors.Join(unavailableErr, fmt.Errorf("sink: %w", throttledErr))))
+}
+
+// TestParseRetryAfter tests parsing Retry-After headers in seconds and as HTTP dates.
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string        // Test case name
+		value    string        // Value of the Retry-After header
+		expected time.Duration // Expected delay
+		ok       bool          // Whether the value is expected to be valid
+	}{
+		{name: "Seconds", value: "120", expected: 2 * time.Minute, ok: true},
+		{name: "HTTP date", value: "Mon, 01 Jan 2024 00:00:30 GMT", expected: 30 * time.Second, ok: true},
+		{name: "HTTP date in the past", value: "Sun, 31 Dec 2023 23:00:00 GMT", expected: 0, ok: true},
+		{name: "Empty", value: "", ok: false},
+		{name: "Invalid", value: "soon", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := parseRetryAfter(tt.value, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, delay)
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// Destination is a New Relic account logs are routed to.
+type Destination struct {
+	Name                 string `json:"Name"`                 // Name of the destination, referenced by routing rules
+	LicenseKeySecretName string `json:"LicenseKeySecretName"` // Name of the Secrets Manager secret holding the license key of the account in its LicenseKey field
+	Region               string `json:"Region"`               // Region of the account, US, EU or FedRAMP, NEW_RELIC_REGION when not set
+}
+
+// RoutingRule sends the logs of the sources it matches to a destination.
+// A rule scoped by LogGroupPrefix or by BucketName and KeyPrefix matches the logs of those sources,
+// a rule with Attributes matches the logs whose common attributes have all the given values.
+// A rule with both a scope and attributes matches the logs matching both.
+type RoutingRule struct {
+	SourceScope
+	Attributes  map[string]string `json:"Attributes"`  // Values of the common attributes the rule applies to
+	Destination string            `json:"Destination"` // Name of the destination of the logs
+}
+
+// Matches checks whether the rule applies to logs with the given common attributes.
+func (rule RoutingRule) Matches(attributes common.LogAttributes) bool {
+	if rule.LogGroupPrefix != "" || rule.BucketName != "" {
+		logGroup, _ := attributes["logGroup"].(string)
+		bucketName, _ := attributes["logBucketName"].(string)
+		objectKey, _ := attributes["logObjectKey"].(string)
+		if !rule.MatchesLogGroup(logGroup) && !(bucketName != "" && rule.MatchesObject(bucketName, objectKey)) {
+			return false
+		}
+	}
+	for name, value := range rule.Attributes {
+		if attributes[name] == nil || fmt.Sprint(attributes[name]) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRoutingConfig parses the destinations and routing rules, and checks that every rule has a scope
+// or attributes, that every destination has a license key secret and a known region,
+// and that every rule routes to a configured destination or to the default one.
+func ParseRoutingConfig(destinationsJSON string, rulesJSON string) (map[string]Destination, []RoutingRule, error) {
+	var destinationList []Destination
+	if destinationsJSON != "" {
+		if err := json.Unmarshal([]byte(destinationsJSON), &destinationList); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal destinations: %w", err)
+		}
+	}
+	destinations := map[string]Destination{}
+	for _, destination := range destinationList {
+		if destination.Name == "" || destination.LicenseKeySecretName == "" {
+			return nil, nil, fmt.Errorf("destination %q needs a Name and a LicenseKeySecretName", destination.Name)
+		}
+		if regionName := destination.regionName(); regionName != "" {
+			if _, _, err := parseRegion(regionName); err != nil {
+				return nil, nil, fmt.Errorf("destination %q has an invalid region: %w", destination.Name, err)
+			}
+		}
+		if _, duplicate := destinations[destination.Name]; duplicate {
+			return nil, nil, fmt.Errorf("destination %q is defined twice", destination.Name)
+		}
+		destinations[destination.Name] = destination
+	}
+
+	var rules []RoutingRule
+	if rulesJSON != "" {
+		if err := json.Unmarshal([]byte(rulesJSON), &rules); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal routing rules: %w", err)
+		}
+	}
+	for _, rule := range rules {
+		if rule.LogGroupPrefix == "" && rule.BucketName == "" && len(rule.Attributes) == 0 {
+			return nil, nil, fmt.Errorf("routing rule to %q has neither a scope nor attributes", rule.Destination)
+		}
+		if _, ok := destinations[rule.Destination]; !ok && rule.Destination != common.DefaultDestination {
+			return nil, nil, fmt.Errorf("routing rule routes to unknown destination %q", rule.Destination)
+		}
+	}
+	return destinations, rules, nil
+}
+
+// regionName returns the region of the destination, or the region of the forwarder when it is not set.
+func (destination Destination) regionName() string {
+	if destination.Region != "" {
+		return destination.Region
+	}
+	return os.Getenv(common.NewRelicRegion)
+}
+
+// Router is a NewRelicClientAPI sending every log batch to the destination of the first routing rule
+// matching its common attributes, and the batches no rule matches to the default client.
+// The clients of the destinations are created when they are first used and reused by later invocations.
+type Router struct {
+	defaultClient NewRelicClientAPI
+	destinations  map[string]Destination
+	rules         []RoutingRule
+	newClient     func(Destination) (NewRelicClientAPI, error)
+	clients       struct {
+		sync.Mutex
+		byName map[string]NewRelicClientAPI
+	}
+}
+
+// NewRouter creates a Router from the destinations in NR_DESTINATIONS and the rules in NR_ROUTING_RULES,
+// with the default client as the catch-all destination. A destination named "default" replaces the default client.
+// It returns the default client itself when no routing rule is configured.
+func NewRouter(defaultClient NewRelicClientAPI) (NewRelicClientAPI, error) {
+	destinations, rules, err := ParseRoutingConfig(os.Getenv(common.NRDestinations), os.Getenv(common.NRRoutingRules))
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 && len(destinations) == 0 {
+		return defaultClient, nil
+	}
+	return newRouter(defaultClient, destinations, rules, newDestinationClient), nil
+}
+
+// newRouter creates a Router creating the clients of the destinations with newClient.
+func newRouter(defaultClient NewRelicClientAPI, destinations map[string]Destination, rules []RoutingRule, newClient func(Destination) (NewRelicClientAPI, error)) *Router {
+	router := &Router{
+		defaultClient: defaultClient,
+		destinations:  destinations,
+		rules:         rules,
+		newClient:     newClient,
+	}
+	router.clients.byName = map[string]NewRelicClientAPI{}
+	return router
+}
+
+// Route returns the name of the destination of logs with the given common attributes.
+func (r *Router) Route(attributes common.LogAttributes) string {
+	for _, rule := range r.rules {
+		if rule.Matches(attributes) {
+			return rule.Destination
+		}
+	}
+	return common.DefaultDestination
+}
+
+// CreateLogEntry sends the logs of a batch to their destinations.
+// The logs of a batch are grouped by destination so that every destination receives a single request.
+// When only some destinations fail, it returns a *PartialSendError holding the logs of those destinations.
+func (r *Router) CreateLogEntry(logEntry interface{}) error {
+	return r.CreateLogEntryWithContext(context.Background(), logEntry)
+}
+
+// CreateLogEntryWithContext sends the logs of a batch to their destinations like CreateLogEntry, passing the context to their clients.
+func (r *Router) CreateLogEntryWithContext(ctx context.Context, logEntry interface{}) error {
+	batch, ok := logEntry.(common.DetailedLogsBatch)
+	if !ok {
+		return r.send(ctx, common.DefaultDestination, logEntry)
+	}
+
+	var names []string
+	routed := map[string]common.DetailedLogsBatch{}
+	for _, detailedLog := range batch {
+		name := r.Route(detailedLog.CommonData.Attributes)
+		if _, ok := routed[name]; !ok {
+			names = append(names, name)
+		}
+		routed[name] = append(routed[name], detailedLog)
+	}
+
+	var errs []error
+	var unsent common.DetailedLogsBatch
+	for _, name := range names {
+		if err := r.send(ctx, name, routed[name]); err != nil {
+			errs = append(errs, err)
+			unsent = append(unsent, routed[name]...)
+		}
+	}
+	if len(errs) == 0 || len(errs) == len(names) {
+		return errors.Join(errs...)
+	}
+	// Routing is deterministic, so the logs that were not sent are routed again to the destinations that failed only.
+	return &PartialSendError{
+		Err:    errors.Join(errs...),
+		Unsent: unsent,
+		Resend: func(ctx context.Context) error { return r.CreateLogEntryWithContext(ctx, unsent) },
+	}
+}
+
+// send sends logs to the named destination.
+func (r *Router) send(ctx context.Context, name string, logEntry interface{}) error {
+	client, err := r.client(name)
+	if err != nil {
+		return err
+	}
+	if err := createLogEntry(ctx, client, logEntry); err != nil {
+		if name == common.DefaultDestination {
+			return err
+		}
+		return fmt.Errorf("destination %s: %w", name, err)
+	}
+	return nil
+}
+
+// client returns the client of the named destination, creating it on first use.
+func (r *Router) client(name string) (NewRelicClientAPI, error) {
+	destination, ok := r.destinations[name]
+	if !ok {
+		return r.defaultClient, nil
+	}
+
+	r.clients.Lock()
+	defer r.clients.Unlock()
+	if client, ok := r.clients.byName[name]; ok {
+		return client, nil
+	}
+	client, err := r.newClient(destination)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client of destination %s: %w", name, err)
+	}
+	r.clients.byName[name] = client
+	return client, nil
+}
+
+// newDestinationClient creates a client of the selected exporter with the license key and region of the destination.
+func newDestinationClient(destination Destination) (NewRelicClientAPI, error) {
+	secretsManagerClient, err := NewSecretsManagerClient()
+	if err != nil {
+		return nil, err
+	}
+	secretMap, err := GetSecretFromSecretManager(context.TODO(), secretsManagerClient, destination.LicenseKeySecretName)
+	if err != nil {
+		return nil, err
+	}
+	if secretMap[common.LicenseKey] == "" {
+		return nil, fmt.Errorf("either LicenseKey is empty or not present in secret %s", destination.LicenseKeySecretName)
+	}
+	return newExporterClient(destination.regionName(), secretMap[common.LicenseKey])
+}
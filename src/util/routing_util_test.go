@@ -0,0 +1,181 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseRoutingConfig tests the validation of the destinations and routing rules.
+func TestParseRoutingConfig(t *testing.T) {
+	tests := []struct {
+		name             string // Test case name
+		destinationsJSON string // Destinations to parse
+		rulesJSON        string // Routing rules to parse
+		expectedRules    int    // Expected number of rules
+		wantErr          string // Expected error, empty if none
+	}{
+		{
+			name: "No routing",
+		},
+		{
+			name:             "Valid routing",
+			destinationsJSON: `[{"Name": "team-a", "LicenseKeySecretName": "team-a-key", "Region": "EU"}]`,
+			rulesJSON:        `[{"LogGroupPrefix": "/aws/lambda/team-a", "Destination": "team-a"}, {"Attributes": {"team": "b"}, "Destination": "default"}]`,
+			expectedRules:    2,
+		},
+		{
+			name:             "Unknown region",
+			destinationsJSON: `[{"Name": "team-a", "LicenseKeySecretName": "team-a-key", "Region": "Mars"}]`,
+			wantErr:          `destination "team-a" has an invalid region`,
+		},
+		{
+			name:             "Destination without license key secret",
+			destinationsJSON: `[{"Name": "team-a"}]`,
+			wantErr:          `destination "team-a" needs a Name and a LicenseKeySecretName`,
+		},
+		{
+			name:             "Duplicate destination",
+			destinationsJSON: `[{"Name": "team-a", "LicenseKeySecretName": "a"}, {"Name": "team-a", "LicenseKeySecretName": "b"}]`,
+			wantErr:          `destination "team-a" is defined twice`,
+		},
+		{
+			name:      "Rule routing to an unknown destination",
+			rulesJSON: `[{"BucketName": "logs", "Destination": "team-c"}]`,
+			wantErr:   `routing rule routes to unknown destination "team-c"`,
+		},
+		{
+			name:      "Rule without scope or attributes",
+			rulesJSON: `[{"Destination": "default"}]`,
+			wantErr:   `routing rule to "default" has neither a scope nor attributes`,
+		},
+		{
+			name:      "Invalid JSON",
+			rulesJSON: `[{`,
+			wantErr:   "failed to unmarshal routing rules",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, rules, err := ParseRoutingConfig(tc.destinationsJSON, tc.rulesJSON)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, rules, tc.expectedRules)
+		})
+	}
+}
+
+// TestRouterCreateLogEntry tests that batches are sent to the destination of the first matching rule, and to the default client otherwise.
+func TestRouterCreateLogEntry(t *testing.T) {
+	destinations, rules, err := ParseRoutingConfig(
+		`[{"Name": "team-a", "LicenseKeySecretName": "team-a-key"}, {"Name": "team-b", "LicenseKeySecretName": "team-b-key"}]`,
+		`[{"LogGroupPrefix": "/aws/lambda/team-a", "Destination": "team-a"},
+		  {"BucketName": "logs", "KeyPrefix": "team-b/", "Destination": "team-b"},
+		  {"Attributes": {"team": "b", "aws.accountId": "123"}, "Destination": "team-b"}]`)
+	assert.NoError(t, err)
+
+	defaultClient := new(MockNRClient)
+	clients := map[string]*MockNRClient{"team-a": new(MockNRClient), "team-b": new(MockNRClient)}
+	created := 0
+	router := newRouter(defaultClient, destinations, rules, func(destination Destination) (NewRelicClientAPI, error) {
+		created++
+		return clients[destination.Name], nil
+	})
+
+	teamA := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"logGroup": "/aws/lambda/team-a-api"}}}
+	teamBObject := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"logBucketName": "logs", "logObjectKey": "team-b/app.log"}}}
+	teamBAttributes := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"team": "b", "aws.accountId": "123"}}}
+	unmatched := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"logBucketName": "logs", "logObjectKey": "team-c/app.log", "team": "b"}}}
+
+	clients["team-a"].On("CreateLogEntry", common.DetailedLogsBatch{teamA}).Return(nil).Twice()
+	clients["team-b"].On("CreateLogEntry", common.DetailedLogsBatch{teamBObject, teamBAttributes}).Return(nil).Once()
+	defaultClient.On("CreateLogEntry", common.DetailedLogsBatch{unmatched}).Return(errors.New("throttled")).Once()
+
+	assert.NoError(t, router.CreateLogEntry(common.DetailedLogsBatch{teamA}))
+	assert.NoError(t, router.CreateLogEntry(common.DetailedLogsBatch{teamA}))
+	err = router.CreateLogEntry(common.DetailedLogsBatch{teamBObject, unmatched, teamBAttributes})
+	var partial *PartialSendError
+	assert.ErrorAs(t, err, &partial)
+	assert.EqualError(t, partial.Err, "throttled")
+	assert.Equal(t, common.DetailedLogsBatch{unmatched}, partial.Unsent)
+
+	defaultClient.AssertExpectations(t)
+	clients["team-a"].AssertExpectations(t)
+	clients["team-b"].AssertExpectations(t)
+	// Clients are created once per destination.
+	assert.Equal(t, 2, created)
+}
+
+// TestRouterPartialSend tests that only the logs of the destinations that failed are retried and reported as not sent.
+func TestRouterPartialSend(t *testing.T) {
+	destinations, rules, err := ParseRoutingConfig(
+		`[{"Name": "team-a", "LicenseKeySecretName": "team-a-key"}, {"Name": "team-b", "LicenseKeySecretName": "team-b-key"}]`,
+		`[{"Attributes": {"team": "a"}, "Destination": "team-a"}, {"Attributes": {"team": "b"}, "Destination": "team-b"}]`)
+	assert.NoError(t, err)
+
+	defaultClient := new(MockNRClient)
+	clients := map[string]*MockNRClient{"team-a": new(MockNRClient), "team-b": new(MockNRClient)}
+	router := newRouter(defaultClient, destinations, rules, func(destination Destination) (NewRelicClientAPI, error) {
+		return clients[destination.Name], nil
+	})
+
+	teamA := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"team": "a"}}}
+	teamB := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"team": "b"}}}
+	unmatched := common.DetailedLog{CommonData: common.Common{Attributes: common.LogAttributes{"team": "c"}}}
+
+	// team-a accepts its logs once, team-b is throttled on every attempt and the default client on the first one only.
+	clients["team-a"].On("CreateLogEntry", common.DetailedLogsBatch{teamA}).Return(nil).Once()
+	clients["team-b"].On("CreateLogEntry", common.DetailedLogsBatch{teamB}).Return(errors.New("503 response returned")).Times(3)
+	defaultClient.On("CreateLogEntry", common.DetailedLogsBatch{unmatched}).Return(errors.New("429 response returned")).Once()
+	defaultClient.On("CreateLogEntry", common.DetailedLogsBatch{unmatched}).Return(nil).Once()
+
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	err = SendWithRetry(context.Background(), router, common.DetailedLogsBatch{teamA, teamB, unmatched}, policy)
+
+	var sendErr *SendError
+	assert.ErrorAs(t, err, &sendErr)
+	assert.Equal(t, 3, sendErr.Attempts)
+	assert.Equal(t, common.DetailedLogsBatch{teamB}, sendErr.Batch)
+	defaultClient.AssertExpectations(t)
+	clients["team-a"].AssertExpectations(t)
+	clients["team-b"].AssertExpectations(t)
+}
+
+// TestRouterClientError tests that a destination whose client cannot be created fails its batches.
+func TestRouterClientError(t *testing.T) {
+	destinations, rules, err := ParseRoutingConfig(
+		`[{"Name": "team-a", "LicenseKeySecretName": "team-a-key"}]`,
+		`[{"LogGroupPrefix": "/aws/lambda/", "Destination": "team-a"}]`)
+	assert.NoError(t, err)
+
+	router := newRouter(new(MockNRClient), destinations, rules, func(Destination) (NewRelicClientAPI, error) {
+		return nil, errors.New("secret not found")
+	})
+	batch := common.DetailedLogsBatch{{CommonData: common.Common{Attributes: common.LogAttributes{"logGroup": "/aws/lambda/api"}}}}
+	assert.EqualError(t, router.CreateLogEntry(batch), "failed to create client of destination team-a: secret not found")
+}
+
+// TestNewRouter tests that the default client is used as is when no routing is configured.
+func TestNewRouter(t *testing.T) {
+	defaultClient := new(MockNRClient)
+	client, err := NewRouter(defaultClient)
+	assert.NoError(t, err)
+	assert.Same(t, defaultClient, client)
+
+	t.Setenv(common.NRRoutingRules, `[{"LogGroupPrefix": "/aws/lambda/", "Destination": "unknown"}]`)
+	_, err = NewRouter(defaultClient)
+	assert.Error(t, err)
+
+	t.Setenv(common.NRRoutingRules, `[{"LogGroupPrefix": "/aws/lambda/", "Destination": "default"}]`)
+	client, err = NewRouter(defaultClient)
+	assert.NoError(t, err)
+	assert.IsType(t, &Router{}, client)
+}
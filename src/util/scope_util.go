@@ -0,0 +1,31 @@
+package util
+
+import (
+	"strings"
+)
+
+// SourceScope limits a configuration rule to a subset of log sources.
+// A rule with LogGroupPrefix applies to CloudWatch log groups starting with that prefix.
+// A rule with BucketName applies to S3 objects in that bucket whose key starts with KeyPrefix.
+// BucketName "*" matches every bucket.
+type SourceScope struct {
+	LogGroupPrefix string `json:"LogGroupPrefix"` // Prefix of the CloudWatch log group names the rule applies to
+	BucketName     string `json:"BucketName"`     // Name of the S3 bucket the rule applies to
+	KeyPrefix      string `json:"KeyPrefix"`      // Prefix of the S3 object keys the rule applies to
+}
+
+// MatchesLogGroup checks whether the scope covers the given CloudWatch log group.
+func (scope SourceScope) MatchesLogGroup(logGroup string) bool {
+	return scope.LogGroupPrefix != "" && strings.HasPrefix(logGroup, scope.LogGroupPrefix)
+}
+
+// MatchesObject checks whether the scope covers the given S3 object.
+func (scope SourceScope) MatchesObject(bucketName string, objectKey string) bool {
+	if scope.BucketName == "" {
+		return false
+	}
+	if scope.BucketName != "*" && scope.BucketName != bucketName {
+		return false
+	}
+	return strings.HasPrefix(objectKey, scope.KeyPrefix)
+}
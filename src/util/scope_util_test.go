@@ -0,0 +1,60 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSourceScope tests matching of log groups and S3 objects against a SourceScope.
+func TestSourceScope(t *testing.T) {
+	tests := []struct {
+		name      string      // Test case name
+		scope     SourceScope // Scope under test
+		logGroup  string      // Log group to match
+		bucket    string      // Bucket to match
+		key       string      // Object key to match
+		wantGroup bool        // Expected log group match
+		wantObj   bool        // Expected object match
+	}{
+		{
+			name:      "Log group prefix",
+			scope:     SourceScope{LogGroupPrefix: "/aws/lambda/"},
+			logGroup:  "/aws/lambda/my-function",
+			bucket:    "bucket",
+			key:       "key",
+			wantGroup: true,
+			wantObj:   false,
+		},
+		{
+			name:      "Bucket and key prefix",
+			scope:     SourceScope{BucketName: "bucket", KeyPrefix: "app/"},
+			logGroup:  "/aws/lambda/my-function",
+			bucket:    "bucket",
+			key:       "app/file.log",
+			wantGroup: false,
+			wantObj:   true,
+		},
+		{
+			name:    "Key prefix mismatch",
+			scope:   SourceScope{BucketName: "bucket", KeyPrefix: "app/"},
+			bucket:  "bucket",
+			key:     "other/file.log",
+			wantObj: false,
+		},
+		{
+			name:    "Wildcard bucket",
+			scope:   SourceScope{BucketName: "*"},
+			bucket:  "any-bucket",
+			key:     "file.log",
+			wantObj: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantGroup, tt.scope.MatchesLogGroup(tt.logGroup))
+			assert.Equal(t, tt.wantObj, tt.scope.MatchesObject(tt.bucket, tt.key))
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+)
+
+// Types of the sinks configured in NR_SINKS.
+const (
+	SinkNewRelic = "newrelic" // SinkNewRelic sends the logs with the client of the selected exporter, routed to their accounts.
+	SinkStdout   = "stdout"   // SinkStdout writes the logs to the standard output as NDJSON.
+	SinkFile     = "file"     // SinkFile appends the logs to a local file as NDJSON.
+	SinkHTTP     = "http"     // SinkHTTP posts the log batches to an HTTP endpoint.
+)
+
+// Failure policies of the sinks of a FanOutSink.
+const (
+	SinkFailureFail   = "fail"   // SinkFailureFail fails the batch when the sink fails, so that it is retried and dead-lettered.
+	SinkFailureIgnore = "ignore" // SinkFailureIgnore logs the failures of the sink and ignores them.
+)
+
+// SinkConfig configures a sink of NR_SINKS.
+type SinkConfig struct {
+	Type      string            `json:"Type"`      // Type of the sink: newrelic, stdout, file or http
+	Name      string            `json:"Name"`      // Name of the sink in errors and logs, its type when not set
+	Path      string            `json:"Path"`      // Path of the file of a file sink
+	URL       string            `json:"URL"`       // URL of the endpoint of an http sink
+	Headers   map[string]string `json:"Headers"`   // Headers sent by an http sink
+	Gzip      bool              `json:"Gzip"`      // Whether an http sink compresses its requests
+	OnFailure string            `json:"OnFailure"` // Failure policy of the sink: fail, the default, or ignore
+}
+
+// NDJSONSink is a NewRelicClientAPI writing every log of a batch as a line of JSON,
+// with the common attributes merged into the attributes of the log.
+type NDJSONSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewNDJSONSink creates an NDJSONSink writing to the writer.
+func NewNDJSONSink(writer io.Writer) *NDJSONSink {
+	return &NDJSONSink{writer: writer}
+}
+
+// CreateLogEntry writes the logs of a batch. The lines of a batch are written at once, so that batches sent
+// by several workers are not interleaved.
+func (s *NDJSONSink) CreateLogEntry(logEntry interface{}) error {
+	batch, ok := logEntry.(common.DetailedLogsBatch)
+	if !ok {
+		return fmt.Errorf("%w: unsupported log entry type %T", ErrInvalidLogEntry, logEntry)
+	}
+
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, detailedLog := range batch {
+		for _, entry := range detailedLog.Entries {
+			attributes := common.LogAttributes{}
+			for name, value := range detailedLog.CommonData.Attributes {
+				attributes[name] = value
+			}
+			for name, value := range entry.Attributes {
+				attributes[name] = value
+			}
+			if entry.Timestamp == "" {
+				entry.Timestamp = detailedLog.CommonData.Timestamp
+			}
+			entry.Attributes = attributes
+			if err := encoder.Encode(entry); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidLogEntry, err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.writer.Write(lines.Bytes())
+	return err
+}
+
+// HTTPSink is a NewRelicClientAPI posting every log batch, in the format of the Log API, to an HTTP endpoint.
+type HTTPSink struct {
+	url        string
+	headers    map[string]string
+	gzip       bool
+	httpClient *http.Client
+	retryAfter *retryAfterTransport
+}
+
+// NewHTTPSink creates an HTTPSink posting to the URL with the headers, compressing the requests with gzip when asked to.
+func NewHTTPSink(endpoint string, headers map[string]string, compress bool) (*HTTPSink, error) {
+	if _, err := url.ParseRequestURI(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid http sink URL %q: %w", endpoint, err)
+	}
+	transport, err := newHTTPTransport()
+	if err != nil {
+		return nil, err
+	}
+	retryAfter := &retryAfterTransport{next: transport}
+	return &HTTPSink{
+		url:        endpoint,
+		headers:    headers,
+		gzip:       compress,
+		httpClient: &http.Client{Transport: retryAfter, Timeout: httpTimeout()},
+		retryAfter: retryAfter,
+	}, nil
+}
+
+// CreateLogEntry posts a log batch.
+func (s *HTTPSink) CreateLogEntry(logEntry interface{}) error {
+	return s.CreateLogEntryWithContext(context.Background(), logEntry)
+}
+
+// CreateLogEntryWithContext posts a log batch, the request being cancelled once the context is done.
+func (s *HTTPSink) CreateLogEntryWithContext(ctx context.Context, logEntry interface{}) error {
+	body, err := json.Marshal(logEntry)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidLogEntry, err)
+	}
+	if s.gzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		return &HTTPStatusError{StatusCode: resp.StatusCode, Body: string(responseBody), NotBefore: s.retryAfter.retryNotBefore()}
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// namedSink is a sink of a FanOutSink with its failure policy.
+type namedSink struct {
+	name      string
+	client    NewRelicClientAPI
+	onFailure string
+}
+
+// FanOutSink is a NewRelicClientAPI sending every log batch to several sinks in parallel.
+// A batch fails when a sink with the fail policy fails; it is then retried on the sinks that failed only.
+type FanOutSink struct {
+	sinks []namedSink
+}
+
+// sinkSend is a send of logs to a sink of a FanOutSink.
+type sinkSend struct {
+	sink namedSink
+	send func(ctx context.Context) error
+	logs common.DetailedLogsBatch // logs holds the logs sent, reported as not sent when the send fails.
+}
+
+// CreateLogEntry sends a log batch to every sink and returns the errors of the sinks with the fail policy.
+// When not every sink fails, it returns a *PartialSendError resending the batch to the sinks that failed only.
+func (s *FanOutSink) CreateLogEntry(logEntry interface{}) error {
+	return s.CreateLogEntryWithContext(context.Background(), logEntry)
+}
+
+// CreateLogEntryWithContext sends a log batch to every sink like CreateLogEntry, passing the context to the sinks.
+func (s *FanOutSink) CreateLogEntryWithContext(ctx context.Context, logEntry interface{}) error {
+	batch, _ := logEntry.(common.DetailedLogsBatch)
+	sends := make([]sinkSend, len(s.sinks))
+	for i, sink := range s.sinks {
+		sends[i] = sinkSend{sink: sink, send: func(ctx context.Context) error { return createLogEntry(ctx, sink.client, logEntry) }, logs: batch}
+	}
+	return fanOut(ctx, batch, sends)
+}
+
+// fanOut runs the sends of a batch in parallel and returns the errors of the sinks with the fail policy, as a *PartialSendError
+// retrying the sends that failed when some logs were sent. A sink that is itself sent in part is retried with its Resend.
+func fanOut(ctx context.Context, batch common.DetailedLogsBatch, sends []sinkSend) error {
+	errs := make([]error, len(sends))
+	retries := make([]*sinkSend, len(sends))
+	var wg sync.WaitGroup
+	for i, send := range sends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := send.send(ctx)
+			if err == nil {
+				return
+			}
+			if send.sink.onFailure == SinkFailureIgnore {
+				log.Warnf("ignoring failure of sink %s: %v", send.sink.name, err)
+				return
+			}
+			errs[i] = fmt.Errorf("sink %s: %w", send.sink.name, err)
+			retries[i] = &send
+			if partial, ok := err.(*PartialSendError); ok {
+				retries[i] = &sinkSend{sink: send.sink, send: partial.Resend, logs: partial.Unsent}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []sinkSend
+	sentInPart := false
+	for i, retry := range retries {
+		if retry == nil {
+			continue
+		}
+		failed = append(failed, *retry)
+		sentInPart = sentInPart || len(retry.logs) < len(sends[i].logs)
+	}
+	err := errors.Join(errs...)
+	if err == nil || (len(failed) == len(sends) && !sentInPart) {
+		return err
+	}
+
+	// The logs not sent are those of the single sink that failed, or the whole batch when several sinks failed.
+	unsent := failed[0].logs
+	if len(failed) > 1 {
+		unsent = batch
+	}
+	return &PartialSendError{
+		Err:    err,
+		Unsent: unsent,
+		Resend: func(ctx context.Context) error { return fanOut(ctx, batch, failed) },
+	}
+}
+
+// ParseSinkConfigs parses the sinks configuration and validates every sink.
+func ParseSinkConfigs(jsonString string) ([]SinkConfig, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var configs []SinkConfig
+	if err := json.Unmarshal([]byte(jsonString), &configs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sinks config: %w", err)
+	}
+	for i, config := range configs {
+		if config.Name == "" {
+			configs[i].Name = config.Type
+		}
+		switch config.OnFailure {
+		case "":
+			configs[i].OnFailure = SinkFailureFail
+		case SinkFailureFail, SinkFailureIgnore:
+		default:
+			return nil, fmt.Errorf("sink %s has an invalid failure policy %q, expected %s or %s", configs[i].Name, config.OnFailure, SinkFailureFail, SinkFailureIgnore)
+		}
+		switch config.Type {
+		case SinkNewRelic, SinkStdout:
+		case SinkFile:
+			if config.Path == "" {
+				return nil, fmt.Errorf("file sink %s has no Path", configs[i].Name)
+			}
+		case SinkHTTP:
+			if config.URL == "" {
+				return nil, fmt.Errorf("http sink %s has no URL", configs[i].Name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown sink type %q, expected %s, %s, %s or %s", config.Type, SinkNewRelic, SinkStdout, SinkFile, SinkHTTP)
+		}
+	}
+	return configs, nil
+}
+
+// NewSink creates the client the logs are sent with. When NR_SINKS is not set it is the client created by newRelicClient,
+// otherwise it is a FanOutSink sending to the configured sinks, newRelicClient being only called for a newrelic sink.
+func NewSink(newRelicClient func() (NewRelicClientAPI, error)) (NewRelicClientAPI, error) {
+	configs, err := ParseSinkConfigs(os.Getenv(common.Sinks))
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return newRelicClient()
+	}
+
+	fanOut := &FanOutSink{}
+	for _, config := range configs {
+		client, err := newSinkClient(config, newRelicClient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sink %s: %w", config.Name, err)
+		}
+		fanOut.sinks = append(fanOut.sinks, namedSink{name: config.Name, client: client, onFailure: config.OnFailure})
+	}
+	return fanOut, nil
+}
+
+// newSinkClient creates the client of a sink.
+func newSinkClient(config SinkConfig, newRelicClient func() (NewRelicClientAPI, error)) (NewRelicClientAPI, error) {
+	switch config.Type {
+	case SinkNewRelic:
+		return newRelicClient()
+	case SinkStdout:
+		return NewNDJSONSink(os.Stdout), nil
+	case SinkFile:
+		file, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return NewNDJSONSink(file), nil
+	default:
+		return NewHTTPSink(config.URL, config.Headers, config.Gzip)
+	}
+}
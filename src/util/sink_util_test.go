@@ -0,0 +1,313 @@
+package util
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/newrelic/aws-unified-lambda-logging/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// sinkTestBatch returns a log batch with two logs.
+func sinkTestBatch() common.DetailedLogsBatch {
+	return common.DetailedLogsBatch{{
+		CommonData: common.Common{Attributes: common.LogAttributes{"logGroup": "/aws/lambda/api", "level": "info"}},
+		Entries: common.LogData{
+			{Timestamp: "1700000000123", Log: "first", Attributes: common.LogAttributes{"level": "error"}},
+			{Log: "second"},
+		},
+	}}
+}
+
+// TestNDJSONSink tests that every log is written as a line with the common attributes merged into its attributes.
+func TestNDJSONSink(t *testing.T) {
+	var output bytes.Buffer
+	sink := NewNDJSONSink(&output)
+
+	assert.NoError(t, sink.CreateLogEntry(sinkTestBatch()))
+	assert.Equal(t,
+		`{"timestamp":"1700000000123","attributes":{"level":"error","logGroup":"/aws/lambda/api"},"log":"first"}`+"\n"+
+			`{"timestamp":"","attributes":{"level":"info","logGroup":"/aws/lambda/api"},"log":"second"}`+"\n",
+		output.String())
+
+	assert.ErrorIs(t, sink.CreateLogEntry("not a batch"), ErrInvalidLogEntry)
+}
+
+// TestHTTPSink tests the requests posted by an HTTP sink, with and without compression.
+func TestHTTPSink(t *testing.T) {
+	tests := []struct {
+		name    string // Test case name
+		gzip    bool   // Whether the sink compresses its requests
+		status  int    // Status code of the response
+		wantErr string // Expected error, empty if none
+	}{
+		{
+			name:   "Uncompressed",
+			status: http.StatusAccepted,
+		},
+		{
+			name:   "Compressed",
+			gzip:   true,
+			status: http.StatusOK,
+		},
+		{
+			name:    "Server error",
+			status:  http.StatusBadGateway,
+			wantErr: "502 response returned: unavailable",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				assert.Equal(t, "token", r.Header.Get("X-Api-Key"))
+				body := io.Reader(r.Body)
+				if tc.gzip {
+					assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+					reader, err := gzip.NewReader(r.Body)
+					assert.NoError(t, err)
+					body = reader
+				}
+				var batch common.DetailedLogsBatch
+				assert.NoError(t, json.NewDecoder(body).Decode(&batch))
+				assert.Len(t, batch[0].Entries, 2)
+
+				w.WriteHeader(tc.status)
+				if tc.wantErr != "" {
+					_, _ = w.Write([]byte("unavailable"))
+				}
+			}))
+			defer server.Close()
+
+			sink, err := NewHTTPSink(server.URL, map[string]string{"X-Api-Key": "token"}, tc.gzip)
+			assert.NoError(t, err)
+			err = sink.CreateLogEntry(sinkTestBatch())
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// TestFanOutSink tests that every sink receives the batch and that only the failures of sinks with the fail policy are returned.
+func TestFanOutSink(t *testing.T) {
+	primary := new(MockNRClient)
+	secondary := new(MockNRClient)
+	tee := new(MockNRClient)
+	batch := sinkTestBatch()
+	primary.On("CreateLogEntry", batch).Return(nil)
+	secondary.On("CreateLogEntry", batch).Return(errors.New("timeout"))
+	tee.On("CreateLogEntry", batch).Return(errors.New("unreachable"))
+
+	sink := &FanOutSink{sinks: []namedSink{
+		{name: "newrelic", client: primary, onFailure: SinkFailureFail},
+		{name: "backup", client: secondary, onFailure: SinkFailureFail},
+		{name: "tee", client: tee, onFailure: SinkFailureIgnore},
+	}}
+	assert.EqualError(t, sink.CreateLogEntry(batch), "log batch sent in part: sink backup: timeout")
+	mock.AssertExpectationsForObjects(t, primary, secondary, tee)
+}
+
+// TestFanOutSinkRetry tests that a batch is retried on the sinks that failed only, and on the logs a sink sent in part did not send.
+func TestFanOutSinkRetry(t *testing.T) {
+	batch := append(sinkTestBatch(), sinkTestBatch()...)
+	unsent := batch[1:]
+
+	// The newrelic sink sends the batch in part, its logs not sent are resent once.
+	newRelic := new(MockNRClient)
+	resent := 0
+	newRelic.On("CreateLogEntry", batch).Return(&PartialSendError{
+		Err:    errors.New("503 response returned"),
+		Unsent: unsent,
+		Resend: func(context.Context) error { resent++; return nil },
+	}).Once()
+	// The backup sink fails once, the tee sink is never retried.
+	backup := new(MockNRClient)
+	backup.On("CreateLogEntry", batch).Return(errors.New("502 response returned")).Once()
+	backup.On("CreateLogEntry", batch).Return(nil).Once()
+	tee := new(MockNRClient)
+	tee.On("CreateLogEntry", batch).Return(errors.New("unreachable")).Once()
+
+	sink := &FanOutSink{sinks: []namedSink{
+		{name: "newrelic", client: newRelic, onFailure: SinkFailureFail},
+		{name: "backup", client: backup, onFailure: SinkFailureFail},
+		{name: "tee", client: tee, onFailure: SinkFailureIgnore},
+	}}
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	assert.NoError(t, SendWithRetry(context.Background(), sink, batch, policy))
+	assert.Equal(t, 1, resent)
+	mock.AssertExpectationsForObjects(t, newRelic, backup, tee)
+
+	// The logs reported as not sent are those of the single sink still failing.
+	newRelic.On("CreateLogEntry", batch).Return(&PartialSendError{
+		Err:    errors.New("503 response returned"),
+		Unsent: unsent,
+		Resend: func(context.Context) error { return errors.New("503 response returned") },
+	}).Once()
+	backup.On("CreateLogEntry", batch).Return(nil).Once()
+	tee.On("CreateLogEntry", batch).Return(nil).Once()
+
+	var sendErr *SendError
+	assert.ErrorAs(t, SendWithRetry(context.Background(), sink, batch, policy), &sendErr)
+	assert.Equal(t, 3, sendErr.Attempts)
+	assert.Equal(t, unsent, sendErr.Batch)
+	mock.AssertExpectationsForObjects(t, newRelic, backup, tee)
+}
+
+// TestSendWithRetryHangingEndpoint tests that the request of an attempt to an endpoint that does not answer is cancelled
+// at the deadline of the context, rather than after the HTTP timeout.
+func TestSendWithRetryHangingEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string                                           // Test case name
+		newClient func(endpoint string) (NewRelicClientAPI, error) // Creates the client sending to the endpoint
+	}{
+		{
+			name: "HTTP sink",
+			newClient: func(endpoint string) (NewRelicClientAPI, error) {
+				return NewHTTPSink(endpoint, nil, true)
+			},
+		},
+		{
+			name: "OTLP exporter",
+			newClient: func(endpoint string) (NewRelicClientAPI, error) {
+				t.Setenv(common.OTLPLogsEndpoint, endpoint)
+				return NewOTLPExporter()
+			},
+		},
+		{
+			name: "HTTP sink behind a fan out",
+			newClient: func(endpoint string) (NewRelicClientAPI, error) {
+				sink, err := NewHTTPSink(endpoint, nil, false)
+				return &FanOutSink{sinks: []namedSink{{name: "http", client: sink, onFailure: SinkFailureFail}}}, err
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+			}))
+			defer server.Close()
+			defer close(release)
+
+			client, err := tc.newClient(server.URL)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err = SendWithRetry(ctx, client, sinkTestBatch(), RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+			assert.Less(t, time.Since(start), 5*time.Second)
+			var sendErr *SendError
+			assert.ErrorAs(t, err, &sendErr)
+			assert.Equal(t, 1, sendErr.Attempts)
+			assert.False(t, sendErr.Permanent)
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		})
+	}
+}
+
+// TestParseSinkConfigs tests the validation of the sinks configuration.
+func TestParseSinkConfigs(t *testing.T) {
+	tests := []struct {
+		name       string       // Test case name
+		jsonString string       // Configuration to parse
+		expected   []SinkConfig // Expected sinks
+		wantErr    string       // Expected error, empty if none
+	}{
+		{
+			name: "No sinks",
+		},
+		{
+			name:       "Dry run and tee",
+			jsonString: `[{"Type": "stdout"}, {"Type": "http", "Name": "collector", "URL": "https://example.com", "OnFailure": "ignore"}]`,
+			expected: []SinkConfig{
+				{Type: SinkStdout, Name: SinkStdout, OnFailure: SinkFailureFail},
+				{Type: SinkHTTP, Name: "collector", URL: "https://example.com", OnFailure: SinkFailureIgnore},
+			},
+		},
+		{
+			name:       "Unknown type",
+			jsonString: `[{"Type": "kafka"}]`,
+			wantErr:    `unknown sink type "kafka", expected newrelic, stdout, file or http`,
+		},
+		{
+			name:       "File sink without path",
+			jsonString: `[{"Type": "file"}]`,
+			wantErr:    "file sink file has no Path",
+		},
+		{
+			name:       "HTTP sink without URL",
+			jsonString: `[{"Type": "http", "Name": "tee"}]`,
+			wantErr:    "http sink tee has no URL",
+		},
+		{
+			name:       "Invalid failure policy",
+			jsonString: `[{"Type": "newrelic", "OnFailure": "retry"}]`,
+			wantErr:    `sink newrelic has an invalid failure policy "retry", expected fail or ignore`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			configs, err := ParseSinkConfigs(tc.jsonString)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, configs)
+		})
+	}
+}
+
+// TestNewSink tests that the New Relic client is only created when a newrelic sink is configured, and the file sink.
+func TestNewSink(t *testing.T) {
+	nrClient := new(MockNRClient)
+	created := 0
+	newRelicClient := func() (NewRelicClientAPI, error) {
+		created++
+		return nrClient, nil
+	}
+
+	client, err := NewSink(newRelicClient)
+	assert.NoError(t, err)
+	assert.Same(t, nrClient, client)
+	assert.Equal(t, 1, created)
+
+	path := filepath.Join(t.TempDir(), "logs.ndjson")
+	t.Setenv(common.Sinks, `[{"Type": "file", "Path": "`+path+`"}]`)
+	client, err = NewSink(newRelicClient)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, created)
+	assert.NoError(t, client.CreateLogEntry(sinkTestBatch()))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(content, []byte("\n")))
+
+	t.Setenv(common.Sinks, `[{"Type": "newrelic"}, {"Type": "stdout", "OnFailure": "ignore"}]`)
+	client, err = NewSink(newRelicClient)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, created)
+	assert.IsType(t, &FanOutSink{}, client)
+}
@@ -0,0 +1,173 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supported values of TimestampRule.Format besides Go time layouts.
+const (
+	TimestampFormatEpochSeconds = "epoch_s"  // TimestampFormatEpochSeconds parses the value as seconds since the Unix epoch.
+	TimestampFormatEpochMillis  = "epoch_ms" // TimestampFormatEpochMillis parses the value as milliseconds since the Unix epoch.
+	TimestampFormatEpochNanos   = "epoch_ns" // TimestampFormatEpochNanos parses the value as nanoseconds since the Unix epoch.
+	TimestampFormatISO8601      = "iso8601"  // TimestampFormatISO8601 parses the value as an ISO-8601 (RFC 3339) date time.
+)
+
+// Values of the logTimestampSource attribute recording where the timestamp of a log came from.
+const (
+	TimestampSourceMessage      = "message"            // TimestampSourceMessage means the timestamp was extracted from the log line.
+	TimestampSourceLastModified = "objectLastModified" // TimestampSourceLastModified means the LastModified time of the S3 object was used.
+	TimestampSourceIngestTime   = "ingestTime"         // TimestampSourceIngestTime means no timestamp was sent and New Relic uses the ingest time.
+)
+
+// TimestampRule describes how the timestamp of a log line is extracted.
+// Either JSONField, a dot separated path into a JSON log line, or Regex is used to locate the timestamp.
+// Regex uses the capture group named "timestamp", else the first capture group, else the whole match.
+// Format is one of epoch_s, epoch_ms, epoch_ns, iso8601 or a Go time layout. It defaults to iso8601.
+type TimestampRule struct {
+	SourceScope
+	JSONField string `json:"JSONField"` // Dot separated path of the timestamp field in JSON log lines
+	Regex     string `json:"Regex"`     // Regex capturing the timestamp in text log lines
+	Format    string `json:"Format"`    // Format of the captured timestamp
+}
+
+// TimestampExtractor extracts timestamps from log lines according to a TimestampRule.
+type TimestampExtractor struct {
+	fieldPath []string
+	regex     *regexp.Regexp
+	group     int
+	format    string
+}
+
+// NewTimestampExtractor creates a TimestampExtractor for the given rule.
+func NewTimestampExtractor(rule TimestampRule) (*TimestampExtractor, error) {
+	if rule.JSONField == "" && rule.Regex == "" {
+		return nil, fmt.Errorf("timestamp rule %+v has neither a JSON field nor a regex", rule.SourceScope)
+	}
+
+	extractor := &TimestampExtractor{format: rule.Format}
+	if extractor.format == "" {
+		extractor.format = TimestampFormatISO8601
+	}
+	if rule.JSONField != "" {
+		extractor.fieldPath = strings.Split(rule.JSONField, ".")
+	}
+	if rule.Regex != "" {
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp regex %q: %w", rule.Regex, err)
+		}
+		extractor.regex = regex
+		if index := regex.SubexpIndex("timestamp"); index > 0 {
+			extractor.group = index
+		} else if regex.NumSubexp() > 0 {
+			extractor.group = 1
+		}
+	}
+	return extractor, nil
+}
+
+// NewTimestampExtractorForObject creates a TimestampExtractor using the first rule of the configuration that matches the S3 object.
+// It returns nil when no rule matches.
+func NewTimestampExtractorForObject(jsonString string, bucketName string, objectKey string) (*TimestampExtractor, error) {
+	if jsonString == "" {
+		return nil, nil
+	}
+	var rules []TimestampRule
+	if err := json.Unmarshal([]byte(jsonString), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal timestamp config: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.MatchesObject(bucketName, objectKey) {
+			return NewTimestampExtractor(rule)
+		}
+	}
+	return nil, nil
+}
+
+// Extract extracts the timestamp of the message.
+// It returns false if the extractor is nil or the message does not contain a parsable timestamp.
+func (e *TimestampExtractor) Extract(message string) (time.Time, bool) {
+	if e == nil {
+		return time.Time{}, false
+	}
+
+	var value string
+	var found bool
+	if e.fieldPath != nil {
+		value, found = extractJSONField(message, e.fieldPath)
+	}
+	if !found && e.regex != nil {
+		if matches := e.regex.FindStringSubmatch(message); matches != nil {
+			value, found = matches[e.group], true
+		}
+	}
+	if !found {
+		return time.Time{}, false
+	}
+
+	timestamp, err := ParseTimestamp(value, e.format)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return timestamp, true
+}
+
+// ParseTimestamp parses the value according to the format.
+// The format is one of epoch_s, epoch_ms, epoch_ns, iso8601 or a Go time layout.
+func ParseTimestamp(value string, format string) (time.Time, error) {
+	switch format {
+	case TimestampFormatEpochSeconds, TimestampFormatEpochMillis, TimestampFormatEpochNanos:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch format {
+		case TimestampFormatEpochSeconds:
+			return time.Unix(0, int64(number*float64(time.Second))), nil
+		case TimestampFormatEpochMillis:
+			return time.UnixMilli(int64(number)), nil
+		}
+		// Parse nanoseconds as an integer to avoid the precision loss of float64.
+		nanos, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(0, nanos), nil
+	case TimestampFormatISO8601:
+		return time.Parse(time.RFC3339Nano, value)
+	default:
+		return time.Parse(format, value)
+	}
+}
+
+// extractJSONField returns the value at the path of a JSON message as a string.
+func extractJSONField(message string, path []string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(message))
+	decoder.UseNumber()
+	var current interface{}
+	if err := decoder.Decode(&current); err != nil {
+		return "", false
+	}
+	for _, key := range path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if current, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	switch value := current.(type) {
+	case string:
+		return value, true
+	case json.Number:
+		return value.String(), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseTimestamp tests parsing timestamps in the supported formats.
+func TestParseTimestamp(t *testing.T) {
+	expected := time.Date(2024, 12, 3, 8, 38, 47, 0, time.UTC)
+
+	tests := []struct {
+		name    string // Test case name
+		value   string // Value to parse
+		format  string // Format of the value
+		wantErr bool   // Expected error
+	}{
+		{name: "Epoch seconds", value: "1733215127", format: TimestampFormatEpochSeconds},
+		{name: "Epoch milliseconds", value: "1733215127000", format: TimestampFormatEpochMillis},
+		{name: "Epoch nanoseconds", value: "1733215127000000000", format: TimestampFormatEpochNanos},
+		{name: "ISO-8601", value: "2024-12-03T08:38:47Z", format: TimestampFormatISO8601},
+		{name: "Go layout", value: "03/Dec/2024:08:38:47 +0000", format: "02/Jan/2006:15:04:05 -0700"},
+		{name: "Invalid epoch", value: "yesterday", format: TimestampFormatEpochSeconds, wantErr: true},
+		{name: "Invalid layout", value: "2024-12-03", format: TimestampFormatISO8601, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTimestamp(tt.value, tt.format)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, expected.Equal(got), "expected %v, got %v", expected, got)
+		})
+	}
+}
+
+// TestTimestampExtractor tests extracting timestamps from JSON and text log lines.
+func TestTimestampExtractor(t *testing.T) {
+	expected := time.Date(2024, 12, 3, 8, 38, 47, 0, time.UTC)
+
+	tests := []struct {
+		name    string        // Test case name
+		rule    TimestampRule // Rule used to build the extractor
+		message string        // Log line
+		found   bool          // Whether a timestamp is expected
+	}{
+		{
+			name:    "Nested JSON field",
+			rule:    TimestampRule{JSONField: "event.time", Format: TimestampFormatEpochMillis},
+			message: `{"event": {"time": 1733215127000}, "message": "hello"}`,
+			found:   true,
+		},
+		{
+			name:    "Missing JSON field",
+			rule:    TimestampRule{JSONField: "event.time"},
+			message: `{"message": "hello"}`,
+			found:   false,
+		},
+		{
+			name:    "Regex with named group",
+			rule:    TimestampRule{Regex: `^\S+ \[(?P<timestamp>[^\]]+)\]`, Format: "02/Jan/2006:15:04:05 -0700"},
+			message: `10.0.0.1 [03/Dec/2024:08:38:47 +0000] "GET / HTTP/1.1" 200`,
+			found:   true,
+		},
+		{
+			name:    "Regex with first group",
+			rule:    TimestampRule{Regex: `ts=(\S+)`},
+			message: `level=info ts=2024-12-03T08:38:47Z msg=hello`,
+			found:   true,
+		},
+		{
+			name:    "Regex without match",
+			rule:    TimestampRule{Regex: `ts=(\S+)`},
+			message: `level=info msg=hello`,
+			found:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor, err := NewTimestampExtractor(tt.rule)
+			assert.NoError(t, err)
+			got, found := extractor.Extract(tt.message)
+			assert.Equal(t, tt.found, found)
+			if tt.found {
+				assert.True(t, expected.Equal(got), "expected %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+// TestNewTimestampExtractorForObject tests selecting timestamp rules by S3 object.
+func TestNewTimestampExtractorForObject(t *testing.T) {
+	config := `[{"BucketName": "logs", "KeyPrefix": "app/", "JSONField": "time"}]`
+
+	extractor, err := NewTimestampExtractorForObject(config, "logs", "app/file.log")
+	assert.NoError(t, err)
+	assert.NotNil(t, extractor)
+
+	extractor, err = NewTimestampExtractorForObject(config, "logs", "other/file.log")
+	assert.NoError(t, err)
+	assert.Nil(t, extractor)
+	_, found := extractor.Extract(`{"time": "2024-12-03T08:38:47Z"}`)
+	assert.False(t, found)
+
+	_, err = NewTimestampExtractorForObject(`[{"BucketName": "logs"}]`, "logs", "file.log")
+	assert.Error(t, err)
+}